@@ -0,0 +1,61 @@
+package httpdshutdown
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// adminStatus is the body served by GET /status. Its Phase field, the phase's name,
+// takes precedence over the numeric Phase of the embedded Stats.
+type adminStatus struct {
+	Phase string `json:"phase"`
+	Stats
+}
+
+// AdminHandler returns a handler exposing a minimal control plane for the watcher,
+// for environments where sending signals is awkward:
+//
+//     GET  /status    the phase and connection counters from `Stats`, as JSON;
+//     POST /shutdown  starts a shutdown with `BeginShutdown` and answers 202 Accepted
+//                     without waiting for it to complete.
+//
+// The handler has no authentication of its own. It is meant for an internal listener
+// or a mux that is guarded by the caller, and must never be exposed publicly. Mount it
+// under a prefix with `http.StripPrefix`.
+//
+// Example use:
+//
+//     mux := http.NewServeMux()
+//     mux.Handle("/admin/", http.StripPrefix("/admin", watcher.AdminHandler()))
+//     go http.ListenAndServe("127.0.0.1:9090", mux)
+//
+func (w *Watcher) AdminHandler() http.Handler {
+	if w == nil {
+		panic("AdminHandler: receiver is nil")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			rw.Header().Set("Allow", "GET, HEAD")
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		stats := w.Stats()
+		rw.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(rw).Encode(adminStatus{Phase: stats.Phase.String(), Stats: stats})
+	})
+	mux.HandleFunc("/shutdown", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			rw.Header().Set("Allow", "POST")
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		go func() {
+			if err := w.BeginShutdown(); err != nil {
+				w.logf("httpdshutdown: shutdown requested over the admin handler: %v", err)
+			}
+		}()
+		rw.WriteHeader(http.StatusAccepted)
+	})
+	return mux
+}
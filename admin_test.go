@@ -0,0 +1,77 @@
+package httpdshutdown
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminHandler(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	srv := httptest.NewServer(w.AdminHandler())
+	defer srv.Close()
+	w.RecordConnState(http.StateNew)
+
+	resp, err := http.Get(srv.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status struct {
+		Phase     string `json:"phase"`
+		OpenConns int    `json:"open_conns"`
+		Draining  bool   `json:"draining"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Phase != "running" || status.OpenConns != 1 || status.Draining {
+		t.Errorf("TestAdminHandler: unexpected status %+v", status)
+	}
+
+	for _, c := range []struct{ method, path string }{{http.MethodPost, "/status"}, {http.MethodGet, "/shutdown"}} {
+		req, _ := http.NewRequest(c.method, srv.URL+c.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("TestAdminHandler: %s %s: expected 405, got %d", c.method, c.path, resp.StatusCode)
+		}
+	}
+	if w.Phase() != PhaseRunning {
+		t.Fatal("TestAdminHandler: a rejected request should not start a shutdown")
+	}
+
+	resp, err = http.Post(srv.URL+"/shutdown", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("TestAdminHandler: expected 202, got %d", resp.StatusCode)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for w.Phase() != PhaseDraining && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if w.Phase() != PhaseDraining {
+		t.Fatalf("TestAdminHandler: POST /shutdown should start a shutdown, phase is %v", w.Phase())
+	}
+	w.RecordConnState(http.StateClosed)
+	if err := w.Wait(); err != nil {
+		t.Errorf("TestAdminHandler: shutdown should complete, got %v", err)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("TestAdminHandler: a nil watcher should panic")
+		}
+	}()
+	var nilW *Watcher
+	nilW.AdminHandler()
+}
@@ -0,0 +1,73 @@
+package httpdshutdown
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// DrainRoundTripper returns an `http.RoundTripper` that extends draining to the
+// client side. Once a shutdown begins, new outbound requests fail with
+// `ErrDraining`, while requests already in flight are left alone. Each outbound
+// request is counted as an open connection until its response body is closed, so
+// `OnStop` waits for in-flight calls to downstream services. A nil next uses
+// `http.DefaultTransport`.
+//
+// Example use:
+//
+//     client := &http.Client{Transport: watcher.DrainRoundTripper(nil)}
+//
+func (w *Watcher) DrainRoundTripper(next http.RoundTripper) http.RoundTripper {
+	if w == nil {
+		panic("DrainRoundTripper: receiver is nil")
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &drainRoundTripper{w: w, next: next}
+}
+
+// drainRoundTripper is the http.RoundTripper returned by DrainRoundTripper.
+type drainRoundTripper struct {
+	w    *Watcher
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *drainRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := rt.w
+	// Checking and counting under the lock means a request either starts before
+	// the shutdown, and is waited for, or is rejected.
+	w.mu.Lock()
+	if w.draining.Load() {
+		w.mu.Unlock()
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, ErrDraining
+	}
+	w.addConnsLocked(1)
+	w.mu.Unlock()
+
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil || resp.Body == nil {
+		w.addConns(-1)
+		return resp, err
+	}
+	resp.Body = &countedBody{ReadCloser: resp.Body, done: func() { w.addConns(-1) }}
+	return resp, nil
+}
+
+// countedBody is a response body that calls done once when it is closed.
+type countedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+// Close closes the body and calls done the first time.
+func (b *countedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
@@ -0,0 +1,52 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDrainRoundTripper(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	w, _ := NewWatcher(2000)
+	client := &http.Client{Transport: w.DrainRoundTripper(nil)}
+
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := w.OpenConns(); n != 1 {
+		t.Errorf("TestDrainRoundTripper: in-flight call should be counted, got %d", n)
+	}
+
+	// The shutdown waits for the call already in flight.
+	errc := make(chan error, 1)
+	go func() { errc <- w.OnStop() }()
+	waitDraining(t, w)
+	if _, err := client.Get(ts.URL); !errors.Is(err, ErrDraining) {
+		t.Errorf("TestDrainRoundTripper: new call while draining should be rejected, got %v", err)
+	}
+	select {
+	case err := <-errc:
+		t.Fatalf("TestDrainRoundTripper: shutdown finished with a call in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("TestDrainRoundTripper: in-flight call should complete, got %q", body)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("TestDrainRoundTripper: should drain without error, got %v", err)
+	}
+	if n := w.OpenConns(); n != 0 {
+		t.Errorf("TestDrainRoundTripper: expected no open conns, got %d", n)
+	}
+}
@@ -0,0 +1,99 @@
+package httpdshutdown
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// clock is the source of time for draining, so that tests can substitute a fake
+// clock and drive timeouts without waiting on the wall clock.
+type clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After returns a channel that receives the time once d has elapsed, and a
+	// function that stops the timer.
+	After(d time.Duration) (<-chan time.Time, func())
+	// Tick returns a channel that receives the time every d, and a function that
+	// stops the ticker.
+	Tick(d time.Duration) (<-chan time.Time, func())
+}
+
+// realClock is the clock used by a Watcher unless a test replaces it.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) After(d time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTimer(d)
+	return t.C, func() { t.Stop() }
+}
+
+func (realClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTicker(d)
+	return t.C, t.Stop
+}
+
+// withClockDeadline returns a copy of parent that expires at deadline as measured by
+// c, like `context.WithDeadline` does on the wall clock, so that the contexts given
+// to hooks, gates and worker groups expire along with the timers of the drain.
+func withClockDeadline(parent context.Context, c clock, deadline time.Time) (context.Context, context.CancelFunc) {
+	if _, ok := c.(realClock); ok {
+		return context.WithDeadline(parent, deadline)
+	}
+	ctx, cancel := context.WithCancel(parent)
+	cc := &clockContext{Context: ctx, deadline: deadline}
+	timer, stopTimer := c.After(deadline.Sub(c.Now()))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-timer:
+			cc.cancel(context.DeadlineExceeded, cancel)
+		case <-ctx.Done():
+		}
+	}()
+	return cc, func() {
+		cc.cancel(context.Canceled, cancel)
+		<-done
+		stopTimer()
+	}
+}
+
+// clockContext is a context whose deadline is measured by a clock other than the
+// wall clock.
+type clockContext struct {
+	context.Context
+	deadline time.Time
+	mu       sync.Mutex
+	err      error // Set once the context is cancelled or expires.
+}
+
+// cancel records err, unless the context already ended, and cancels the context.
+func (c *clockContext) cancel(err error, cancel context.CancelFunc) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	cancel()
+}
+
+func (c *clockContext) Deadline() (time.Time, bool) { return c.deadline, true }
+
+func (c *clockContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return c.Context.Err()
+}
+
+// newWatcherWithClock constructs a Watcher like `NewWatcher` that takes its time from
+// c, so that tests can drive timeouts deterministically without waiting.
+func newWatcherWithClock(c clock, timeout time.Duration, hooks ...ShutdownHook) *Watcher {
+	w, _ := NewWatcher(0, hooks...)
+	w.timeout, w.clock = timeout, c
+	return w
+}
@@ -0,0 +1,325 @@
+package httpdshutdown
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when Advance is called.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+	changed chan struct{} // Closed and replaced whenever a waiter is added.
+}
+
+// fakeWaiter is a timer, or a ticker if period is positive.
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now(), changed: make(chan struct{})}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) (<-chan time.Time, func()) {
+	return f.add(d, 0)
+}
+
+func (f *fakeClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	return f.add(d, d)
+}
+
+func (f *fakeClock) add(d, period time.Duration) (<-chan time.Time, func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fw := &fakeWaiter{at: f.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	if d <= 0 && period == 0 {
+		// Like a real timer, one that is already due fires at once.
+		fw.c <- f.now
+		return fw.c, func() {}
+	}
+	f.waiters = append(f.waiters, fw)
+	close(f.changed)
+	f.changed = make(chan struct{})
+	return fw.c, func() { f.remove(fw) }
+}
+
+func (f *fakeClock) remove(fw *fakeWaiter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, other := range f.waiters {
+		if other == fw {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// Advance moves the clock forward by d, firing every timer and ticker that comes due.
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	pending := f.waiters[:0]
+	for _, fw := range f.waiters {
+		if fw.at.After(f.now) {
+			pending = append(pending, fw)
+			continue
+		}
+		select {
+		case fw.c <- f.now:
+		default:
+		}
+		if fw.period > 0 {
+			for !fw.at.After(f.now) {
+				fw.at = fw.at.Add(fw.period)
+			}
+			pending = append(pending, fw)
+		}
+	}
+	f.waiters = pending
+}
+
+// BlockUntil waits until at least n timers and tickers are waiting on the clock.
+func (f *fakeClock) BlockUntil(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.After(2 * time.Second)
+	for {
+		f.mu.Lock()
+		waiting, changed := len(f.waiters), f.changed
+		f.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			t.Fatalf("BlockUntil: %d waiters after 2s, expected %d", waiting, n)
+		}
+	}
+}
+
+func TestFakeClockTimeout(t *testing.T) {
+	// An hour-long grace period expires as soon as the clock is advanced past it.
+	w, _ := NewWatcher(int(time.Hour / time.Millisecond))
+	fc := newFakeClock()
+	w.clock = fc
+	w.RecordConnState(http.StateNew)
+	errc := make(chan error, 1)
+	go func() { errc <- w.OnStop() }()
+	fc.BlockUntil(t, 1)
+	fc.Advance(time.Hour - time.Millisecond)
+	select {
+	case err := <-errc:
+		t.Fatalf("TestFakeClockTimeout: OnStop returned before the timeout: %v", err)
+	default:
+	}
+	fc.Advance(time.Millisecond)
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrShutdownTimeout) {
+			t.Errorf("TestFakeClockTimeout: expected a timeout, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestFakeClockTimeout: OnStop did not time out")
+	}
+	if r := w.LastReport(); r == nil || r.Duration != time.Hour {
+		t.Errorf("TestFakeClockTimeout: report should measure fake time, got %+v", r)
+	}
+}
+
+func TestFakeClockStall(t *testing.T) {
+	w, _ := NewWatcherAdaptive(time.Second, time.Hour)
+	fc := newFakeClock()
+	w.clock = fc
+	w.RecordConnState(http.StateNew)
+	w.RecordConnState(http.StateNew)
+	errc := make(chan error, 1)
+	go func() { errc <- w.OnStop() }()
+	// The hard timeout and the stall poll.
+	fc.BlockUntil(t, 2)
+	fc.Advance(defaultPollInterval)
+	w.RecordConnState(http.StateClosed)
+	// Progress keeps the drain alive past the stall duration.
+	for i := 0; i < 19; i++ {
+		fc.Advance(defaultPollInterval)
+	}
+	select {
+	case err := <-errc:
+		t.Fatalf("TestFakeClockStall: a draining shutdown should not stall, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	// Without progress the drain stalls, well before the hard timeout.
+	for i := 0; i < 200; i++ {
+		fc.Advance(defaultPollInterval)
+		select {
+		case err := <-errc:
+			if !errors.Is(err, ErrShutdownTimeout) {
+				t.Errorf("TestFakeClockStall: expected a stall timeout, got %v", err)
+			}
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+	t.Fatal("TestFakeClockStall: OnStop did not stall")
+}
+
+func TestFakeClockContexts(t *testing.T) {
+	// advanceUntil advances fc a minute at a time until errc yields a result.
+	advanceUntil := func(fc *fakeClock, errc <-chan error) error {
+		t.Helper()
+		for i := 0; i < 200; i++ {
+			fc.Advance(time.Minute)
+			select {
+			case err := <-errc:
+				return err
+			case <-time.After(time.Millisecond):
+			}
+		}
+		t.Fatal("TestFakeClockContexts: OnStop did not return")
+		return nil
+	}
+
+	// A drain gate's context expires with the grace period on the fake clock.
+	fc := newFakeClock()
+	w := newWatcherWithClock(fc, time.Hour)
+	w.RegisterDrainGate(func(ctx context.Context) (bool, error) {
+		<-ctx.Done()
+		return false, ctx.Err()
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- w.OnStop() }()
+	if err := advanceUntil(fc, errc); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("TestFakeClockContexts: expected the gate to expire, got %v", err)
+	}
+
+	// So does a hook's, at the deadline of the grace period.
+	fc = newFakeClock()
+	start := fc.Now()
+	w = newWatcherWithClock(fc, time.Hour)
+	var deadline time.Time
+	started := make(chan struct{})
+	w.RegisterContextHook("wait", func(ctx context.Context) error {
+		deadline, _ = ctx.Deadline()
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	go func() { errc <- w.OnStop() }()
+	<-started
+	if err := advanceUntil(fc, errc); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("TestFakeClockContexts: expected the hook to expire, got %v", err)
+	}
+	if !deadline.Equal(start.Add(time.Hour)) {
+		t.Errorf("TestFakeClockContexts: expected the hook deadline on the fake clock, got %v", deadline.Sub(start))
+	}
+}
+
+func TestFakeClockHooks(t *testing.T) {
+	// A hook outliving the hooks budget on the fake clock is given up on at once.
+	fc := newFakeClock()
+	w := newWatcherWithClock(fc, time.Hour)
+	w.Configure(WithHooksTimeout(time.Minute))
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	w.RegisterNamedHook("stuck", func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- w.OnStop() }()
+	<-started
+	// The grace period and the hooks budget.
+	fc.BlockUntil(t, 2)
+	fc.Advance(time.Minute)
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrHooksTimeout) {
+			t.Errorf("TestFakeClockHooks: expected ErrHooksTimeout, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestFakeClockHooks: the hooks budget did not expire with the fake clock")
+	}
+
+	// Retries back off on the fake clock, and hook durations are measured on it.
+	fc = newFakeClock()
+	w = newWatcherWithClock(fc, time.Hour)
+	var attempts atomic.Int32
+	w.RegisterNamedHook("flaky", func() error {
+		attempts.Add(1)
+		return ErrRetryable
+	})
+	go func() { errc <- w.OnStop() }()
+	for done, i := false, 0; !done; i++ {
+		if i == 200 {
+			t.Fatal("TestFakeClockHooks: the retries did not follow the fake clock")
+		}
+		fc.Advance(time.Minute)
+		select {
+		case <-errc:
+			done = true
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if n := attempts.Load(); n != maxHookAttempts {
+		t.Errorf("TestFakeClockHooks: expected %d attempts, got %d", maxHookAttempts, n)
+	}
+	if r := w.LastReport(); r == nil || len(r.Hooks) != 1 || r.Hooks[0].Duration < time.Minute {
+		t.Errorf("TestFakeClockHooks: expected the retries to take fake minutes, got %+v", r)
+	}
+}
+
+func TestGraceCountsFromSignal(t *testing.T) {
+	w, _ := NewWatcher(100)
+	fc := newFakeClock()
+	w.clock = fc
+	// Pre-shutdown work runs as a custom action before the daemon calls OnStop.
+	_ = w.OnSignal(syscall.SIGTERM, func() error { return nil })
+	w.dispatchSignal(syscall.SIGTERM, nil)
+	fc.Advance(70 * time.Millisecond)
+
+	w.RecordConnState(http.StateNew)
+	errc := make(chan error, 1)
+	go func() { errc <- w.OnStop() }()
+	fc.BlockUntil(t, 1)
+	fc.Advance(29 * time.Millisecond)
+	select {
+	case err := <-errc:
+		t.Fatalf("TestGraceCountsFromSignal: OnStop returned early: %v", err)
+	default:
+	}
+	fc.Advance(time.Millisecond)
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrShutdownTimeout) {
+			t.Errorf("TestGraceCountsFromSignal: expected a timeout, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestGraceCountsFromSignal: OnStop should only get the remaining 30ms")
+	}
+	if r := w.LastReport(); r == nil || r.Duration != 30*time.Millisecond {
+		t.Errorf("TestGraceCountsFromSignal: expected a 30ms drain, got %+v", r)
+	}
+
+	// Reset forgets the signal.
+	w.Reset()
+	if d := w.graceTimeout(); d != 100*time.Millisecond {
+		t.Errorf("TestGraceCountsFromSignal: expected the full timeout after Reset, got %v", d)
+	}
+}
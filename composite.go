@@ -0,0 +1,78 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// NewCompositeWatcher constructs a Watcher that coordinates the shutdown of several
+// child watchers, for example one per sub-service embedded in a single binary. Its
+// `OnStop` stops all of the children concurrently with a shared deadline, waits for
+// its own connections to drain and then runs its own hooks. Errors from the children
+// are joined into the returned error.
+//
+// The shared deadline is the longest timeout among the children; use `OnStopTimeout`
+// to override it. Nil children are ignored. Only the composite needs to be passed to
+// `SigHandle`, so the children do not have to handle signals themselves.
+//
+// Example instantiation:
+//
+//     parent := httpdshutdown.NewCompositeWatcher(apiWatcher, adminWatcher)
+//     go parent.SigHandle(sigs, exitcode)
+//
+func NewCompositeWatcher(children ...*Watcher) *Watcher {
+	var timeout time.Duration
+	var kept []*Watcher
+	for _, c := range children {
+		if c == nil {
+			continue
+		}
+		kept = append(kept, c)
+		if c.timeout > timeout {
+			timeout = c.timeout
+		}
+	}
+	w, _ := NewWatcher(0)
+	w.timeout = timeout
+	w.children = kept
+	return w
+}
+
+// stopChildren starts stopping every child watcher concurrently with timeout as the
+// grace period. The returned function waits for all of them and returns their errors
+// joined. Closing cancel cancels the children that are still draining.
+func (w *Watcher) stopChildren(timeout time.Duration, cancel <-chan struct{}) func() error {
+	if len(w.children) == 0 {
+		return func() error { return nil }
+	}
+	errs := make([]error, len(w.children))
+	var wg sync.WaitGroup
+	for i, c := range w.children {
+		// Begin synchronously so every child is cancellable before this returns.
+		st := c.beginStop()
+		wg.Add(1)
+		go func(i int, c *Watcher) {
+			defer wg.Done()
+			_, errs[i] = c.finishStop(st, timeout)
+		}(i, c)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	go func() {
+		select {
+		case <-cancel:
+			for _, c := range w.children {
+				c.CancelShutdown()
+			}
+		case <-done:
+		}
+	}()
+	return func() error {
+		<-done
+		return errors.Join(errs...)
+	}
+}
@@ -0,0 +1,84 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCompositeWatcher(t *testing.T) {
+	var ran atomic.Int32
+	hook := func() error {
+		ran.Add(1)
+		return nil
+	}
+	fast, _ := NewWatcher(100, hook)
+	slow, _ := NewWatcher(300, hook)
+	parent := NewCompositeWatcher(fast, nil, slow)
+	if parent.Timeout() != 300*time.Millisecond {
+		t.Errorf("TestCompositeWatcher: shared deadline should be the longest child timeout, got %v", parent.Timeout())
+	}
+	parent.RegisterHook(hook)
+
+	// Both children drain concurrently, so the whole shutdown takes about one
+	// drain rather than the sum of them.
+	fast.RecordConnState(http.StateNew)
+	slow.RecordConnState(http.StateNew)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		fast.RecordConnState(http.StateClosed)
+		slow.RecordConnState(http.StateClosed)
+	}()
+	elapsed, err := parent.OnStopTimed()
+	if err != nil {
+		t.Errorf("TestCompositeWatcher: should not have an error, got %v", err)
+	}
+	if elapsed > 250*time.Millisecond {
+		t.Errorf("TestCompositeWatcher: children were not stopped concurrently, took %v", elapsed)
+	}
+	if n := ran.Load(); n != 3 {
+		t.Errorf("TestCompositeWatcher: expected 3 hooks to run, got %d", n)
+	}
+	if !fast.IsDraining() || !slow.IsDraining() {
+		t.Errorf("TestCompositeWatcher: children should be draining")
+	}
+}
+
+func TestCompositeWatcherErrors(t *testing.T) {
+	a, _ := NewWatcher(50)
+	b, _ := NewWatcher(50)
+	a.RecordConnState(http.StateNew)
+	parent := NewCompositeWatcher(a, b)
+	err := parent.OnStop()
+	if !errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("TestCompositeWatcherErrors: expected the child timeout to be reported, got %v", err)
+	}
+	if r := parent.LastReport(); r == nil || !r.TimedOut {
+		t.Errorf("TestCompositeWatcherErrors: report should record the timeout")
+	}
+
+	// Cancelling the parent cancels the children still draining.
+	a.Reset()
+	b.Reset()
+	parent.Reset()
+	b.RecordConnState(http.StateNew)
+	errc := make(chan error, 1)
+	go func() { errc <- parent.OnStopTimeout(10 * time.Second) }()
+	waitDraining(t, parent)
+	if err := parent.CancelShutdown(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrShutdownCancelled) {
+			t.Errorf("TestCompositeWatcherErrors: expected cancellation, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestCompositeWatcherErrors: children were not cancelled")
+	}
+	if b.IsDraining() {
+		t.Errorf("TestCompositeWatcherErrors: cancelled child should not be draining")
+	}
+}
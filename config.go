@@ -0,0 +1,114 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config is a declarative description of a Watcher, for constructing one with
+// `NewWatcherConfig` from a value that is easy to populate from a configuration file
+// and to compare in tests. It covers the common settings; the functional options of
+// `Configure` remain available for everything else. The zero Config is valid and
+// describes a watcher with a grace period of `DefaultTimeoutMS` and every other
+// setting at its default.
+type Config struct {
+	// Timeout is the grace period; zero means `DefaultTimeoutMS`.
+	Timeout time.Duration `json:"timeout"`
+	// HooksTimeout is the budget of all hooks together, as set by `WithHooksTimeout`;
+	// zero means unbounded.
+	HooksTimeout time.Duration `json:"hooks_timeout"`
+	// DrainMode is what a shutdown waits for, as set by `WithDrainMode`.
+	DrainMode DrainMode `json:"drain_mode"`
+	// MinDrain is the least time a shutdown waits, as set by `WithMinDrainTime`.
+	MinDrain time.Duration `json:"min_drain"`
+	// PreStopDelay is the wait before the drain, as set by `WithPreStopDelay`.
+	PreStopDelay time.Duration `json:"pre_stop_delay"`
+	// InterruptExitCode, if not nil, is the exit code for SIGINT, as set by
+	// `WithInterruptExitCode`; nil keeps the default panic.
+	InterruptExitCode *int `json:"interrupt_exit_code,omitempty"`
+	// SignalActions maps signals to actions, as registered by `OnSignal`.
+	SignalActions map[os.Signal]func() error `json:"-"`
+	// Logger receives the watcher's warnings, as set by `WithLogger`.
+	Logger Logger `json:"-"`
+	// Hooks are the shutdown hooks, registered in order as by `RegisterHooks`.
+	Hooks []NamedHook `json:"-"`
+}
+
+// Validate reports the first problem with cfg, if any, with the same errors that
+// `NewWatcherConfig` would return for it.
+func (cfg Config) Validate() error {
+	switch {
+	case cfg.Timeout < 0:
+		return errors.New("Config: Timeout must not be negative")
+	case cfg.HooksTimeout < 0:
+		return errors.New("Config: HooksTimeout must not be negative")
+	}
+	for sig, action := range cfg.SignalActions {
+		if action == nil {
+			return fmt.Errorf("Config: the action for %v is nil", sig)
+		}
+	}
+	// The options check everything else; try them on a scratch watcher.
+	w := new(Watcher)
+	for _, opt := range cfg.options() {
+		if err := opt(w); err != nil {
+			return fmt.Errorf("Config: %w", err)
+		}
+	}
+	if err := w.RegisterHooks(cfg.Hooks); err != nil {
+		return fmt.Errorf("Config: %w", err)
+	}
+	return nil
+}
+
+// options returns the options that apply cfg's settings other than the timeout,
+// signal actions and hooks.
+func (cfg Config) options() []Option {
+	opts := []Option{WithDrainMode(cfg.DrainMode), WithMinDrainTime(cfg.MinDrain),
+		WithPreStopDelay(cfg.PreStopDelay), WithLogger(cfg.Logger)}
+	if cfg.HooksTimeout > 0 {
+		opts = append(opts, WithHooksTimeout(cfg.HooksTimeout))
+	}
+	if cfg.InterruptExitCode != nil {
+		opts = append(opts, WithInterruptExitCode(*cfg.InterruptExitCode))
+	}
+	return opts
+}
+
+// NewWatcherConfig constructs a Watcher described by cfg, which is validated first:
+// an invalid Config returns an error and no Watcher.
+//
+// Example instantiation:
+//
+//     watcher, err := httpdshutdown.NewWatcherConfig(httpdshutdown.Config{
+//             Timeout:   10 * time.Second,
+//             DrainMode: httpdshutdown.DrainRequests,
+//             Hooks:     []httpdshutdown.NamedHook{{Name: "db", Hook: closeDB}},
+//     })
+//
+func NewWatcherConfig(cfg Config) (*Watcher, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("NewWatcherConfig: %w", err)
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeoutMS * time.Millisecond
+	}
+	w, err := NewWatcher(0)
+	if err != nil {
+		return nil, err
+	}
+	w.timeout = timeout
+	if err := w.Configure(cfg.options()...); err != nil {
+		return nil, fmt.Errorf("NewWatcherConfig: %w", err)
+	}
+	for sig, action := range cfg.SignalActions {
+		w.OnSignal(sig, action)
+	}
+	if err := w.RegisterHooks(cfg.Hooks); err != nil {
+		return nil, fmt.Errorf("NewWatcherConfig: %w", err)
+	}
+	return w, nil
+}
@@ -0,0 +1,71 @@
+package httpdshutdown
+
+import (
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNewWatcherConfig(t *testing.T) {
+	// The zero Config gives the defaults.
+	w, err := NewWatcherConfig(Config{})
+	if err != nil {
+		t.Fatalf("TestNewWatcherConfig: %v", err)
+	}
+	if w.Timeout() != DefaultTimeoutMS*time.Millisecond || w.drainMode != DrainConnections ||
+		w.hooksTimeout != 0 || w.interruptExit || len(w.HookNames()) != 0 {
+		t.Errorf("TestNewWatcherConfig: expected the defaults, got %s", w.DebugString())
+	}
+
+	code := 130
+	var rotated bool
+	w, err = NewWatcherConfig(Config{
+		Timeout:           1500 * time.Millisecond,
+		HooksTimeout:      time.Second,
+		DrainMode:         DrainRequests,
+		MinDrain:          200 * time.Millisecond,
+		PreStopDelay:      100 * time.Millisecond,
+		InterruptExitCode: &code,
+		SignalActions: map[os.Signal]func() error{syscall.SIGUSR2: func() error {
+			rotated = true
+			return nil
+		}},
+		Logger: log.New(os.Stderr, "", 0),
+		Hooks:  []NamedHook{{Name: "flush", Hook: sampleShutdownHook}, {Name: "db", Hook: sampleShutdownHook}},
+	})
+	if err != nil {
+		t.Fatalf("TestNewWatcherConfig: %v", err)
+	}
+	if w.Timeout() != 1500*time.Millisecond || w.hooksTimeout != time.Second || w.drainMode != DrainRequests ||
+		w.minDrain != 200*time.Millisecond || w.preStopDelay != 100*time.Millisecond ||
+		!w.interruptExit || w.interruptCode != 130 || w.logger == nil {
+		t.Errorf("TestNewWatcherConfig: settings not applied: %s", w.DebugString())
+	}
+	if names := strings.Join(w.HookNames(), ","); names != "flush,db" {
+		t.Errorf("TestNewWatcherConfig: expected the hooks in order, got %s", names)
+	}
+	if _, terminal := w.dispatchSignal(syscall.SIGUSR2, nil); terminal || !rotated {
+		t.Errorf("TestNewWatcherConfig: expected the signal action to run")
+	}
+
+	bad := 300
+	for _, cfg := range []Config{
+		{Timeout: -time.Second},
+		{HooksTimeout: -time.Second},
+		{DrainMode: DrainMode(7)},
+		{MinDrain: -time.Second},
+		{InterruptExitCode: &bad},
+		{SignalActions: map[os.Signal]func() error{syscall.SIGUSR1: nil}},
+		{Hooks: []NamedHook{{Name: "db", Hook: sampleShutdownHook}, {Name: "db", Hook: sampleShutdownHook}}},
+	} {
+		if cfg.Validate() == nil {
+			t.Errorf("TestNewWatcherConfig: %+v should not validate", cfg)
+		}
+		if w, err := NewWatcherConfig(cfg); w != nil || err == nil {
+			t.Errorf("TestNewWatcherConfig: %+v should be rejected", cfg)
+		}
+	}
+}
@@ -0,0 +1,558 @@
+package httpdshutdown
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DrainMode selects what a shutdown waits for before running hooks.
+type DrainMode int
+
+const (
+	// DrainConnections waits for every connection to close. With keep-alive, a
+	// connection stays open after its request completes, until the client or a
+	// server timeout closes it.
+	DrainConnections DrainMode = iota
+	// DrainRequests waits only until no request is in flight. Idle keep-alive
+	// connections are closed when the shutdown begins, and connections that go
+	// idle during the drain are closed as their requests complete. This mode
+	// needs connection identities, so states must be recorded through
+	// `ConnStateHook` or `WrapConnState`.
+	DrainRequests
+)
+
+// ConnClass tags a connection so that the watcher can apply a draining policy suited
+// to how long the connection is expected to live.
+type ConnClass int
+
+const (
+	// ShortLived connections carry ordinary requests. During a shutdown the watcher
+	// simply waits, up to the timeout, for them to close.
+	ShortLived ConnClass = iota
+	// LongLived connections, such as WebSocket or server-sent event streams, may stay
+	// open for hours and would otherwise always exhaust the timeout. When a shutdown
+	// begins, every closer registered with `RegisterLongLivedCloser` is invoked so the
+	// application can end these streams; they are then waited for like any other
+	// connection.
+	LongLived
+)
+
+// HijackPolicy selects how a `StateHijacked` transition affects the open connection
+// count. See `WithHijackPolicy`.
+type HijackPolicy int
+
+const (
+	// HijackAsClosed stops counting a connection once it is hijacked, as if it had
+	// closed. This suits servers whose handlers finish with the connection before
+	// returning.
+	HijackAsClosed HijackPolicy = iota
+	// HijackAsOpen keeps a hijacked connection counted as open until the application
+	// calls `ReleaseHijacked`, for servers that hand hijacked connections, such as
+	// WebSockets, to code that outlives the handler.
+	HijackAsOpen
+)
+
+// RecordConnStateTagged behaves like `RecordConnState` but also counts the connection
+// under the given class. All state transitions for one connection should be recorded
+// with the same class.
+func (w *Watcher) RecordConnStateTagged(newState http.ConnState, class ConnClass) {
+	if w == nil {
+		panic("RecordConnStateTagged: receiver is nil")
+	}
+	w.recordConn(nil, "", newState, class)
+}
+
+// recordConn applies a connection state transition. conn is nil when the caller does
+// not know which connection changed state, and addr is empty when it does not know
+// which server the connection belongs to.
+func (w *Watcher) recordConn(conn net.Conn, addr string, newState http.ConnState, class ConnClass) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.countPaused {
+		return
+	}
+	if conn != nil && newState == http.StateNew && w.maxConns > 0 &&
+		(w.draining.Load() || len(w.conns) >= w.maxConns) {
+		// Count the rejected conn so the StateClosed the server reports in turn
+		// stays balanced, but do not track it against the limit.
+		w.rejectedConns++
+		w.totalConns++
+		w.addConnsLocked(1)
+		go conn.Close()
+		return
+	}
+	if conn != nil {
+		w.trackConnLocked(conn, addr, newState, class)
+	}
+	switch newState {
+	case http.StateNew:
+		w.totalConns++
+		w.addConnsLocked(1)
+		if class == LongLived {
+			w.longLived++
+		}
+	case http.StateHijacked:
+		w.hijackedConns++
+		if w.trackHijacked && conn != nil {
+			if w.hijacked == nil {
+				w.hijacked = make(map[net.Conn]ConnClass)
+			}
+			w.hijacked[conn] = class
+			return
+		}
+		w.closeConnLocked(class)
+	case http.StateClosed:
+		w.closedConns++
+		w.closeConnLocked(class)
+	}
+}
+
+// connInfo is what the watcher knows about a connection whose identity was reported
+// through `ConnStateHook` or `WrapConnState`.
+type connInfo struct {
+	state    http.ConnState // Most recent state.
+	since    time.Time      // When the connection entered state.
+	addr     string         // Address of the server that accepted the conn, if known.
+	critical bool           // Its request in flight was marked with MarkCritical.
+}
+
+// trackConnLocked follows the state of an identified connection, counting those with
+// a request in flight. In DrainRequests mode an identified connection that goes idle
+// during a shutdown is closed, since its request has completed. w.mu must be held.
+func (w *Watcher) trackConnLocked(conn net.Conn, addr string, newState http.ConnState, class ConnClass) {
+	info := w.conns[conn]
+	if info == nil {
+		if newState != http.StateNew {
+			return
+		}
+		if w.conns == nil {
+			w.conns = make(map[net.Conn]*connInfo)
+		}
+		info = &connInfo{addr: addr}
+		w.conns[conn] = info
+		if addr != "" {
+			w.addAddrConnLocked(addr, 1)
+		}
+	}
+	if info.state == http.StateActive && newState != http.StateActive {
+		w.addActiveLocked(-1)
+	} else if info.state != http.StateActive && newState == http.StateActive {
+		w.addActiveLocked(1)
+	}
+	info.state, info.since = newState, w.clock.Now()
+	switch newState {
+	case http.StateIdle:
+		// A critical connection only holds up a drain until its request completes.
+		wasCritical := info.critical
+		info.critical = false
+		if (w.drainMode == DrainRequests || wasCritical) && w.draining.Load() {
+			// Close asynchronously; the server reports StateClosed in turn.
+			go conn.Close()
+		}
+	case http.StateHijacked, http.StateClosed:
+		delete(w.conns, conn)
+		if info.addr != "" {
+			w.addAddrConnLocked(info.addr, -1)
+		}
+	}
+}
+
+// addAddrConnLocked adjusts the open connection count for the server at addr. w.mu
+// must be held.
+func (w *Watcher) addAddrConnLocked(addr string, delta int) {
+	if w.connsByAddr == nil {
+		w.connsByAddr = make(map[string]int)
+	}
+	if n := w.connsByAddr[addr] + delta; n > 0 {
+		w.connsByAddr[addr] = n
+	} else {
+		w.connsByAddr[addr] = 0
+	}
+}
+
+// OpenConnsByAddr returns the number of open connections for each attached server,
+// keyed by the server's `Addr`, so that for example a drained admin server can be
+// told apart from a busy API server. Every attached server has an entry, even with
+// no connections open. Hijacked connections are no longer counted by address.
+func (w *Watcher) OpenConnsByAddr() map[string]int {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	counts := make(map[string]int, len(w.connsByAddr))
+	for addr, n := range w.connsByAddr {
+		counts[addr] = n
+	}
+	return counts
+}
+
+// addActiveLocked adjusts the count of identified connections with a request in
+// flight. The idle channel is closed while that count is zero. w.mu must be held.
+func (w *Watcher) addActiveLocked(delta int) {
+	n := w.activeConns + delta
+	if n < 0 {
+		n = 0
+	}
+	if w.activeConns == 0 && n > 0 {
+		w.idle = make(chan struct{})
+	} else if w.activeConns > 0 && n == 0 {
+		close(w.idle)
+	}
+	w.activeConns = n
+}
+
+// closeIdleConns closes every identified connection that has no request in flight.
+func (w *Watcher) closeIdleConns() {
+	w.mu.Lock()
+	var idle []net.Conn
+	for conn, info := range w.conns {
+		if info.state == http.StateIdle {
+			idle = append(idle, conn)
+		}
+	}
+	w.mu.Unlock()
+	for _, conn := range idle {
+		conn.Close()
+	}
+}
+
+// OnForceClose registers fn to be called with every connection the watcher
+// force-closes, once it is closed, for post-incident analysis of the clients whose
+// requests were cut off; `net.Conn.RemoteAddr` still works on a closed connection.
+// Connections are force-closed when a shutdown times out with `WithForceClose`, and
+// when one is escalated by a second signal or interrupted with
+// `OnStopInterruptible`. Every registered function is called, in registration order,
+// from the shutdown's goroutine.
+//
+// Example use:
+//
+//     watcher.OnForceClose(func(conn net.Conn) {
+//             log.Printf("cut off %v", conn.RemoteAddr())
+//     })
+//
+func (w *Watcher) OnForceClose(fn func(conn net.Conn)) error {
+	if w == nil {
+		return fmt.Errorf("OnForceClose: %w", ErrNilWatcher)
+	}
+	if fn == nil {
+		return errors.New("OnForceClose: fn is nil")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.forceCloseFns = append(w.forceCloseFns, fn)
+	return nil
+}
+
+// forceCloseConns closes every identified connection, calling before, if not nil,
+// with each one first, and the functions registered with OnForceClose after.
+func (w *Watcher) forceCloseConns(before func(net.Conn)) {
+	w.mu.Lock()
+	open := make([]net.Conn, 0, len(w.conns))
+	for conn := range w.conns {
+		open = append(open, conn)
+	}
+	after := append([]func(net.Conn){}, w.forceCloseFns...)
+	w.mu.Unlock()
+	for _, conn := range open {
+		if before != nil {
+			before(conn)
+		}
+		conn.Close()
+		for _, fn := range after {
+			fn(conn)
+		}
+	}
+}
+
+// closeStaleConns closes every identified connection whose request has been in flight
+// for longer than maxAge at now.
+func (w *Watcher) closeStaleConns(maxAge time.Duration, now time.Time) {
+	w.mu.Lock()
+	var stale []net.Conn
+	for conn, info := range w.conns {
+		if info.state == http.StateActive && now.Sub(info.since) > maxAge {
+			stale = append(stale, conn)
+		}
+	}
+	w.mu.Unlock()
+	for _, conn := range stale {
+		w.logf("httpdshutdown: closing connection from %v with a request in flight for over %v",
+			conn.RemoteAddr(), maxAge)
+		conn.Close()
+	}
+}
+
+// closeConnLocked stops counting a connection of the given class. w.mu must be held.
+func (w *Watcher) closeConnLocked(class ConnClass) {
+	w.addConnsLocked(-1)
+	if class == LongLived && w.longLived > 0 {
+		w.longLived--
+	}
+}
+
+// ReleaseHijacked stops counting a hijacked connection that the watcher has been
+// keeping open since `WithHijackTracking` was configured. Call it when the
+// application is done with the connection, for example when a WebSocket closes.
+//
+// The lifecycle of a tracked connection is:
+//
+//    StateNew       the watcher starts counting the connection
+//    StateHijacked  the handler takes over; the connection stays counted
+//    ReleaseHijacked  the application is done; the connection stops being counted
+//
+// An error is returned if conn is not a tracked hijacked connection.
+func (w *Watcher) ReleaseHijacked(conn net.Conn) error {
+	if w == nil {
+		return fmt.Errorf("ReleaseHijacked: %w", ErrNilWatcher)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	class, ok := w.hijacked[conn]
+	if !ok {
+		return errors.New("ReleaseHijacked: connection is not a tracked hijacked connection")
+	}
+	delete(w.hijacked, conn)
+	w.closeConnLocked(class)
+	return nil
+}
+
+// RejectedConns returns the number of connections closed on arrival because of the
+// limit set with `WithMaxConns`.
+func (w *Watcher) RejectedConns() int {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rejectedConns
+}
+
+// PauseCounting makes the watcher ignore connection state transitions until
+// `ResumeCounting` is called, for maintenance windows in which connections are reset
+// or migrated and the count should not react. While paused, `RecordConnState`,
+// `ConnStateHook` and the ConnState of attached servers are no-ops.
+//
+// This is an advanced feature: a connection that opens or closes during the pause is
+// never counted or never uncounted, which desynchronizes the count from reality. A
+// count left too high stalls the next drain until it times out, and one left too low
+// lets a shutdown complete with connections still open. Use `SeedOpenConns` or
+// `Reset` to correct it afterwards.
+func (w *Watcher) PauseCounting() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.countPaused = true
+}
+
+// ResumeCounting resumes the counting paused with `PauseCounting`.
+func (w *Watcher) ResumeCounting() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.countPaused = false
+}
+
+// SeedOpenConns adds n to the open connection count, for a watcher attached to a
+// server that is already serving. Connections accepted before the watcher was
+// recording states are otherwise invisible to it, and a shutdown would not wait for
+// them; their `StateClosed` transitions, once recorded, bring the count back down.
+// A close recorded for a connection that was never counted cannot drive the count
+// below zero. It is an error to seed a negative count or to seed while a shutdown
+// is in progress.
+//
+// Example use:
+//
+//     srv.ConnState = watcher.ConnStateHook()
+//     watcher.SeedOpenConns(existingConns)
+//
+func (w *Watcher) SeedOpenConns(n int) error {
+	if w == nil {
+		return fmt.Errorf("SeedOpenConns: %w", ErrNilWatcher)
+	}
+	if n < 0 {
+		return errors.New("SeedOpenConns: count must not be negative")
+	}
+	if w.draining.Load() {
+		return errors.New("SeedOpenConns: a shutdown is in progress")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.totalConns += n
+	w.addConnsLocked(n)
+	return nil
+}
+
+// Track counts an in-flight operation that is not an HTTP connection, such as a job
+// pulled from a queue, as an open connection until the returned function is called,
+// so that a shutdown waits for it exactly as it waits for connections. Calling the
+// returned function more than once has no further effect. Tracked operations are
+// included in `OpenConns` but not in `TotalConns`. Like connections counted with
+// `RecordConnState`, they hold up `OnStop` only when no server is attached; with
+// attached servers, use `RegisterWorkerGroup` instead.
+//
+// Example use:
+//
+//     done := watcher.Track()
+//     defer done()
+//     process(job)
+//
+func (w *Watcher) Track() (done func()) {
+	if w == nil {
+		panic("Track: receiver is nil")
+	}
+	w.addConns(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { w.addConns(-1) })
+	}
+}
+
+// TrackHandler returns a handler that counts every request it serves with `Track`,
+// for servers that report no connection states, such as those of `net/http/fcgi`.
+// A shutdown then waits for the requests in flight like it waits for connections.
+//
+// Example use:
+//
+//     go fcgi.Serve(ln, watcher.TrackHandler(mux))
+//
+func (w *Watcher) TrackHandler(h http.Handler) http.Handler {
+	if w == nil {
+		panic("TrackHandler: receiver is nil")
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		done := w.Track()
+		defer done()
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// TotalConns returns the number of connections opened since the watcher was created
+// or last `Reset`. Zero after a server has been serving usually means that
+// `RecordConnState` was never wired up, so the watcher considers itself drained at
+// once and the shutdown is not graceful. To catch this, the first `OnStop` logs a
+// warning when servers are attached but no connection was ever tracked.
+func (w *Watcher) TotalConns() int {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.totalConns
+}
+
+// ClosedConns returns the number of connections that ended with `StateClosed` since
+// the watcher was created or last `Reset`.
+func (w *Watcher) ClosedConns() int {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closedConns
+}
+
+// HijackedConns returns the number of connections that ended with `StateHijacked`
+// since the watcher was created or last `Reset`. Unless `WithHijackTracking` is
+// configured, a hijacked connection stops counting as open, so a drain that completes
+// suspiciously fast on a WebSocket-heavy daemon shows up here rather than in
+// `ClosedConns`.
+func (w *Watcher) HijackedConns() int {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.hijackedConns
+}
+
+// LongLivedConns returns the number of open connections tagged `LongLived`.
+func (w *Watcher) LongLivedConns() int {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.longLived
+}
+
+// RegisterLongLivedCloser registers a function that is called when a shutdown begins
+// to ask long-lived connections to close, rather than waiting for them to time out.
+// A closer should return promptly; it is called before the watcher starts waiting on
+// open connections.
+func (w *Watcher) RegisterLongLivedCloser(closer func()) error {
+	if w == nil {
+		return fmt.Errorf("RegisterLongLivedCloser: %w", ErrNilWatcher)
+	}
+	if closer == nil {
+		return errors.New("RegisterLongLivedCloser: closer is nil")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closers = append(w.closers, closer)
+	return nil
+}
+
+// ConnStateHook returns a function that can be assigned directly to a `http.Server`'s
+// `ConnState` field, sparing callers from writing a closure around `RecordConnState`.
+//
+// Counting connections suits HTTP/1, where a connection carries one request at a
+// time. Under HTTP/2 a connection multiplexes many streams and reports `StateActive`
+// only once, so the count underestimates the requests in flight and a drain may end
+// while streams are still running. Servers that speak HTTP/2 should be attached with
+// `AttachServer` instead, whose `http.Server.Shutdown` sends GOAWAY and waits for the
+// streams; a warning is logged the first time a manually counted connection
+// negotiates HTTP/2 over TLS. Cleartext h2c connections cannot be detected.
+//
+// Example use:
+//
+//    srv := &http.Server{Addr: ":8080"}
+//    srv.ConnState = watcher.ConnStateHook()
+//
+func (w *Watcher) ConnStateHook() func(net.Conn, http.ConnState) {
+	if w == nil {
+		// panic since the returned func is handed to a http.Server, which does not
+		// do any error checking
+		panic("ConnStateHook: receiver is nil")
+	}
+	return w.WrapConnState(nil)
+}
+
+// isHTTP2 reports whether conn negotiated HTTP/2 over TLS.
+func isHTTP2(conn net.Conn) bool {
+	tc, ok := conn.(*tls.Conn)
+	return ok && tc.ConnectionState().NegotiatedProtocol == "h2"
+}
+
+// WrapConnState returns a `ConnState` function that records the connection state on
+// the watcher and then invokes next, so a server's existing `ConnState` callback keeps
+// working. A nil next is tolerated.
+//
+// Example use:
+//
+//    srv.ConnState = watcher.WrapConnState(myMetricsConnState)
+//
+func (w *Watcher) WrapConnState(next func(net.Conn, http.ConnState)) func(net.Conn, http.ConnState) {
+	if w == nil {
+		panic("WrapConnState: receiver is nil")
+	}
+	return func(conn net.Conn, newState http.ConnState) {
+		if newState == http.StateActive && isHTTP2(conn) && w.warnedH2.CompareAndSwap(false, true) {
+			w.logf("httpdshutdown: an HTTP/2 connection is counted manually, which underestimates " +
+				"the requests in flight; attach the server with AttachServer to drain it with GOAWAY")
+		}
+		w.recordConn(conn, "", newState, ShortLived)
+		if next != nil {
+			next(conn, newState)
+		}
+	}
+}
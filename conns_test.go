@@ -0,0 +1,627 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnStateHook(t *testing.T) {
+	w, wErr := NewWatcher(1000)
+	if w == nil || wErr != nil {
+		t.Fatalf("TestConnStateHook: should not be nil")
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w.mu.Lock()
+		open := w.openConns
+		w.mu.Unlock()
+		if open != 1 {
+			t.Errorf("TestConnStateHook: expected 1 open conn in handler, got %d", open)
+		}
+	}))
+	ts.Config.ConnState = w.ConnStateHook()
+	ts.Start()
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	ts.CloseClientConnections()
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestConnStateHook: should not have an error after conns close")
+	}
+}
+
+func TestWrapConnState(t *testing.T) {
+	w, wErr := NewWatcher(1000)
+	if w == nil || wErr != nil {
+		t.Fatalf("TestWrapConnState: should not be nil")
+	}
+	var seen []http.ConnState
+	f := w.WrapConnState(func(conn net.Conn, newState http.ConnState) {
+		seen = append(seen, newState)
+	})
+	f(nil, http.StateNew)
+	f(nil, http.StateActive)
+	if w.openConns != 1 {
+		t.Errorf("TestWrapConnState: expected 1 open conn, got %d", w.openConns)
+	}
+	f(nil, http.StateClosed)
+	if w.openConns != 0 {
+		t.Errorf("TestWrapConnState: expected 0 open conns, got %d", w.openConns)
+	}
+	if len(seen) != 3 || seen[0] != http.StateNew || seen[2] != http.StateClosed {
+		t.Errorf("TestWrapConnState: wrapped callback saw %v", seen)
+	}
+
+	// A nil next must be tolerated.
+	g := w.WrapConnState(nil)
+	g(nil, http.StateNew)
+	g(nil, http.StateClosed)
+	if w.openConns != 0 {
+		t.Errorf("TestWrapConnState: expected 0 open conns, got %d", w.openConns)
+	}
+}
+
+func TestLongLivedConns(t *testing.T) {
+	w, wErr := NewWatcher(2000)
+	if w == nil || wErr != nil {
+		t.Fatalf("TestLongLivedConns: should not be nil")
+	}
+	w.RecordConnStateTagged(http.StateNew, LongLived)
+	w.RecordConnStateTagged(http.StateNew, ShortLived)
+	w.RecordConnState(http.StateClosed)
+	if n := w.LongLivedConns(); n != 1 {
+		t.Errorf("TestLongLivedConns: expected 1 long-lived conn, got %d", n)
+	}
+	closed := false
+	if err := w.RegisterLongLivedCloser(func() {
+		closed = true
+		go w.RecordConnStateTagged(http.StateClosed, LongLived)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestLongLivedConns: closer should have let the drain finish, got %v", err)
+	}
+	if !closed {
+		t.Errorf("TestLongLivedConns: closer was not invoked")
+	}
+	if n := w.LongLivedConns(); n != 0 {
+		t.Errorf("TestLongLivedConns: expected 0 long-lived conns, got %d", n)
+	}
+	if err := w.RegisterLongLivedCloser(nil); err == nil {
+		t.Errorf("TestLongLivedConns: nil closer should be rejected")
+	}
+}
+
+func FuzzRecordConnState(f *testing.F) {
+	f.Add([]byte{byte(http.StateNew), byte(http.StateActive), byte(http.StateIdle), byte(http.StateClosed)})
+	f.Add([]byte{byte(http.StateClosed), byte(http.StateHijacked), byte(http.StateNew)})
+	f.Add([]byte{byte(http.StateNew), byte(http.StateNew), byte(http.StateHijacked), 99})
+	f.Fuzz(func(t *testing.T, states []byte) {
+		w, wErr := NewWatcher(0)
+		if w == nil || wErr != nil {
+			t.Fatalf("FuzzRecordConnState: should not be nil")
+		}
+		model := 0
+		for _, b := range states {
+			state := http.ConnState(b)
+			w.RecordConnState(state)
+			switch state {
+			case http.StateNew:
+				model++
+			case http.StateClosed, http.StateHijacked:
+				if model > 0 {
+					model--
+				}
+			}
+			open := w.OpenConns()
+			if open < 0 {
+				t.Fatalf("FuzzRecordConnState: open count went negative: %d", open)
+			}
+			if open != model {
+				t.Fatalf("FuzzRecordConnState: open count %d, expected %d", open, model)
+			}
+		}
+		// Balance every connection still open; the count must return to zero and
+		// the watcher must consider itself drained.
+		for i := 0; i < model; i++ {
+			w.RecordConnState(http.StateClosed)
+		}
+		if open := w.OpenConns(); open != 0 {
+			t.Fatalf("FuzzRecordConnState: expected 0 open conns after balancing, got %d", open)
+		}
+		select {
+		case <-w.ConnsDrained():
+		default:
+			t.Fatalf("FuzzRecordConnState: drained channel should be closed")
+		}
+	})
+}
+
+func TestHijackTracking(t *testing.T) {
+	w, wErr := NewWatcher(10)
+	if w == nil || wErr != nil {
+		t.Fatalf("TestHijackTracking: should not be nil")
+	}
+	if err := w.Configure(WithHijackTracking()); err != nil {
+		t.Fatal(err)
+	}
+	hook := w.ConnStateHook()
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	hook(conn, http.StateNew)
+	hook(conn, http.StateActive)
+	hook(conn, http.StateHijacked)
+	if n := w.OpenConns(); n != 1 {
+		t.Errorf("TestHijackTracking: hijacked conn should stay counted, got %d", n)
+	}
+	if err := w.OnStop(); err == nil {
+		t.Errorf("TestHijackTracking: drain should wait for the hijacked conn")
+	}
+	if err := w.ReleaseHijacked(conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.ReleaseHijacked(conn); err == nil {
+		t.Errorf("TestHijackTracking: releasing twice should be an error")
+	}
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestHijackTracking: drain should complete after release, got %v", err)
+	}
+
+	// Without tracking a hijack ends the count immediately.
+	w2, _ := NewWatcher(10)
+	hook2 := w2.ConnStateHook()
+	hook2(conn, http.StateNew)
+	hook2(conn, http.StateHijacked)
+	if n := w2.OpenConns(); n != 0 {
+		t.Errorf("TestHijackTracking: untracked hijack should not be counted, got %d", n)
+	}
+}
+
+func TestWithHijackPolicy(t *testing.T) {
+	w, _ := NewWatcher(20)
+	if err := w.Configure(WithHijackPolicy(HijackPolicy(7))); err == nil {
+		t.Errorf("TestWithHijackPolicy: unknown policy should be rejected")
+	}
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	for _, tc := range []struct {
+		policy  HijackPolicy
+		drained bool
+	}{
+		{HijackAsClosed, true},
+		{HijackAsOpen, false},
+	} {
+		w.Reset()
+		if err := w.Configure(WithHijackPolicy(tc.policy)); err != nil {
+			t.Fatal(err)
+		}
+		hook := w.ConnStateHook()
+		hook(conn, http.StateNew)
+		hook(conn, http.StateHijacked)
+		if err := w.OnStop(); (err == nil) != tc.drained {
+			t.Errorf("TestWithHijackPolicy: policy %d: expected drained %v, got %v", tc.policy, tc.drained, err)
+		}
+	}
+}
+
+func TestDrainRequests(t *testing.T) {
+	for _, mode := range []DrainMode{DrainConnections, DrainRequests} {
+		w, wErr := NewWatcher(500)
+		if w == nil || wErr != nil {
+			t.Fatalf("TestDrainRequests: should not be nil")
+		}
+		if err := w.Configure(WithDrainMode(mode)); err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}))
+		ts.Config.ConnState = w.ConnStateHook()
+		ts.Start()
+
+		// Leave an idle keep-alive connection behind, then start a slow request on
+		// a second connection.
+		client := &http.Client{Transport: &http.Transport{}}
+		resp, err := client.Get(ts.URL + "/fast")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		slowDone := make(chan error, 1)
+		go func() {
+			resp, err := http.Get(ts.URL + "/slow")
+			if err == nil {
+				_, _ = ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			slowDone <- err
+		}()
+		for w.OpenConns() < 2 {
+			time.Sleep(time.Millisecond)
+		}
+
+		err = w.OnStop()
+		switch mode {
+		case DrainConnections:
+			if !errors.Is(err, ErrShutdownTimeout) {
+				t.Errorf("TestDrainRequests: idle keep-alive conn should hold up a connection drain, got %v", err)
+			}
+		case DrainRequests:
+			if err != nil {
+				t.Errorf("TestDrainRequests: request drain should complete, got %v", err)
+			}
+		}
+		if err := <-slowDone; err != nil {
+			t.Errorf("TestDrainRequests: in-flight request should complete, got %v", err)
+		}
+		client.Transport.(*http.Transport).CloseIdleConnections()
+		ts.Close()
+	}
+	w, _ := NewWatcher(0)
+	if err := w.Configure(WithDrainMode(DrainMode(42))); err == nil {
+		t.Errorf("TestDrainRequests: unknown mode should be rejected")
+	}
+}
+
+func TestForceClose(t *testing.T) {
+	w, _ := NewWatcher(50)
+	var mu sync.Mutex
+	var before []net.Conn
+	err := w.Configure(WithForceClose(func(conn net.Conn) {
+		mu.Lock()
+		before = append(before, conn)
+		mu.Unlock()
+		conn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\n\r\n"))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := w.ConnStateHook()
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	hook(conn, http.StateNew)
+	hook(conn, http.StateActive)
+	received := make(chan string, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(peer)
+		received <- string(b)
+	}()
+
+	if err := w.OnStop(); !errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("TestForceClose: expected a timeout, got %v", err)
+	}
+	mu.Lock()
+	if len(before) != 1 || before[0] != conn {
+		t.Errorf("TestForceClose: callback should run once for the open conn, got %v", before)
+	}
+	mu.Unlock()
+	select {
+	case got := <-received:
+		if !strings.HasPrefix(got, "HTTP/1.1 503") {
+			t.Errorf("TestForceClose: peer should receive the final response, got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("TestForceClose: conn was not closed")
+	}
+}
+
+// closeRecorder is a net.Conn that records whether it has been closed.
+type closeRecorder struct {
+	net.Conn
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *closeRecorder) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func TestOnForceClose(t *testing.T) {
+	w, _ := NewWatcher(50)
+	if err := w.OnForceClose(nil); err == nil {
+		t.Errorf("TestOnForceClose: a nil fn should be rejected")
+	}
+	var mu sync.Mutex
+	closed := make(map[net.Conn]bool)
+	calls := 0
+	w.Configure(WithForceClose(nil))
+	w.OnForceClose(func(conn net.Conn) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		closed[conn] = conn.(*closeRecorder).isClosed()
+	})
+
+	const n = 3
+	hook := w.ConnStateHook()
+	var conns []net.Conn
+	for i := 0; i < n; i++ {
+		c, peer := net.Pipe()
+		defer peer.Close()
+		conn := &closeRecorder{Conn: c}
+		conns = append(conns, conn)
+		hook(conn, http.StateNew)
+		hook(conn, http.StateActive)
+	}
+
+	if err := w.OnStop(); !errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("TestOnForceClose: expected a timeout, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != n || len(closed) != n {
+		t.Errorf("TestOnForceClose: expected %d calls for %d conns, got %d for %d", n, n, calls, len(closed))
+	}
+	for _, conn := range conns {
+		if wasClosed, ok := closed[conn]; !ok || !wasClosed {
+			t.Errorf("TestOnForceClose: expected a call with %p once closed, got called %v, closed %v",
+				conn, ok, wasClosed)
+		}
+	}
+
+	var nilW *Watcher
+	if err := nilW.OnForceClose(func(net.Conn) {}); !errors.Is(err, ErrNilWatcher) {
+		t.Errorf("TestOnForceClose: expected ErrNilWatcher, got %v", err)
+	}
+}
+
+func TestMaxRequestAge(t *testing.T) {
+	w, _ := NewWatcher(2000)
+	if err := w.Configure(WithMaxRequestAge(0)); err == nil {
+		t.Errorf("TestMaxRequestAge: zero age should be rejected")
+	}
+	if err := w.Configure(WithMaxRequestAge(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	hook := w.ConnStateHook()
+	oldPipe, oldPeer := net.Pipe()
+	youngPipe, youngPeer := net.Pipe()
+	defer oldPeer.Close()
+	defer youngPeer.Close()
+	old, young := &closeRecorder{Conn: oldPipe}, &closeRecorder{Conn: youngPipe}
+	hook(old, http.StateNew)
+	hook(old, http.StateActive)
+	time.Sleep(80 * time.Millisecond)
+	hook(young, http.StateNew)
+	hook(young, http.StateActive)
+
+	// The server reports the old conn closed once the watcher closes it, and the
+	// young request completes on its own.
+	go func() {
+		ioutil.ReadAll(oldPeer)
+		hook(old, http.StateClosed)
+	}()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		hook(young, http.StateIdle)
+		hook(young, http.StateClosed)
+	}()
+	elapsed, err := w.OnStopTimed()
+	if err != nil {
+		t.Errorf("TestMaxRequestAge: should drain without error, got %v", err)
+	}
+	if elapsed > time.Second {
+		t.Errorf("TestMaxRequestAge: stuck request held up the drain for %v", elapsed)
+	}
+	if !old.isClosed() {
+		t.Errorf("TestMaxRequestAge: old request should have been reaped")
+	}
+	if young.isClosed() {
+		t.Errorf("TestMaxRequestAge: young request should have been allowed to finish")
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	w, _ := NewWatcher(2000)
+	if err := w.Configure(WithMaxConns(0)); err == nil {
+		t.Errorf("TestMaxConns: zero limit should be rejected")
+	}
+	if err := w.Configure(WithMaxConns(1)); err != nil {
+		t.Fatal(err)
+	}
+	hook := w.ConnStateHook()
+	firstPipe, firstPeer := net.Pipe()
+	secondPipe, secondPeer := net.Pipe()
+	defer firstPeer.Close()
+	defer secondPeer.Close()
+	first, second := &closeRecorder{Conn: firstPipe}, &closeRecorder{Conn: secondPipe}
+	hook(first, http.StateNew)
+	hook(second, http.StateNew)
+	ioutil.ReadAll(secondPeer) // returns once the rejected conn is closed
+	if !second.isClosed() || first.isClosed() {
+		t.Errorf("TestMaxConns: only the conn over the limit should be closed")
+	}
+	if n := w.RejectedConns(); n != 1 {
+		t.Errorf("TestMaxConns: expected 1 rejected conn, got %d", n)
+	}
+	hook(second, http.StateClosed)
+	if n := w.OpenConns(); n != 1 {
+		t.Errorf("TestMaxConns: rejected conn should leave the count balanced, got %d", n)
+	}
+
+	// While draining every new conn is rejected, even below the limit.
+	hook(first, http.StateClosed)
+	errc := make(chan error, 1)
+	thirdPipe, thirdPeer := net.Pipe()
+	defer thirdPeer.Close()
+	blocker, blockerPeer := net.Pipe()
+	defer blockerPeer.Close()
+	w2, _ := NewWatcher(2000)
+	_ = w2.Configure(WithMaxConns(10))
+	hook2 := w2.ConnStateHook()
+	hook2(blocker, http.StateNew)
+	go func() { errc <- w2.OnStop() }()
+	waitDraining(t, w2)
+	third := &closeRecorder{Conn: thirdPipe}
+	hook2(third, http.StateNew)
+	ioutil.ReadAll(thirdPeer)
+	if !third.isClosed() || w2.RejectedConns() != 1 {
+		t.Errorf("TestMaxConns: new conn while draining should be rejected")
+	}
+	hook2(third, http.StateClosed)
+	hook2(blocker, http.StateClosed)
+	if err := <-errc; err != nil {
+		t.Errorf("TestMaxConns: should drain without error, got %v", err)
+	}
+}
+
+func TestTerminationCounts(t *testing.T) {
+	w, _ := NewWatcher(100)
+	for i := 0; i < 3; i++ {
+		w.RecordConnState(http.StateNew)
+	}
+	w.RecordConnState(http.StateHijacked)
+	w.RecordConnState(http.StateHijacked)
+	w.RecordConnState(http.StateClosed)
+	if total, closed, hijacked := w.TotalConns(), w.ClosedConns(), w.HijackedConns(); total != 3 || closed != 1 || hijacked != 2 {
+		t.Errorf("TestTerminationCounts: expected 3 total, 1 closed, 2 hijacked, got %d %d %d", total, closed, hijacked)
+	}
+	// The drain looks complete even though two connections are still in use.
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestTerminationCounts: should drain, got %v", err)
+	}
+	w.Reset()
+	if w.TotalConns() != 0 || w.ClosedConns() != 0 || w.HijackedConns() != 0 {
+		t.Errorf("TestTerminationCounts: Reset should clear the counters")
+	}
+	var nw *Watcher
+	if nw.TotalConns() != 0 || nw.ClosedConns() != 0 || nw.HijackedConns() != 0 {
+		t.Errorf("TestTerminationCounts: nil watcher should report zero")
+	}
+}
+
+func TestSeedOpenConns(t *testing.T) {
+	w, _ := NewWatcher(50)
+	if err := w.SeedOpenConns(-1); err == nil {
+		t.Errorf("TestSeedOpenConns: negative count should be rejected")
+	}
+	// Attached late, with two connections already open and one more arriving.
+	if err := w.SeedOpenConns(2); err != nil {
+		t.Fatal(err)
+	}
+	w.RecordConnState(http.StateNew)
+	if n := w.OpenConns(); n != 3 {
+		t.Errorf("TestSeedOpenConns: expected 3 open conns, got %d", n)
+	}
+	w.RecordConnState(http.StateClosed)
+	w.RecordConnState(http.StateClosed)
+	if err := w.OnStop(); !errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("TestSeedOpenConns: a seeded conn should hold up the drain, got %v", err)
+	}
+	if err := w.SeedOpenConns(1); err == nil {
+		t.Errorf("TestSeedOpenConns: seeding while draining should be rejected")
+	}
+	w.RecordConnState(http.StateClosed)
+	// An unexpected extra close does not drive the count negative.
+	w.RecordConnState(http.StateClosed)
+	if n := w.OpenConns(); n != 0 {
+		t.Errorf("TestSeedOpenConns: expected no open conns, got %d", n)
+	}
+}
+
+func TestTrack(t *testing.T) {
+	w, _ := NewWatcher(2000)
+	w.RecordConnState(http.StateNew)
+	done := w.Track()
+	if n := w.OpenConns(); n != 2 {
+		t.Errorf("TestTrack: expected the operation counted with the connection, got %d", n)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		w.RecordConnState(http.StateClosed)
+		time.Sleep(100 * time.Millisecond)
+		done()
+	}()
+	elapsed, err := w.OnStopTimed()
+	if err != nil {
+		t.Errorf("TestTrack: %v", err)
+	}
+	if elapsed < 150*time.Millisecond {
+		t.Errorf("TestTrack: OnStop should wait for the operation too, took %v", elapsed)
+	}
+	// Calling done again does not drop another connection from the count.
+	w.RecordConnState(http.StateNew)
+	done()
+	if n := w.OpenConns(); n != 1 || w.TotalConns() != 2 {
+		t.Errorf("TestTrack: unexpected counts, %d open and %d total", n, w.TotalConns())
+	}
+}
+
+func TestTrackHandler(t *testing.T) {
+	w, _ := NewWatcher(2000)
+	started := make(chan struct{})
+	h := w.TrackHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+	}))
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	<-started
+	elapsed, err := w.OnStopTimed()
+	if err != nil || elapsed < 50*time.Millisecond {
+		t.Errorf("TestTrackHandler: OnStop should wait for the request, took %v, got %v", elapsed, err)
+	}
+	if n := w.OpenConns(); n != 0 {
+		t.Errorf("TestTrackHandler: expected the request to be done, got %d open", n)
+	}
+}
+
+func TestPauseCounting(t *testing.T) {
+	w, _ := NewWatcher(100)
+	w.RecordConnState(http.StateNew)
+	w.PauseCounting()
+	hook := w.ConnStateHook()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.RecordConnState(http.StateNew)
+			w.RecordConnState(http.StateClosed)
+			w.RecordConnState(http.StateClosed)
+			conn, peer := net.Pipe()
+			defer peer.Close()
+			defer conn.Close()
+			hook(conn, http.StateNew)
+		}()
+	}
+	wg.Wait()
+	if open, total := w.OpenConns(), w.TotalConns(); open != 1 || total != 1 {
+		t.Errorf("TestPauseCounting: transitions while paused should be ignored, got %d open of %d", open, total)
+	}
+
+	w.ResumeCounting()
+	w.RecordConnState(http.StateNew)
+	w.RecordConnState(http.StateClosed)
+	w.RecordConnState(http.StateClosed)
+	if open, total := w.OpenConns(), w.TotalConns(); open != 0 || total != 2 {
+		t.Errorf("TestPauseCounting: counting should resume, got %d open of %d", open, total)
+	}
+
+	var nw *Watcher
+	nw.PauseCounting()
+	nw.ResumeCounting()
+}
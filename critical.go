@@ -0,0 +1,147 @@
+package httpdshutdown
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// connKey is the context key under which ConnContext stores a request's connection.
+type connKey struct{}
+
+// ConnContext returns ctx carrying c, so that `MarkCritical` can find the connection
+// of a request. `AttachServer` installs it on the server; assign it to a server's
+// `ConnContext` yourself when its states are recorded with `WrapConnState` or
+// `ConnStateHook`.
+//
+// Example use:
+//
+//     srv.ConnState = watcher.ConnStateHook()
+//     srv.ConnContext = watcher.ConnContext
+//
+func (w *Watcher) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// WithCriticalGrace lets connections marked with `MarkCritical`, such as one carrying
+// a payment in progress, outlive the grace period by up to extra. If critical
+// connections are still open when the grace period ends, the other connections the
+// watcher can identify are closed, and the shutdown waits up to extra more for the
+// critical ones to finish. Without critical connections the grace period ends as
+// usual. The shutdown succeeds if only critical connections were left and they
+// finished in time; ordinary connections closed at the deadline are reported as
+// `ErrShutdownTimeout`, like any other that outlived the grace period.
+func WithCriticalGrace(extra time.Duration) Option {
+	return func(w *Watcher) error {
+		if extra <= 0 {
+			return errors.New("WithCriticalGrace: extra must be a positive duration")
+		}
+		w.criticalGrace = extra
+		return nil
+	}
+}
+
+// MarkCritical marks the connection carrying r as critical until its request
+// completes, so that a shutdown gives it the extra grace of `WithCriticalGrace`. The
+// connection must be tracked by the watcher, with its context set by `ConnContext`.
+//
+// Example use:
+//
+//     func pay(rw http.ResponseWriter, r *http.Request) {
+//             watcher.MarkCritical(r)
+//             ...
+//     }
+//
+func (w *Watcher) MarkCritical(r *http.Request) error {
+	if w == nil {
+		return fmt.Errorf("MarkCritical: %w", ErrNilWatcher)
+	}
+	c, ok := r.Context().Value(connKey{}).(net.Conn)
+	if !ok {
+		return errors.New("MarkCritical: the request has no connection; see ConnContext")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for conn, info := range w.conns {
+		// A TLS server reports the TLS connection to ConnState, but the underlying
+		// one to ConnContext.
+		if tc, ok := conn.(*tls.Conn); conn == c || ok && tc.NetConn() == c {
+			info.critical = true
+			return nil
+		}
+	}
+	return errors.New("MarkCritical: the connection is not tracked")
+}
+
+// closeOrdinary closes the identified connections of the server at addr, or of any
+// server if addr is empty, that are not critical, if there is a critical grace and one
+// of those connections is critical. It returns how many it closed and whether it did.
+func (w *Watcher) closeOrdinary(addr string) (closed int, extend bool) {
+	w.mu.Lock()
+	grace := w.criticalGrace
+	var ordinary []net.Conn
+	for conn, info := range w.conns {
+		if addr != "" && info.addr != addr {
+			continue
+		}
+		if info.critical {
+			extend = true
+		} else {
+			ordinary = append(ordinary, conn)
+		}
+	}
+	w.mu.Unlock()
+	if grace <= 0 || !extend {
+		return 0, false
+	}
+	w.logf("httpdshutdown: closing %d connections at the deadline and giving critical connections %v more",
+		len(ordinary), grace)
+	for _, conn := range ordinary {
+		conn.Close()
+	}
+	return len(ordinary), true
+}
+
+// awaitCritical extends the shutdown of the server at addr once it has reached its
+// deadline with critical connections still open: it closes the other connections with
+// closeOrdinary and waits up to the critical grace for the critical ones to complete.
+// It returns how many ordinary connections it closed and whether it waited for
+// critical ones that then completed in time.
+func (w *Watcher) awaitCritical(addr string) (closed int, ok bool) {
+	closed, extend := w.closeOrdinary(addr)
+	if !extend {
+		return 0, false
+	}
+	w.mu.Lock()
+	grace, interval := w.criticalGrace, w.pollIntervalLocked()
+	w.mu.Unlock()
+	timer, stopTimer := w.clock.After(grace)
+	defer stopTimer()
+	poll, stopPoll := w.clock.Tick(interval)
+	defer stopPoll()
+	for w.hasCritical(addr) {
+		select {
+		case <-timer:
+			return closed, false
+		case <-poll:
+		}
+	}
+	return closed, true
+}
+
+// hasCritical reports whether a critical connection of the server at addr, or of any
+// server if addr is empty, is open.
+func (w *Watcher) hasCritical(addr string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, info := range w.conns {
+		if info.critical && (addr == "" || info.addr == addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// criticalHandler serves /pay, a critical request finishing after the 100ms grace
+// period, and blocks any other request until release is closed.
+func criticalHandler(t *testing.T, w *Watcher, started chan<- string, release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pay" {
+			started <- r.URL.Path
+			<-release
+			return
+		}
+		if err := w.MarkCritical(r); err != nil {
+			t.Errorf("TestWithCriticalGrace: %v", err)
+		}
+		started <- r.URL.Path
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(rw, "paid")
+	})
+}
+
+// pay requests url and sends the body of the response, or the error, on the returned
+// channel.
+func pay(url string) <-chan string {
+	c := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			c <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		c <- string(body)
+	}()
+	return c
+}
+
+func TestWithCriticalGrace(t *testing.T) {
+	w, _ := NewWatcher(100)
+	if err := w.Configure(WithCriticalGrace(0)); err == nil {
+		t.Errorf("TestWithCriticalGrace: a zero grace should be rejected")
+	}
+
+	for _, attach := range []bool{true, false} {
+		started, release := make(chan string, 2), make(chan struct{})
+		w, _ := NewWatcher(100)
+		w.Configure(WithCriticalGrace(2 * time.Second))
+		var url string
+		if attach {
+			var srv *http.Server
+			srv, url = startServer(t, criticalHandler(t, w, started, release), w.AttachServer)
+			defer srv.Close()
+		} else {
+			// Without an attached server the drain waits on the connection count.
+			ts := httptest.NewUnstartedServer(criticalHandler(t, w, started, release))
+			ts.Config.ConnState = w.ConnStateHook()
+			ts.Config.ConnContext = w.ConnContext
+			ts.Start()
+			defer ts.Close()
+			url = ts.URL
+		}
+
+		paid, _ := pay(url+"/pay"), pay(url+"/stuck")
+		<-started
+		<-started
+
+		start := time.Now()
+		err := w.OnStop()
+		elapsed := time.Since(start)
+		close(release)
+		// The ordinary request was cut off at the deadline, so the shutdown timed out,
+		// but only once the critical one had finished.
+		if !errors.Is(err, ErrShutdownTimeout) {
+			t.Errorf("TestWithCriticalGrace: attached %v: expected ErrShutdownTimeout, got %v", attach, err)
+		}
+		if body := <-paid; body != "paid" {
+			t.Errorf("TestWithCriticalGrace: attached %v: the critical request should complete, got %q",
+				attach, body)
+		}
+		if elapsed < 250*time.Millisecond || elapsed > 2*time.Second {
+			t.Errorf("TestWithCriticalGrace: attached %v: expected to wait for the critical request, took %v",
+				attach, elapsed)
+		}
+	}
+
+	// A critical request alone finishing within the extension is a clean shutdown.
+	started := make(chan string, 1)
+	w, _ = NewWatcher(100)
+	w.Configure(WithCriticalGrace(2 * time.Second))
+	srv, url := startServer(t, criticalHandler(t, w, started, nil), w.AttachServer)
+	defer srv.Close()
+	paid := pay(url + "/pay")
+	<-started
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestWithCriticalGrace: %v", err)
+	}
+	if body := <-paid; body != "paid" {
+		t.Errorf("TestWithCriticalGrace: the critical request should complete, got %q", body)
+	}
+
+	var nilW *Watcher
+	if err := nilW.MarkCritical(httptest.NewRequest("GET", "/", nil)); !errors.Is(err, ErrNilWatcher) {
+		t.Errorf("TestWithCriticalGrace: expected ErrNilWatcher, got %v", err)
+	}
+	if err := w.MarkCritical(httptest.NewRequest("GET", "/", nil)); err == nil ||
+		!strings.Contains(err.Error(), "ConnContext") {
+		t.Errorf("TestWithCriticalGrace: a request without a connection should be rejected, got %v", err)
+	}
+}
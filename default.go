@@ -0,0 +1,105 @@
+package httpdshutdown
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+const (
+	// DefaultTimeoutMS is the grace period, in milliseconds, of the default watcher.
+	DefaultTimeoutMS = 5000
+
+	// TimeoutEnvVar names the environment variable read by `NewWatcherFromEnv`.
+	TimeoutEnvVar = "HTTPD_SHUTDOWN_TIMEOUT_MS"
+)
+
+var (
+	defaultOnce    sync.Once
+	defaultWatcher *Watcher
+)
+
+// Default returns the package-level Watcher operated on by the convenience functions
+// `RegisterHook`, `RecordConnState` and `OnStop`. It is constructed on first use with
+// a timeout of `DefaultTimeoutMS`. This mirrors `http.DefaultServeMux` and suits the
+// common case of a daemon running a single server.
+//
+// Example use:
+//
+//    httpdshutdown.RegisterHook(closeDB)
+//    srv.ConnState = httpdshutdown.Default().ConnStateHook()
+//    go httpdshutdown.Default().SigHandle(sigs, exitcode)
+//
+func Default() *Watcher {
+	defaultOnce.Do(func() {
+		defaultWatcher, _ = NewWatcher(DefaultTimeoutMS)
+	})
+	return defaultWatcher
+}
+
+// NewWatcherFromEnv constructs a Watcher like `NewWatcher`, taking the timeout in
+// milliseconds from the `HTTPD_SHUTDOWN_TIMEOUT_MS` environment variable so the grace
+// period can be tuned without recompiling. If the variable is unset or empty, the
+// timeout is `DefaultTimeoutMS`. A value that is not a non-negative integer is an
+// error rather than silently replaced by the default.
+//
+// Example instantiation:
+//
+//     watcher, err := httpdshutdown.NewWatcherFromEnv(closeDB)
+//
+func NewWatcherFromEnv(hooks ...ShutdownHook) (*Watcher, error) {
+	timeoutMS := DefaultTimeoutMS
+	if v := os.Getenv(TimeoutEnvVar); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("NewWatcherFromEnv: %s must be a non-negative number of milliseconds, got %q",
+				TimeoutEnvVar, v)
+		}
+		timeoutMS = n
+	}
+	return NewWatcher(timeoutMS, hooks...)
+}
+
+// RegisterHook adds a shutdown hook to the default watcher.
+func RegisterHook(hook ShutdownHook) error {
+	return Default().RegisterHook(hook)
+}
+
+// RecordConnState records a connection state change on the default watcher.
+func RecordConnState(newState http.ConnState) {
+	Default().RecordConnState(newState)
+}
+
+// OnStop drains connections and runs the hooks of the default watcher.
+func OnStop() error {
+	return Default().OnStop()
+}
+
+// Serve is the batteries-included path for a daemon built on the default watcher. It
+// configures the watcher with opts, attaches srv, wiring up its `ConnState`, serves it
+// with `ListenAndServe` and handles signals, returning once a graceful shutdown has
+// completed, with the shutdown's error. SIGTERM, SIGQUIT and SIGHUP shut down
+// gracefully, as with `SigHandle`. SIGINT returns an error at once, without draining,
+// and so does a server that fails, for example because its address is in use.
+//
+// Example use:
+//
+//     httpdshutdown.RegisterHook(closeDB)
+//     if err := httpdshutdown.Serve(srv, httpdshutdown.WithMinDrainTime(5*time.Second)); err != nil {
+//             log.Fatal(err)
+//     }
+//
+func Serve(srv *http.Server, opts ...Option) error {
+	w := Default()
+	if err := w.Configure(opts...); err != nil {
+		return fmt.Errorf("Serve: %w", err)
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP, syscall.SIGINT)
+	defer signal.Stop(sigs)
+	return w.serve(srv, srv.ListenAndServe, sigs)
+}
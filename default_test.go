@@ -0,0 +1,51 @@
+package httpdshutdown
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDefault(t *testing.T) {
+	if Default() != Default() {
+		t.Fatalf("TestDefault: should return the same watcher")
+	}
+	if Default().Timeout() != DefaultTimeoutMS*time.Millisecond {
+		t.Errorf("TestDefault: unexpected timeout %v", Default().Timeout())
+	}
+	called := false
+	if err := RegisterHook(func() error {
+		called = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	RecordConnState(http.StateNew)
+	RecordConnState(http.StateClosed)
+	if err := OnStop(); err != nil {
+		t.Errorf("TestDefault: should not have an error")
+	}
+	if !called {
+		t.Errorf("TestDefault: hook was not called")
+	}
+	Default().Reset()
+}
+
+func TestNewWatcherFromEnv(t *testing.T) {
+	t.Setenv(TimeoutEnvVar, "")
+	w, err := NewWatcherFromEnv()
+	if err != nil || w.Timeout() != DefaultTimeoutMS*time.Millisecond {
+		t.Errorf("TestNewWatcherFromEnv: unset var should use the default, got %v", err)
+	}
+	t.Setenv(TimeoutEnvVar, "1500")
+	w, err = NewWatcherFromEnv(func() error { return nil })
+	if err != nil || w.Timeout() != 1500*time.Millisecond || len(w.shutdownHooks) != 1 {
+		t.Errorf("TestNewWatcherFromEnv: expected a 1500ms timeout, got %v", err)
+	}
+	for _, bad := range []string{"5s", "-1", "1e3"} {
+		t.Setenv(TimeoutEnvVar, bad)
+		if w, err := NewWatcherFromEnv(); err == nil || w != nil {
+			t.Errorf("TestNewWatcherFromEnv: %q should be rejected", bad)
+		}
+	}
+}
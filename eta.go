@@ -0,0 +1,76 @@
+package httpdshutdown
+
+import "time"
+
+// drainRateWeight is the weight an observed closure rate gets in the smoothed rate.
+const drainRateWeight = 0.3
+
+// drainRate estimates how fast connections close during a drain, as an
+// exponentially weighted moving average of the rates observed between closures.
+type drainRate struct {
+	last    time.Time // When the drain started or a closure was last counted.
+	pending int       // Closures observed at last that are not yet counted.
+	rate    float64   // Smoothed closures per second; zero until one is counted.
+}
+
+// reset starts a new estimate for a drain beginning at now.
+func (r *drainRate) reset(now time.Time) {
+	*r = drainRate{last: now}
+}
+
+// observe records that n connections closed at now. Closures observed at the same
+// instant are counted together once time has moved on, since no rate can be taken
+// over no time.
+func (r *drainRate) observe(now time.Time, n int) {
+	elapsed := now.Sub(r.last)
+	if elapsed <= 0 {
+		r.pending += n
+		return
+	}
+	observed := float64(r.pending+n) / elapsed.Seconds()
+	if r.rate == 0 {
+		r.rate = observed
+	} else {
+		r.rate = drainRateWeight*observed + (1-drainRateWeight)*r.rate
+	}
+	r.last, r.pending = now, 0
+}
+
+// eta returns the time open connections should take to close at the smoothed rate,
+// or zero if no closure has been counted. The rate is capped by the time since the
+// last closure, so an estimate stretches out while the drain stalls.
+func (r *drainRate) eta(now time.Time, open int) time.Duration {
+	if r.rate == 0 || open == 0 {
+		return 0
+	}
+	rate := r.rate
+	if since := now.Sub(r.last).Seconds(); since > 0 && 1/since < rate {
+		rate = 1 / since
+	}
+	return time.Duration(float64(open) / rate * float64(time.Second))
+}
+
+// DrainETA estimates how long the shutdown in progress will take to drain the
+// connections still open, at the rate they have been closing, smoothed so that a
+// burst of closures does not swing the estimate. It returns zero when no shutdown is
+// in progress, nothing remains to drain or no connection has closed yet, since no
+// estimate can be made without progress. An operator can report it alongside
+// `WithProgress`.
+//
+// Example use:
+//
+//     watcher.Configure(httpdshutdown.WithProgress(time.Second, func(open int) {
+//             log.Printf("%d connections open, ~%v to drain", open, watcher.DrainETA())
+//     }))
+//
+func (w *Watcher) DrainETA() time.Duration {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopping == 0 {
+		return 0
+	}
+	return w.drainRate.eta(w.clock.Now(), w.openConns)
+}
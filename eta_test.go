@@ -0,0 +1,60 @@
+package httpdshutdown
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDrainETA(t *testing.T) {
+	fc := newFakeClock()
+	w := newWatcherWithClock(fc, time.Minute)
+	for i := 0; i < 10; i++ {
+		w.RecordConnState(http.StateNew)
+	}
+	if eta := w.DrainETA(); eta != 0 {
+		t.Errorf("TestDrainETA: expected no estimate before a shutdown, got %v", eta)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- w.OnStop() }()
+	fc.BlockUntil(t, 1)
+	if eta := w.DrainETA(); eta != 0 {
+		t.Errorf("TestDrainETA: expected no estimate before any progress, got %v", eta)
+	}
+
+	// A steady 10 closures per second, with 6 connections left, is 600ms to go.
+	for i := 0; i < 4; i++ {
+		fc.Advance(100 * time.Millisecond)
+		w.RecordConnState(http.StateClosed)
+	}
+	if eta := w.DrainETA(); eta < 590*time.Millisecond || eta > 610*time.Millisecond {
+		t.Errorf("TestDrainETA: expected about 600ms, got %v", eta)
+	}
+	// Two closures at once count as a burst over the next interval, which the
+	// smoothing damps.
+	fc.Advance(100 * time.Millisecond)
+	w.RecordConnState(http.StateClosed)
+	w.RecordConnState(http.StateClosed)
+	if eta := w.DrainETA(); eta < 300*time.Millisecond || eta > 400*time.Millisecond {
+		t.Errorf("TestDrainETA: expected about 400ms after the burst, got %v", eta)
+	}
+	// A stall stretches the estimate out.
+	fc.Advance(time.Second)
+	if eta := w.DrainETA(); eta < 4*time.Second {
+		t.Errorf("TestDrainETA: expected the stall to stretch the estimate, got %v", eta)
+	}
+
+	for i := 0; i < 4; i++ {
+		w.RecordConnState(http.StateClosed)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if eta := w.DrainETA(); eta != 0 {
+		t.Errorf("TestDrainETA: expected no estimate after the shutdown, got %v", eta)
+	}
+	var nilW *Watcher
+	if eta := nilW.DrainETA(); eta != 0 {
+		t.Errorf("TestDrainETA: expected zero from a nil watcher, got %v", eta)
+	}
+}
@@ -0,0 +1,82 @@
+package httpdshutdown
+
+import (
+	"fmt"
+	"time"
+)
+
+// hookEventBuffer is the capacity of the channel returned by HookEvents.
+const hookEventBuffer = 64
+
+// HookEventKind says whether a HookEvent reports a hook starting or finishing.
+type HookEventKind int
+
+const (
+	// HookStarted is emitted just before a hook runs.
+	HookStarted HookEventKind = iota
+	// HookFinished is emitted once a hook has returned.
+	HookFinished
+)
+
+// String returns a lower case name for the kind of event.
+func (k HookEventKind) String() string {
+	switch k {
+	case HookStarted:
+		return "started"
+	case HookFinished:
+		return "finished"
+	}
+	return fmt.Sprintf("HookEventKind(%d)", int(k))
+}
+
+// HookEvent reports progress through the shutdown hooks as they run.
+type HookEvent struct {
+	Kind     HookEventKind // Whether the hook started or finished.
+	Name     string        // Name the hook was registered under.
+	Err      error         // Error returned by the hook; set for HookFinished only.
+	Duration time.Duration // How long the hook ran; set for HookFinished only.
+}
+
+// HookEvents returns a channel receiving a `HookEvent` as each shutdown hook starts
+// and finishes, for example to drive a live shutdown dashboard. Every call returns
+// the same channel, and events are only emitted once it has been requested.
+//
+// Hooks never wait on a slow reader: the channel buffers 64 events, and events that
+// arrive while the buffer is full are dropped. Read the channel promptly, or rely on
+// `LastReport` for a complete record.
+//
+// Example use:
+//
+//     go func() {
+//             for ev := range watcher.HookEvents() {
+//                     log.Printf("hook %s: %v", ev.Name, ev.Kind)
+//             }
+//     }()
+//
+func (w *Watcher) HookEvents() <-chan HookEvent {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.hookEvents == nil {
+		w.hookEvents = make(chan HookEvent, hookEventBuffer)
+	}
+	return w.hookEvents
+}
+
+// emitHookEvent sends ev to the HookEvents channel, dropping it if nobody has asked
+// for events or the buffer is full.
+func (w *Watcher) emitHookEvent(ev HookEvent) {
+	w.slogHook(ev)
+	w.mu.Lock()
+	events := w.hookEvents
+	w.mu.Unlock()
+	if events == nil {
+		return
+	}
+	select {
+	case events <- ev:
+	default:
+	}
+}
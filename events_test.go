@@ -0,0 +1,39 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHookEvents(t *testing.T) {
+	w, _ := NewWatcher(100)
+	failure := errors.New("flush failed")
+	_ = w.RegisterNamedHook("cache", func() error { return nil })
+	_ = w.RegisterNamedHook("metrics", func() error { return failure })
+	events := w.HookEvents()
+	if events != w.HookEvents() {
+		t.Errorf("TestHookEvents: repeated calls should return the same channel")
+	}
+	w.OnStop()
+	want := []HookEvent{
+		{Kind: HookStarted, Name: "cache"},
+		{Kind: HookFinished, Name: "cache"},
+		{Kind: HookStarted, Name: "metrics"},
+		{Kind: HookFinished, Name: "metrics", Err: failure},
+	}
+	for i, exp := range want {
+		got := <-events
+		got.Duration = 0
+		if got != exp {
+			t.Errorf("TestHookEvents: event %d: expected %+v, got %+v", i, exp, got)
+		}
+	}
+
+	// A reader that never drains the channel cannot block the hooks.
+	for i := 0; i < hookEventBuffer; i++ {
+		w.RunHooks()
+	}
+	if n := len(events); n != hookEventBuffer {
+		t.Errorf("TestHookEvents: expected a full buffer of %d events, got %d", hookEventBuffer, n)
+	}
+}
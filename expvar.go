@@ -0,0 +1,48 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+)
+
+// PublishExpvar publishes the watcher's counters with the standard `expvar` package, so
+// that they appear at /debug/vars, as a lightweight alternative to the Prometheus
+// collector of `httpdshutdownprom`. The counters are grouped in a map under name and
+// read afresh each time the map is served:
+//
+//     open_conns     connections currently open;
+//     total_conns    connections opened since creation or Reset;
+//     timeouts       shutdowns that exceeded the grace period;
+//     last_drain_ms  duration of the most recently completed shutdown, or 0.
+//
+// expvar names cannot be unpublished, so PublishExpvar returns an error if name is
+// already taken, for example by a second call.
+//
+// Example use:
+//
+//     watcher.PublishExpvar("httpdshutdown")
+//
+func (w *Watcher) PublishExpvar(name string) error {
+	if w == nil {
+		return fmt.Errorf("PublishExpvar: %w", ErrNilWatcher)
+	}
+	if name == "" {
+		return errors.New("PublishExpvar: name is empty")
+	}
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("PublishExpvar: %q is already published", name)
+	}
+	m := new(expvar.Map)
+	m.Set("open_conns", expvar.Func(func() interface{} { return w.OpenConns() }))
+	m.Set("total_conns", expvar.Func(func() interface{} { return w.Stats().TotalConns }))
+	m.Set("timeouts", expvar.Func(func() interface{} { return w.Stats().Timeouts }))
+	m.Set("last_drain_ms", expvar.Func(func() interface{} {
+		if report := w.LastReport(); report != nil {
+			return report.Duration.Milliseconds()
+		}
+		return int64(0)
+	}))
+	expvar.Publish(name, m)
+	return nil
+}
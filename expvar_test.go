@@ -0,0 +1,56 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPublishExpvar(t *testing.T) {
+	// Published names last for the life of the process, so each run needs its own.
+	name := fmt.Sprintf("TestPublishExpvar-%d", time.Now().UnixNano())
+	w, _ := NewWatcher(20)
+	if err := w.PublishExpvar(name); err != nil {
+		t.Fatalf("TestPublishExpvar: %v", err)
+	}
+	m := expvar.Get(name).(*expvar.Map)
+	get := func(key string) int {
+		t.Helper()
+		n, err := strconv.Atoi(m.Get(key).String())
+		if err != nil {
+			t.Fatalf("TestPublishExpvar: %s: %v", key, err)
+		}
+		return n
+	}
+	if get("open_conns") != 0 || get("last_drain_ms") != 0 {
+		t.Errorf("TestPublishExpvar: expected zeroes before any activity, got %v", m)
+	}
+
+	w.RecordConnState(http.StateNew)
+	w.RecordConnState(http.StateNew)
+	w.RecordConnState(http.StateClosed)
+	if err := w.OnStop(); !errors.Is(err, ErrShutdownTimeout) {
+		t.Fatalf("TestPublishExpvar: expected a timeout, got %v", err)
+	}
+	if get("open_conns") != 1 || get("total_conns") != 2 || get("timeouts") != 1 {
+		t.Errorf("TestPublishExpvar: unexpected counters %v", m)
+	}
+	if ms := get("last_drain_ms"); ms < 20 {
+		t.Errorf("TestPublishExpvar: expected the drain duration, got %dms", ms)
+	}
+
+	if err := w.PublishExpvar(name); err == nil {
+		t.Errorf("TestPublishExpvar: a taken name should be rejected")
+	}
+	if err := w.PublishExpvar(""); err == nil {
+		t.Errorf("TestPublishExpvar: an empty name should be rejected")
+	}
+	var nilW *Watcher
+	if err := nilW.PublishExpvar("nil"); !errors.Is(err, ErrNilWatcher) {
+		t.Errorf("TestPublishExpvar: expected ErrNilWatcher, got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInjectedFault is wrapped by the errors of faults injected with
+// `WithFaultInjection`, so that a test can tell them from real failures.
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultConfig describes the faults that `WithFaultInjection` injects into every
+// shutdown.
+type FaultConfig struct {
+	// ForceTimeout makes the drain report `ErrShutdownTimeout` however it went, so
+	// timeout hooks run and the shutdown counts as timed out.
+	ForceTimeout bool
+	// FailHook names a hook that fails with `ErrInjectedFault` instead of running.
+	FailHook string
+}
+
+// String describes the faults for DebugString.
+func (f FaultConfig) String() string {
+	var faults []string
+	if f.ForceTimeout {
+		faults = append(faults, "force timeout")
+	}
+	if f.FailHook != "" {
+		faults = append(faults, fmt.Sprintf("fail hook %q", f.FailHook))
+	}
+	if len(faults) == 0 {
+		return "none"
+	}
+	return strings.Join(faults, ", ")
+}
+
+// WithFaultInjection makes every shutdown fail as described by faults, without any
+// slow connection or broken resource, so that integration tests and game days can
+// exercise a daemon's error and exit paths deterministically. Injected failures wrap
+// `ErrInjectedFault` as well as the error they simulate, such as `ErrShutdownTimeout`,
+// and reach exit codes through `SigHandle` like real ones. Since the option breaks
+// shutdowns on purpose, every shutdown of a watcher configured with it logs a warning,
+// and `DebugString` lists the faults. It must never be configured in production.
+//
+// Example use:
+//
+//     watcher.Configure(httpdshutdown.WithFaultInjection(httpdshutdown.FaultConfig{
+//             ForceTimeout: true,
+//             FailHook:     "db",
+//     }))
+//
+func WithFaultInjection(faults FaultConfig) Option {
+	return func(w *Watcher) error {
+		if !faults.ForceTimeout && faults.FailHook == "" {
+			return errors.New("WithFaultInjection: no fault configured")
+		}
+		w.faults = &faults
+		return nil
+	}
+}
+
+// injectFailHook replaces the hook named by faults, if any, in hooks, a snapshot
+// owned by the caller, with one failing with ErrInjectedFault.
+func injectFailHook(hooks []namedHook, faults *FaultConfig) {
+	if faults == nil || faults.FailHook == "" {
+		return
+	}
+	for i := range hooks {
+		if hooks[i].name == faults.FailHook {
+			hooks[i].fn = func() error { return ErrInjectedFault }
+			hooks[i].ctxFn = nil
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestWithFaultInjection(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	if err := w.Configure(WithFaultInjection(FaultConfig{})); err == nil {
+		t.Errorf("TestWithFaultInjection: a config without faults should be rejected")
+	}
+
+	// A forced timeout, with nothing to drain.
+	timeoutHookRan := false
+	_ = w.RegisterTimeoutHook(func() error {
+		timeoutHookRan = true
+		return nil
+	})
+	if err := w.Configure(WithFaultInjection(FaultConfig{ForceTimeout: true})); err != nil {
+		t.Fatal(err)
+	}
+	err := w.OnStop()
+	if !errors.Is(err, ErrShutdownTimeout) || !errors.Is(err, ErrInjectedFault) {
+		t.Errorf("TestWithFaultInjection: expected an injected timeout, got %v", err)
+	}
+	if r := w.LastReport(); r == nil || !r.TimedOut || !timeoutHookRan || w.Phase() != PhaseTimedOut {
+		t.Errorf("TestWithFaultInjection: the shutdown should count as timed out")
+	}
+	if !strings.Contains(w.DebugString(), "faults:      force timeout") {
+		t.Errorf("TestWithFaultInjection: DebugString should list the faults, got\n%s", w.DebugString())
+	}
+
+	// A failed hook, reported through the exit code; the real hook does not run.
+	w, _ = NewWatcher(1000)
+	dbClosed, cacheFlushed := false, false
+	_ = w.RegisterNamedHook("db", func() error {
+		dbClosed = true
+		return nil
+	})
+	_ = w.RegisterNamedHook("cache", func() error {
+		cacheFlushed = true
+		return nil
+	})
+	if err := w.Configure(WithFaultInjection(FaultConfig{FailHook: "db"})); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := w.dispatchSignal(syscall.SIGTERM, nil); code != 1 {
+		t.Errorf("TestWithFaultInjection: expected exit code 1, got %d", code)
+	}
+	if err := w.Wait(); !errors.Is(err, ErrInjectedFault) || !strings.Contains(err.Error(), "db") {
+		t.Errorf("TestWithFaultInjection: expected the db hook to fail, got %v", err)
+	}
+	if dbClosed || !cacheFlushed {
+		t.Errorf("TestWithFaultInjection: only the failing hook should be replaced")
+	}
+}
@@ -0,0 +1,86 @@
+package httpdshutdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DrainGate reports whether an external condition that must hold before a shutdown
+// completes is satisfied, for example that a load balancer has taken the node out
+// of rotation. See `RegisterDrainGate`.
+type DrainGate func(ctx context.Context) (bool, error)
+
+// RegisterDrainGate adds a condition that gates the completion of every shutdown on
+// external state rather than only on the local connection count. Once connections
+// have drained, each gate is polled until it returns true, and hooks only run after
+// every gate is satisfied or the grace period expires, in which case `OnStop`
+// returns an error wrapping `ErrShutdownTimeout`. A gate that returns an error is no
+// longer polled and does not hold up the shutdown; its error is returned by `OnStop`.
+// ctx expires with the grace period.
+//
+// Example use:
+//
+//     watcher.RegisterDrainGate(func(ctx context.Context) (bool, error) {
+//             return lb.IsDeregistered(ctx, nodeID)
+//     })
+//
+func (w *Watcher) RegisterDrainGate(gate DrainGate) error {
+	if w == nil {
+		return fmt.Errorf("RegisterDrainGate: %w", ErrNilWatcher)
+	}
+	if gate == nil {
+		return errors.New("RegisterDrainGate: gate is nil")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.drainGates = append(w.drainGates, gate)
+	return nil
+}
+
+// waitGates polls gates until all are satisfied, remaining has elapsed or cancel is
+// closed.
+func (w *Watcher) waitGates(gates []DrainGate, remaining time.Duration, cancel <-chan struct{}) error {
+	if len(gates) == 0 {
+		return nil
+	}
+	ctx, ctxCancel := withClockDeadline(context.Background(), w.clock, w.clock.Now().Add(remaining))
+	defer ctxCancel()
+	timer, stopTimer := w.clock.After(remaining)
+	defer stopTimer()
+	w.mu.Lock()
+	interval := w.pollIntervalLocked()
+	w.mu.Unlock()
+	poll, stopPoll := w.clock.Tick(interval)
+	defer stopPoll()
+	var errs []error
+	pending := make([]int, len(gates))
+	for i := range gates {
+		pending[i] = i
+	}
+	for {
+		var waiting []int
+		for _, i := range pending {
+			ok, err := gates[i](ctx)
+			switch {
+			case err != nil:
+				errs = append(errs, fmt.Errorf("OnStop: drain gate %d: %w", i, err))
+			case !ok:
+				waiting = append(waiting, i)
+			}
+		}
+		pending = waiting
+		if len(pending) == 0 {
+			return errors.Join(errs...)
+		}
+		select {
+		case <-poll:
+		case <-timer:
+			return errors.Join(append(errs, fmt.Errorf("OnStop: %w with %d drain gates unsatisfied",
+				ErrShutdownTimeout, len(pending)))...)
+		case <-cancel:
+			return errors.Join(errs...)
+		}
+	}
+}
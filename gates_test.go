@@ -0,0 +1,66 @@
+package httpdshutdown
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegisterDrainGate(t *testing.T) {
+	w, _ := NewWatcher(2000)
+	if err := w.RegisterDrainGate(nil); err == nil {
+		t.Errorf("TestRegisterDrainGate: nil gate should be rejected")
+	}
+	// The gate is satisfied on its third poll.
+	var polls int32
+	hookRan := false
+	_ = w.RegisterHook(func() error {
+		hookRan = atomic.LoadInt32(&polls) >= 3
+		return nil
+	})
+	if err := w.RegisterDrainGate(func(ctx context.Context) (bool, error) {
+		return atomic.AddInt32(&polls, 1) >= 3, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestRegisterDrainGate: satisfied gate should not fail the shutdown, got %v", err)
+	}
+	if !hookRan {
+		t.Errorf("TestRegisterDrainGate: hooks should run once the gate is satisfied")
+	}
+}
+
+func TestDrainGateTimeout(t *testing.T) {
+	w, _ := NewWatcher(100)
+	_ = w.RegisterDrainGate(func(ctx context.Context) (bool, error) {
+		return false, nil
+	})
+	start := time.Now()
+	if err := w.OnStop(); !errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("TestDrainGateTimeout: unsatisfied gate should time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("TestDrainGateTimeout: gate should be polled until the timeout, took %v", elapsed)
+	}
+}
+
+func TestDrainGateError(t *testing.T) {
+	w, _ := NewWatcher(5000)
+	lbErr := errors.New("lb unreachable")
+	var polls int32
+	_ = w.RegisterDrainGate(func(ctx context.Context) (bool, error) {
+		atomic.AddInt32(&polls, 1)
+		return false, lbErr
+	})
+	start := time.Now()
+	err := w.OnStop()
+	if !errors.Is(err, lbErr) || errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("TestDrainGateError: expected the gate's error, got %v", err)
+	}
+	if time.Since(start) > time.Second || atomic.LoadInt32(&polls) != 1 {
+		t.Errorf("TestDrainGateError: a failed gate should not be polled again")
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/bradclawsie/httpdshutdown
+
+go 1.21
@@ -0,0 +1,201 @@
+package httpdshutdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// StopSteps overrides individual steps of the shutdown sequence performed by
+// `GracefulStopSteps`. A nil step runs the default. Every step gets the context
+// passed to `GracefulStopSteps`, whose deadline bounds the whole sequence.
+type StopSteps struct {
+	// StopAccepting stops the intake of new work. By default keep-alives are
+	// disabled on attached servers, so connections close after their current
+	// request. The watcher is marked as draining before this step in any case, so
+	// listeners from `WrapListener` refuse new connections and `Context` is done.
+	StopAccepting func(ctx context.Context) error
+	// WaitActive waits for requests in flight to complete. By default attached
+	// servers are shut down with ctx, and the watcher waits until no identified
+	// connection has a request in flight or, if no connection identities are
+	// known, until every connection has closed.
+	WaitActive func(ctx context.Context) error
+	// CloseIdle closes the connections still open once requests have completed. By
+	// default every identified idle connection is closed.
+	CloseIdle func(ctx context.Context) error
+	// RunHooks runs the shutdown hooks. By default the registered hooks run, with
+	// context hooks getting the deadline of ctx, and only required hooks fail the
+	// shutdown.
+	RunHooks func(ctx context.Context) error
+}
+
+// GracefulStop performs the recommended shutdown sequence in a single call:
+//
+//     1. stop accepting: mark the watcher as draining and disable keep-alives;
+//     2. wait for the requests in flight to complete, until the deadline of ctx;
+//     3. close the connections left idle;
+//     4. run the shutdown hooks, followed by the finalizers from `RegisterFinalizer`.
+//
+// If ctx has no deadline, the watcher's timeout is used, counted as for `OnStop`.
+// Every step runs even if an earlier one fails or the deadline passes, and the errors
+// are joined; a deadline that passes while requests are in flight is reported as
+// `ErrShutdownTimeout`. Use `GracefulStopSteps` to replace individual steps.
+//
+// Example use:
+//
+//     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+//     defer cancel()
+//     err := watcher.GracefulStop(ctx)
+//
+func (w *Watcher) GracefulStop(ctx context.Context) error {
+	if w == nil {
+		return fmt.Errorf("GracefulStop: %w", ErrNilWatcher)
+	}
+	return w.GracefulStopSteps(ctx, StopSteps{})
+}
+
+// GracefulStopSteps behaves like `GracefulStop`, running the steps set in steps in
+// place of the defaults.
+func (w *Watcher) GracefulStopSteps(ctx context.Context, steps StopSteps) error {
+	if w == nil {
+		return fmt.Errorf("GracefulStopSteps: %w", ErrNilWatcher)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.graceTimeout())
+		defer cancel()
+	}
+	start := w.clock.Now()
+	deadline, _ := ctx.Deadline()
+	w.mu.Lock()
+	w.draining.Store(true)
+	w.stopping++
+	w.stopDeadline = deadline
+	w.setPhaseLocked(PhaseDraining)
+	w.drainRate.reset(start)
+	if w.ctxCancel != nil {
+		w.ctxCancel()
+	}
+	servers := append([]attachedServer{}, w.servers...)
+	w.mu.Unlock()
+	if err := sdNotify("STOPPING=1"); err != nil {
+		w.logf("httpdshutdown: %v", err)
+	}
+
+	var results []HookResult
+	if steps.StopAccepting == nil {
+		steps.StopAccepting = func(context.Context) error {
+			for _, s := range servers {
+				s.srv.SetKeepAlivesEnabled(false)
+			}
+			return nil
+		}
+	}
+	if steps.WaitActive == nil {
+		steps.WaitActive = func(ctx context.Context) error {
+			return w.waitActive(ctx, servers)
+		}
+	}
+	if steps.CloseIdle == nil {
+		steps.CloseIdle = func(context.Context) error {
+			w.closeIdleConns()
+			return nil
+		}
+	}
+	if steps.RunHooks == nil {
+		steps.RunHooks = func(ctx context.Context) error {
+			// The deadline of ctx is on the wall clock; the hooks measure time on the
+			// watcher's.
+			var deadline time.Time
+			if d, ok := ctx.Deadline(); ok {
+				deadline = w.clock.Now().Add(time.Until(d))
+			}
+			var expired error
+			results, expired, _ = w.runHooks(deadline, nil)
+			return errors.Join(expired, requiredHookErr(results))
+		}
+	}
+
+	var errs []error
+	for _, step := range []struct {
+		name string
+		fn   func(context.Context) error
+	}{
+		{"stop accepting", steps.StopAccepting},
+		{"wait active", steps.WaitActive},
+		{"close idle", steps.CloseIdle},
+	} {
+		if err := step.fn(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("GracefulStop: %s: %w", step.name, err))
+		}
+	}
+	w.mu.Lock()
+	w.setPhaseLocked(PhaseHooks)
+	w.mu.Unlock()
+	if err := steps.RunHooks(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("GracefulStop: run hooks: %w", err))
+	}
+	finalResults, finalErr := w.runFinalizers()
+	if finalErr != nil {
+		errs = append(errs, fmt.Errorf("GracefulStop: finalizers: %w", finalErr))
+	}
+
+	err := errors.Join(errs...)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.report = &ShutdownReport{
+		Start:    start,
+		Duration: w.clock.Now().Sub(start),
+		TimedOut: errors.Is(err, ErrShutdownTimeout),
+		Hooks:    append(results, finalResults...),
+	}
+	w.stopping--
+	if w.report.TimedOut {
+		w.timeouts++
+		w.setPhaseLocked(PhaseTimedOut)
+	} else {
+		w.setPhaseLocked(PhaseDone)
+	}
+	w.completeLocked(err)
+	return err
+}
+
+// waitActive shuts down servers with ctx and waits until no request is in flight,
+// which is judged by the identified connections if there are any and by the open
+// connection count otherwise.
+func (w *Watcher) waitActive(ctx context.Context, servers []attachedServer) error {
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func(i int, srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				if errors.Is(err, context.DeadlineExceeded) {
+					err = ErrShutdownTimeout
+				}
+				errs[i] = fmt.Errorf("server %q: %w", srv.Addr, err)
+			}
+		}(i, s.srv)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); errors.Is(err, ErrShutdownTimeout) {
+		return err
+	}
+
+	w.mu.Lock()
+	done := w.drained
+	if len(w.conns) > 0 {
+		done = w.idle
+	}
+	w.mu.Unlock()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("%w with %d connections still open", ErrShutdownTimeout, w.OpenConns()))
+	}
+	return errors.Join(errs...)
+}
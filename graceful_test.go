@@ -0,0 +1,137 @@
+package httpdshutdown
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGracefulStop(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	hookRan := false
+	w, _ := NewWatcher(2000, func() error {
+		hookRan = true
+		return nil
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Addr: ln.Addr().String(), Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+	if err := w.AttachServer(srv); err != nil {
+		t.Fatal(err)
+	}
+	wl := w.WrapListener(ln)
+	go srv.Serve(wl)
+	inFlight(t, "http://"+srv.Addr, started)
+
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	if err := w.GracefulStop(context.Background()); err != nil {
+		t.Errorf("TestGracefulStop: should drain without error, got %v", err)
+	}
+	if !hookRan {
+		t.Errorf("TestGracefulStop: hooks should run")
+	}
+	if _, err := wl.Accept(); !errors.Is(err, ErrDraining) {
+		t.Errorf("TestGracefulStop: the listener should refuse conns, got %v", err)
+	}
+	if w.Phase() != PhaseDone || w.LastReport() == nil {
+		t.Errorf("TestGracefulStop: shutdown should be complete, phase %v", w.Phase())
+	}
+	if err := w.Wait(); err != nil {
+		t.Errorf("TestGracefulStop: Wait should report the result, got %v", err)
+	}
+}
+
+func TestGracefulStopDeadline(t *testing.T) {
+	w, _ := NewWatcher(2000)
+	// A stuck request holds up the drain until the deadline; the hooks still run.
+	w.RecordConnState(http.StateNew)
+	hookRan := false
+	_ = w.RegisterHook(func() error {
+		hookRan = true
+		return nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := w.GracefulStop(ctx); !errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("TestGracefulStopDeadline: expected a timeout, got %v", err)
+	}
+	if !hookRan || !w.TimedOut() {
+		t.Errorf("TestGracefulStopDeadline: hooks should run after a timeout")
+	}
+}
+
+func TestGracefulStopCloseIdle(t *testing.T) {
+	w, _ := NewWatcher(2000)
+	ts := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ts.Config.ConnState = w.ConnStateHook()
+	ts.Start()
+	defer ts.Close()
+	// Leave a keep-alive connection idle.
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if w.OpenConns() != 1 {
+		t.Fatalf("TestGracefulStopCloseIdle: expected an idle conn, got %d", w.OpenConns())
+	}
+	if err := w.GracefulStop(context.Background()); err != nil {
+		t.Errorf("TestGracefulStopCloseIdle: should not have an error, got %v", err)
+	}
+	// The server reports StateClosed for the closed conn in turn.
+	for i := 0; i < 1000 && w.OpenConns() != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := w.OpenConns(); n != 0 {
+		t.Errorf("TestGracefulStopCloseIdle: the idle conn should be closed, got %d open", n)
+	}
+}
+
+func TestGracefulStopSteps(t *testing.T) {
+	w, _ := NewWatcher(2000, func() error {
+		t.Errorf("TestGracefulStopSteps: registered hooks should not run when overridden")
+		return nil
+	})
+	var order []string
+	step := func(name string, err error) func(context.Context) error {
+		return func(ctx context.Context) error {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Errorf("TestGracefulStopSteps: %s should get a deadline", name)
+			}
+			if name == "stop" && !w.IsDraining() {
+				t.Errorf("TestGracefulStopSteps: watcher should be draining before intake stops")
+			}
+			order = append(order, name)
+			return err
+		}
+	}
+	waitErr := errors.New("dependency still busy")
+	err := w.GracefulStopSteps(context.Background(), StopSteps{
+		StopAccepting: step("stop", nil),
+		WaitActive:    step("wait", waitErr),
+		CloseIdle:     step("close", nil),
+		RunHooks:      step("hooks", nil),
+	})
+	if want := []string{"stop", "wait", "close", "hooks"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("TestGracefulStopSteps: expected steps %v, got %v", want, order)
+	}
+	if !errors.Is(err, waitErr) {
+		t.Errorf("TestGracefulStopSteps: step error should be returned, got %v", err)
+	}
+	var nw *Watcher
+	if err := nw.GracefulStop(context.Background()); !errors.Is(err, ErrNilWatcher) {
+		t.Errorf("TestGracefulStopSteps: nil watcher should return ErrNilWatcher, got %v", err)
+	}
+}
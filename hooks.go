@@ -0,0 +1,945 @@
+package httpdshutdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// namedHook is a shutdown hook together with the name it is reported under.
+type namedHook struct {
+	name       string
+	fn         ShutdownHook
+	ctxFn      ContextShutdownHook // Used instead of fn when not nil.
+	deps       []string            // Names of hooks that must finish first.
+	hasDeps    bool                // Registered with RegisterHookDep.
+	group      int                 // Concurrency group, if grouped.
+	grouped    bool                // Registered with RegisterHookGroup.
+	bestEffort bool                // Failures are logged but do not fail OnStop.
+	postClose  bool                // Runs last, once the attached servers are closed.
+	rollback   ShutdownHook        // Undoes fn in strict mode if the shutdown fails.
+}
+
+// HookTiming selects when the shutdown hooks run relative to closing the servers
+// attached with `AttachServer` or `AttachGRPC`. See `WithHookTiming`.
+type HookTiming int
+
+const (
+	// AfterServerClose runs the hooks once the servers have stopped accepting,
+	// drained and closed, so no request can reach a resource a hook releases.
+	AfterServerClose HookTiming = iota
+	// BeforeServerClose runs the hooks as soon as the servers have stopped
+	// accepting, while the requests in flight are still being served, and closes
+	// the servers once both the hooks and the drain have finished.
+	BeforeServerClose
+)
+
+// RegisterHook adds a shutdown hook to a Watcher after it has been constructed. Hooks
+// run in the order in which they were registered.
+func (w *Watcher) RegisterHook(hook ShutdownHook) error {
+	if w == nil {
+		return fmt.Errorf("RegisterHook: %w", ErrNilWatcher)
+	}
+	if hook == nil {
+		return errors.New("RegisterHook: hook is nil")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.shutdownHooks = append(w.shutdownHooks, namedHook{name: anonymousHookName(len(w.shutdownHooks)), fn: hook})
+	return nil
+}
+
+// SetHooks replaces every hook registered with the Register methods by hooks, in a
+// single step, for example when a configuration reload redefines the shutdown plan.
+// A shutdown that starts concurrently runs either the old or the new set, never a
+// mix of the two. The new hooks are anonymous and run in the order given. Hooks
+// registered with `RegisterTimeoutHook` or `RegisterFinalizer` are kept.
+//
+// SetHooks is rejected with an error while a shutdown is in progress, rather than
+// deferred, so that the caller knows which set the shutdown ran.
+func (w *Watcher) SetHooks(hooks ...ShutdownHook) error {
+	if w == nil {
+		return fmt.Errorf("SetHooks: %w", ErrNilWatcher)
+	}
+	named := make([]namedHook, len(hooks))
+	for i, hook := range hooks {
+		if hook == nil {
+			return fmt.Errorf("SetHooks: hook %d is nil", i)
+		}
+		named[i] = namedHook{name: anonymousHookName(i), fn: hook}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopping > 0 {
+		return errors.New("SetHooks: shutdown in progress")
+	}
+	w.shutdownHooks = named
+	return nil
+}
+
+// RegisterNamedHook adds a shutdown hook that is identified by name in shutdown
+// reports. Hooks registered without a name are reported as `hook[N]`, where N is
+// their position among the registered hooks. Since two hooks with the same name make
+// logs ambiguous and usually indicate a copy-paste bug, registering a name that is
+// already taken is an error.
+func (w *Watcher) RegisterNamedHook(name string, hook ShutdownHook) error {
+	if w == nil {
+		return fmt.Errorf("RegisterNamedHook: %w", ErrNilWatcher)
+	}
+	if hook == nil {
+		return errors.New("RegisterNamedHook: hook is nil")
+	}
+	if name == "" {
+		return errors.New("RegisterNamedHook: name is empty")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.addNamedHookLocked("RegisterNamedHook", namedHook{name: name, fn: hook})
+}
+
+// NamedHook pairs a shutdown hook with the name it is registered under, for
+// registering hooks in bulk with `RegisterHooks`.
+type NamedHook struct {
+	Name string
+	Hook ShutdownHook
+}
+
+// RegisterHooks registers a batch of named hooks, for example from a config-driven
+// list, as if by `RegisterNamedHook` for each in order. The whole batch is validated
+// first: if any hook is nil, has an empty name, or has a name that is already
+// registered or repeated within the batch, an error is returned and none of the hooks
+// are added, so a bad entry does not leave the watcher half-configured.
+func (w *Watcher) RegisterHooks(hooks []NamedHook) error {
+	if w == nil {
+		return fmt.Errorf("RegisterHooks: %w", ErrNilWatcher)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	seen := make(map[string]bool, len(hooks))
+	for i, h := range hooks {
+		switch {
+		case h.Hook == nil:
+			return fmt.Errorf("RegisterHooks: hook %d is nil", i)
+		case h.Name == "":
+			return fmt.Errorf("RegisterHooks: hook %d has an empty name", i)
+		case seen[h.Name] || w.hasHookLocked(h.Name):
+			return fmt.Errorf("RegisterHooks: a hook named %q is already registered", h.Name)
+		}
+		seen[h.Name] = true
+	}
+	for _, h := range hooks {
+		w.shutdownHooks = append(w.shutdownHooks, namedHook{name: h.Name, fn: h.Hook})
+	}
+	return nil
+}
+
+// RegisterHookWithRollback adds a named shutdown hook together with a compensating
+// action that undoes it, such as registering again with a broker that the hook
+// deregistered from. Rollbacks only run in the strict mode set with
+// `WithStrictHooks`: if a required hook fails or the hooks budget expires, the
+// rollbacks of the hooks that succeeded run once every hook has finished, in
+// reverse order, leaving the system as it was for a later retry. They are reported
+// as `<name> rollback`, and their errors are returned along with the hook errors.
+//
+// Example use:
+//
+//     watcher.RegisterHookWithRollback("deregister", registry.Deregister, registry.Register)
+//
+func (w *Watcher) RegisterHookWithRollback(name string, hook, rollback ShutdownHook) error {
+	if w == nil {
+		return fmt.Errorf("RegisterHookWithRollback: %w", ErrNilWatcher)
+	}
+	if hook == nil || rollback == nil {
+		return errors.New("RegisterHookWithRollback: hook or rollback is nil")
+	}
+	if name == "" {
+		return errors.New("RegisterHookWithRollback: name is empty")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.addNamedHookLocked("RegisterHookWithRollback", namedHook{name: name, fn: hook, rollback: rollback})
+}
+
+// RegisterTimeoutHook adds a hook of last resort that runs only when a shutdown times
+// out, for diagnostics or cleanup that only make sense when the graceful shutdown
+// failed, such as dumping goroutine stacks or killing child processes. Timeout hooks
+// run in addition to the normal hooks, and before them, so they observe the stuck
+// state before cleanup changes it. They appear first in the shutdown report as
+// `timeout-hook[N]`; their errors are logged and reported but not returned, since
+// the shutdown already fails with `ErrShutdownTimeout`.
+func (w *Watcher) RegisterTimeoutHook(hook ShutdownHook) error {
+	if w == nil {
+		return fmt.Errorf("RegisterTimeoutHook: %w", ErrNilWatcher)
+	}
+	if hook == nil {
+		return errors.New("RegisterTimeoutHook: hook is nil")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	name := fmt.Sprintf("timeout-hook[%d]", len(w.timeoutHooks))
+	w.timeoutHooks = append(w.timeoutHooks, namedHook{name: name, fn: hook})
+	return nil
+}
+
+// runTimeoutHooks executes a snapshot of the hooks registered with
+// RegisterTimeoutHook.
+func (w *Watcher) runTimeoutHooks() []HookResult {
+	w.mu.Lock()
+	hooks := append([]namedHook{}, w.timeoutHooks...)
+	w.mu.Unlock()
+	if len(hooks) == 0 {
+		return nil
+	}
+	results, _, _ := runNamedHooks(context.Background(), w.clock, hooks, 0, w.logf, w.emitHookEvent)
+	return results
+}
+
+// RegisterFinalizer adds a hook that runs last on every shutdown outcome, whether the
+// drain completed or timed out, after the timeout hooks and the normal hooks, for
+// work such as writing an audit log entry or flushing metrics. Finalizers run even if
+// an earlier hook failed, panicked or exceeded the budget set with `WithHooksTimeout`,
+// which does not apply to them. A shutdown cancelled with `CancelShutdown` runs no
+// hooks, finalizers included.
+//
+// Finalizers run in the order in which they were registered and appear last in the
+// shutdown report as `finalizer[N]`. Their errors fail the shutdown like those of
+// normal hooks.
+func (w *Watcher) RegisterFinalizer(hook ShutdownHook) error {
+	if w == nil {
+		return fmt.Errorf("RegisterFinalizer: %w", ErrNilWatcher)
+	}
+	if hook == nil {
+		return errors.New("RegisterFinalizer: hook is nil")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	name := fmt.Sprintf("finalizer[%d]", len(w.finalizers))
+	w.finalizers = append(w.finalizers, namedHook{name: name, fn: hook})
+	return nil
+}
+
+// runFinalizers executes a snapshot of the hooks registered with RegisterFinalizer.
+func (w *Watcher) runFinalizers() ([]HookResult, error) {
+	w.mu.Lock()
+	hooks := append([]namedHook{}, w.finalizers...)
+	w.mu.Unlock()
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+	results, _, err := runNamedHooks(context.Background(), w.clock, hooks, 0, w.logf, w.emitHookEvent)
+	return results, err
+}
+
+// RegisterContextHook adds a named shutdown hook that receives a context. During
+// `OnStop` the context's deadline is the end of the grace period, start + timeout,
+// so the time a slow drain used is no longer available to the hooks and the whole
+// shutdown stays within the grace period. With `WithHooksTimeout` the deadline is
+// instead the end of the hooks budget. When hooks are run directly with `RunHooks`
+// the context only has a deadline if a hooks budget is set.
+//
+// Example use:
+//
+//    watcher.RegisterContextHook("flush", func(ctx context.Context) error {
+//            return queue.Flush(ctx)
+//    })
+//
+func (w *Watcher) RegisterContextHook(name string, hook ContextShutdownHook) error {
+	if w == nil {
+		return fmt.Errorf("RegisterContextHook: %w", ErrNilWatcher)
+	}
+	if hook == nil {
+		return errors.New("RegisterContextHook: hook is nil")
+	}
+	if name == "" {
+		return errors.New("RegisterContextHook: name is empty")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.addNamedHookLocked("RegisterContextHook", namedHook{name: name, ctxFn: hook})
+}
+
+// RegisterBestEffortHook adds a named shutdown hook whose failure is logged and
+// reported but does not fail the shutdown, for cleanup such as flushing metrics to an
+// endpoint that may be unreachable. An error from any other, required, hook is
+// returned by `OnStop`, so `SigHandle` exits with code 1; an error from a best-effort
+// hook leaves the exit code alone. `RunHooks` returns the errors of all hooks.
+func (w *Watcher) RegisterBestEffortHook(name string, hook ShutdownHook) error {
+	if w == nil {
+		return fmt.Errorf("RegisterBestEffortHook: %w", ErrNilWatcher)
+	}
+	if hook == nil {
+		return errors.New("RegisterBestEffortHook: hook is nil")
+	}
+	if name == "" {
+		return errors.New("RegisterBestEffortHook: name is empty")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.addNamedHookLocked("RegisterBestEffortHook", namedHook{name: name, fn: hook, bestEffort: true})
+}
+
+// RegisterPostCloseHook adds a named shutdown hook that runs strictly after every
+// server attached with `AttachServer` or `AttachGRPC` has been shut down and closed,
+// for cleanup that serving depends on, such as stopping the refresh loop of an OCSP
+// stapler or TLS session ticket keys, which must outlive the last TLS handshake.
+// Post-close hooks run after the other hooks, in the order they were registered.
+// With the default `AfterServerClose` timing every hook already runs after the servers
+// close; with `BeforeServerClose`, the other hooks run during the drain while
+// post-close hooks wait for the servers, within the hooks' deadline.
+//
+// Example use:
+//
+//     watcher.RegisterPostCloseHook("ocsp", stapler.Stop)
+//
+func (w *Watcher) RegisterPostCloseHook(name string, hook ShutdownHook) error {
+	if w == nil {
+		return fmt.Errorf("RegisterPostCloseHook: %w", ErrNilWatcher)
+	}
+	if hook == nil {
+		return errors.New("RegisterPostCloseHook: hook is nil")
+	}
+	if name == "" {
+		return errors.New("RegisterPostCloseHook: name is empty")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.addNamedHookLocked("RegisterPostCloseHook", namedHook{name: name, fn: hook, postClose: true})
+}
+
+// postCloseLast moves the post-close hooks of hooks, a snapshot owned by the caller,
+// after the others, keeping the order of each. If serversClosed is not nil, they also
+// wait for it to be closed before running, or give up when their context ends.
+func postCloseLast(hooks []namedHook, serversClosed <-chan struct{}) []namedHook {
+	ordered := make([]namedHook, 0, len(hooks))
+	var post []namedHook
+	for _, h := range hooks {
+		if !h.postClose {
+			ordered = append(ordered, h)
+			continue
+		}
+		if serversClosed != nil {
+			inner := h
+			h.fn, h.ctxFn = nil, func(ctx context.Context) error {
+				select {
+				case <-serversClosed:
+				case <-ctx.Done():
+					return fmt.Errorf("waiting for the servers to close: %w", ctx.Err())
+				}
+				return callHook(ctx, inner)
+			}
+		}
+		post = append(post, h)
+	}
+	return append(ordered, post...)
+}
+
+// hasHookLocked reports whether a hook named name is registered. w.mu must be held.
+func (w *Watcher) hasHookLocked(name string) bool {
+	for _, h := range w.shutdownHooks {
+		if h.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addNamedHookLocked registers h unless its name is already taken, reporting errors
+// under the name of the calling method. w.mu must be held.
+func (w *Watcher) addNamedHookLocked(method string, h namedHook) error {
+	if w.hasHookLocked(h.name) {
+		return fmt.Errorf("%s: a hook named %q is already registered", method, h.name)
+	}
+	w.shutdownHooks = append(w.shutdownHooks, h)
+	return nil
+}
+
+// RegisterCloserHook registers a named shutdown hook that closes c, which makes
+// registering database handles, files and listeners a one-liner.
+//
+// Example use:
+//
+//    watcher.RegisterCloserHook("db", db)
+//
+func (w *Watcher) RegisterCloserHook(name string, c io.Closer) error {
+	if w == nil {
+		return fmt.Errorf("RegisterCloserHook: %w", ErrNilWatcher)
+	}
+	if c == nil {
+		return errors.New("RegisterCloserHook: closer is nil")
+	}
+	return w.RegisterNamedHook(name, c.Close)
+}
+
+// RegisterHookDep adds a named shutdown hook that must not start until every hook
+// named in deps has finished. Dependencies only constrain ordering: a dependency
+// that returns an error does not prevent its dependents from running.
+//
+// Once any hook is registered this way, `RunHooks` schedules hooks as a dependency
+// graph and runs independent branches concurrently. Hooks registered without
+// dependencies keep running one after another in registration order. A dependency
+// may name a hook that is registered later; registering a hook that would complete
+// a cycle is an error.
+//
+// Example use:
+//
+//    watcher.RegisterNamedHook("stop-writes", stopWrites)
+//    watcher.RegisterHookDep("flush", []string{"stop-writes"}, flushBuffer)
+//    watcher.RegisterHookDep("close-db", []string{"flush"}, closeDB)
+//
+func (w *Watcher) RegisterHookDep(name string, deps []string, hook ShutdownHook) error {
+	if w == nil {
+		return fmt.Errorf("RegisterHookDep: %w", ErrNilWatcher)
+	}
+	if hook == nil {
+		return errors.New("RegisterHookDep: hook is nil")
+	}
+	if name == "" {
+		return errors.New("RegisterHookDep: name is empty")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.hasHookLocked(name) {
+		return fmt.Errorf("RegisterHookDep: a hook named %q is already registered", name)
+	}
+	hooks := append(append([]namedHook{}, w.shutdownHooks...), namedHook{
+		name:    name,
+		fn:      hook,
+		deps:    append([]string(nil), deps...),
+		hasDeps: true,
+	})
+	// A dependency on a hook that is not registered yet is allowed here, since it
+	// may be registered later, but a cycle never is.
+	if preds, _ := hookGraph(hooks); preds != nil {
+		if err := findCycle(hooks, preds); err != nil {
+			return fmt.Errorf("RegisterHookDep: %w", err)
+		}
+	}
+	w.shutdownHooks = hooks
+	return nil
+}
+
+// RegisterHookGroup adds a shutdown hook to a concurrency group. Groups run in
+// ascending order: the hooks of a group start together, once every hook of the
+// previous group has finished, and run concurrently with each other. This sits
+// between hooks that run one after another and a full dependency graph built with
+// `RegisterHookDep`; for example, flushing several caches can happen in parallel but
+// must complete before the database closes:
+//
+//     watcher.RegisterHookGroup(0, flushSessions)
+//     watcher.RegisterHookGroup(0, flushMetrics)
+//     watcher.RegisterHookGroup(1, closeDB)
+//
+// Group numbers need not be consecutive. Grouped hooks are scheduled like hooks with
+// dependencies, so they do not wait for hooks registered without a group. They are
+// reported as `hook[N]` like other anonymous hooks.
+func (w *Watcher) RegisterHookGroup(group int, hook ShutdownHook) error {
+	if w == nil {
+		return fmt.Errorf("RegisterHookGroup: %w", ErrNilWatcher)
+	}
+	if hook == nil {
+		return errors.New("RegisterHookGroup: hook is nil")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.shutdownHooks = append(w.shutdownHooks, namedHook{
+		name:    anonymousHookName(len(w.shutdownHooks)),
+		fn:      hook,
+		group:   group,
+		grouped: true,
+	})
+	return nil
+}
+
+// HookNames returns the names of the registered shutdown hooks in registration order,
+// with anonymous hooks reported as `hook[N]`, so a daemon can log at startup which
+// cleanup is wired up. Hooks registered with `RegisterTimeoutHook` are not included.
+//
+// Example use:
+//
+//     log.Printf("shutdown hooks: %s", strings.Join(watcher.HookNames(), ", "))
+//
+func (w *Watcher) HookNames() []string {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	names := make([]string, len(w.shutdownHooks))
+	for i, h := range w.shutdownHooks {
+		names[i] = h.name
+	}
+	return names
+}
+
+// RunHooks executes registered hooks, each of which blocks. Typically this is called
+// automatically by `OnStop`. If any hooks fail, the returned error wraps every
+// hook's error and implements `Unwrap() []error`, so `errors.As` can recover the
+// error returned by an individual hook. Each failure is annotated with the hook's
+// name and elapsed time, and every hook's elapsed time is written to the logger set
+// with `WithLogger`. A hook that panics is recovered and fails with `ErrHookPanic`,
+// so the hooks after it still run. A hook whose error wraps `ErrRetryable` is retried.
+//
+// RunHooks runs the hooks registered when it starts. Registering hooks concurrently
+// is safe: the hook list is copied under the watcher's lock, which is not held while
+// hooks run, so hooks registered meanwhile are left for a later run.
+func (w *Watcher) RunHooks() error {
+	if w == nil {
+		return fmt.Errorf("RunHooks: %w", ErrNilWatcher)
+	}
+	_, err := w.RunHooksResult()
+	return err
+}
+
+// RunHooksResult behaves like `RunHooks` but also returns a `HookResult` for every
+// hook that ran, in execution order, whether it succeeded or failed, for audit or
+// telemetry of a run that returned no error.
+//
+// Example use:
+//
+//     results, err := watcher.RunHooksResult()
+//     for _, r := range results {
+//             log.Printf("hook %s: %v in %v", r.Name, r.Err, r.Duration)
+//     }
+//
+func (w *Watcher) RunHooksResult() ([]HookResult, error) {
+	if w == nil {
+		return nil, fmt.Errorf("RunHooksResult: %w", ErrNilWatcher)
+	}
+	results, _, err := w.runHooks(time.Time{}, nil)
+	return results, err
+}
+
+// HooksDone returns a channel that is closed once the shutdown hooks have finished,
+// including any rollbacks. Together with `ConnsDrained` it lets a coordinator overlap
+// teardown steps, for example releasing a port as soon as the connections are gone
+// while the hooks are still flushing. Unlike `Wait`, it does not wait for timeout
+// hooks, finalizers or the rest of the shutdown. The channel closes however the hooks
+// were run, including by `RunHooks`, and stays closed until `Reset` or `ReArm`. A nil
+// Watcher returns a nil channel.
+//
+// Example use:
+//
+//     <-watcher.ConnsDrained()
+//     releasePort()
+//     <-watcher.HooksDone()
+//     deregister()
+//
+func (w *Watcher) HooksDone() <-chan struct{} {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.hooksDone == nil {
+		w.hooksDone = make(chan struct{})
+	}
+	return w.hooksDone
+}
+
+// RunHookSlice runs hooks in order and aggregates their errors exactly like
+// `RunHooks`, for running a subset of hooks or hooks from another source outside a
+// Watcher. Hooks are reported under the names hook[0], hook[1] and so on.
+//
+// Example use:
+//
+//     err := httpdshutdown.RunHookSlice([]httpdshutdown.ShutdownHook{flushCache, closeDB})
+//
+func RunHookSlice(hooks []ShutdownHook) error {
+	named := make([]namedHook, len(hooks))
+	for i, h := range hooks {
+		named[i] = namedHook{name: anonymousHookName(i), fn: h}
+	}
+	_, _, err := runNamedHooks(context.Background(), realClock{}, named, 0, nil, nil)
+	return err
+}
+
+// runHooks executes a snapshot of the registered hooks, followed by extra, with
+// runNamedHooks. Context hooks get a context that expires at deadline, as measured by
+// the watcher's clock, or once the hooks budget is spent if one is set; a zero
+// deadline and no budget mean no deadline. Post-close hooks run last and, if
+// serversClosed is not nil, wait for it to be closed.
+func (w *Watcher) runHooks(deadline time.Time, serversClosed <-chan struct{},
+	extra ...ShutdownHook) (results []HookResult, expired error, err error) {
+	w.mu.Lock()
+	hooks := append([]namedHook{}, w.shutdownHooks...)
+	budget := w.hooksTimeout
+	injectFailHook(hooks, w.faults)
+	w.mu.Unlock()
+	hooks = postCloseLast(hooks, serversClosed)
+	for _, h := range extra {
+		hooks = append(hooks, namedHook{name: anonymousHookName(len(hooks)), fn: h})
+	}
+	ctx := context.Background()
+	if budget > 0 {
+		deadline = w.clock.Now().Add(budget)
+	}
+	// The deadline also bounds the retries of hooks returning ErrRetryable.
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = withClockDeadline(ctx, w.clock, deadline)
+		defer cancel()
+	}
+	w.mu.Lock()
+	tracer, strict := w.hookTracer, w.strictHooks
+	w.mu.Unlock()
+	endSpan := func(error) {}
+	if tracer != nil {
+		ctx, endSpan = tracer.StartShutdown(ctx)
+		ctx = context.WithValue(ctx, hookTracerKey{}, tracer)
+	}
+	results, expired, err = runNamedHooks(ctx, w.clock, hooks, budget, w.logf, w.emitHookEvent)
+	endSpan(errors.Join(expired, err))
+	if strict && (expired != nil || requiredHookErr(results) != nil) {
+		rollbacks := rollbackHooks(hooks, results)
+		rolled, _, rollbackErr := runNamedHooks(context.Background(), w.clock, rollbacks, 0, w.logf, w.emitHookEvent)
+		results, err = append(results, rolled...), errors.Join(err, rollbackErr)
+	}
+	w.mu.Lock()
+	if w.hooksDone == nil {
+		w.hooksDone = make(chan struct{})
+	}
+	select {
+	case <-w.hooksDone:
+	default:
+		close(w.hooksDone)
+	}
+	w.mu.Unlock()
+	return results, expired, err
+}
+
+// rollbackHooks returns the rollbacks of the hooks that succeeded, according to
+// results, in reverse order.
+func rollbackHooks(hooks []namedHook, results []HookResult) []namedHook {
+	var rollbacks []namedHook
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if hooks[i].rollback != nil && results[i].Err == nil {
+			rollbacks = append(rollbacks, namedHook{name: hooks[i].name + " rollback", fn: hooks[i].rollback})
+		}
+	}
+	return rollbacks
+}
+
+// runNamedHooks executes hooks, returning a result for each hook, in registration
+// order, along with the aggregate error. If the hooks exceed a positive budget,
+// runNamedHooks stops waiting for them, starts no further hooks and also returns an
+// error naming the hooks that did not finish. The outcome of every hook is written
+// to logf, and each hook starting and finishing is passed to emit, if not nil. The
+// budget, retries and durations are measured by c.
+func runNamedHooks(ctx context.Context, c clock, hooks []namedHook, budget time.Duration,
+	logf func(string, ...interface{}), emit func(HookEvent)) (results []HookResult, expired error, err error) {
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+	if emit == nil {
+		emit = func(HookEvent) {}
+	}
+	ran := make([]HookResult, len(hooks))
+	errs := make([]error, 0)
+	// A misconfigured dependency is reported, but never causes cleanup to be
+	// skipped: unknown dependencies are ignored, and a cycle falls back to running
+	// the hooks in registration order.
+	preds, graphErr := hookGraph(hooks)
+	if preds != nil {
+		if cycleErr := findCycle(hooks, preds); cycleErr != nil {
+			preds, graphErr = nil, cycleErr
+		}
+	}
+	if graphErr != nil {
+		errs = append(errs, fmt.Errorf("shutdown hook err: %w", graphErr))
+	}
+
+	var mu sync.Mutex
+	finished := make([]bool, len(hooks))
+	var stop chan struct{} // Closed once the budget expires; nil without a budget.
+	run := func(i int) {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		emit(HookEvent{Kind: HookStarted, Name: hooks[i].name})
+		result := runHook(ctx, c, hooks[i])
+		emit(HookEvent{Kind: HookFinished, Name: result.Name, Err: result.Err, Duration: result.Duration})
+		// A context hook that gave up because the budget expired did not finish,
+		// however the race between its return and the budget timer turned out.
+		expired := stop != nil && ctx.Err() != nil && errors.Is(result.Err, ctx.Err())
+		mu.Lock()
+		ran[i], finished[i] = result, !expired
+		mu.Unlock()
+	}
+	runAll := func() {
+		if preds == nil {
+			for i := range hooks {
+				run(i)
+			}
+			return
+		}
+		done := make([]chan struct{}, len(hooks))
+		for i := range hooks {
+			done[i] = make(chan struct{})
+		}
+		for i := range hooks {
+			go func(i int) {
+				defer close(done[i])
+				for _, p := range preds[i] {
+					<-done[p]
+				}
+				run(i)
+			}(i)
+		}
+		for i := range hooks {
+			<-done[i]
+		}
+	}
+	if budget <= 0 {
+		runAll()
+		results = ran
+	} else {
+		// Hooks run in the background so that an exhausted budget can stop the
+		// wait; a plain hook already running cannot be interrupted and is left to
+		// finish. Hooks share one context, cancelled when the budget expires, so context
+		// hooks still running can abort rather than outlive the shutdown.
+		var cancelCtx context.CancelFunc
+		ctx, cancelCtx = context.WithCancel(ctx)
+		defer cancelCtx()
+		stop = make(chan struct{})
+		all := make(chan struct{})
+		go func() {
+			defer close(all)
+			runAll()
+		}()
+		timer, stopTimer := c.After(budget)
+		select {
+		case <-all:
+		case <-timer:
+			close(stop)
+			cancelCtx()
+		}
+		stopTimer()
+
+		// Copy the results, since hooks left running past the budget may still write.
+		mu.Lock()
+		results = append([]HookResult(nil), ran...)
+		finished = append([]bool(nil), finished...)
+		mu.Unlock()
+	}
+
+	var unfinished []string
+	// The aggregate keeps each hook's original error, so `errors.Is` and
+	// `errors.As` can find them, while its message is one line per failure naming
+	// the hook and how much of the grace period it used.
+	for i, result := range results {
+		if !finished[i] {
+			unfinished = append(unfinished, hooks[i].name)
+			results[i] = HookResult{Name: hooks[i].name, Err: ErrHooksTimeout, Error: ErrHooksTimeout.Error(),
+				BestEffort: hooks[i].bestEffort}
+			continue
+		}
+		if result.Err != nil {
+			logf("httpdshutdown: hook %s failed after %v: %v", result.Name, result.Duration, result.Err)
+			errs = append(errs, hookFailure(result))
+			continue
+		}
+		logf("httpdshutdown: hook %s finished in %v", result.Name, result.Duration)
+	}
+	if len(unfinished) > 0 {
+		expired = fmt.Errorf("%w after %v, unfinished: %s", ErrHooksTimeout, budget, strings.Join(unfinished, ", "))
+		logf("httpdshutdown: %v", expired)
+		errs = append(errs, fmt.Errorf("shutdown hook err: %w", expired))
+	}
+	return results, expired, errors.Join(errs...)
+}
+
+// maxHookAttempts is how many times a hook returning ErrRetryable is called in
+// total, and hookRetryDelay the delay before its first retry, which doubles after
+// each one.
+const (
+	maxHookAttempts = 5
+	hookRetryDelay  = 10 * time.Millisecond
+)
+
+// runHook executes a single hook, retrying it while it returns ErrRetryable, and
+// records its outcome, timing both with c.
+func runHook(ctx context.Context, c clock, h namedHook) HookResult {
+	start := c.Now()
+	ctx, endSpan := startHookSpan(ctx, h.name)
+	err := callHook(ctx, h)
+	delay := hookRetryDelay
+retry:
+	for attempt := 1; attempt < maxHookAttempts && errors.Is(err, ErrRetryable); attempt++ {
+		if deadline, ok := ctx.Deadline(); ok && deadline.Sub(c.Now()) < delay {
+			break
+		}
+		t, stopT := c.After(delay)
+		select {
+		case <-ctx.Done():
+			stopT()
+			break retry
+		case <-t:
+		}
+		delay *= 2
+		err = callHook(ctx, h)
+	}
+	endSpan(err)
+	result := HookResult{Name: h.name, Duration: c.Now().Sub(start), Err: err, BestEffort: h.bestEffort}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	var p *hookPanic
+	if errors.As(err, &p) {
+		result.Panic, result.Stack = p.value, p.stack
+	}
+	return result
+}
+
+// hookPanic is the error reported for a hook that panicked. It wraps ErrHookPanic
+// and keeps the recovered value and the stack of the panicking goroutine for the
+// hook's `HookResult`.
+type hookPanic struct {
+	value interface{}
+	stack string
+}
+
+func (p *hookPanic) Error() string {
+	return fmt.Sprintf("%v: %v", ErrHookPanic, p.value)
+}
+
+func (p *hookPanic) Unwrap() error {
+	return ErrHookPanic
+}
+
+// callHook calls a single hook, turning a panic into a *hookPanic error.
+func callHook(ctx context.Context, h namedHook) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &hookPanic{value: r, stack: string(debug.Stack())}
+		}
+	}()
+	if h.ctxFn != nil {
+		return h.ctxFn(ctx)
+	}
+	return h.fn()
+}
+
+// hookGraph returns, for each hook, the indices of the hooks that must finish before
+// it starts. A hook registered with dependencies waits for the hooks it names; any
+// other hook waits for the previous hook registered without dependencies. A grouped
+// hook waits for every hook in the nearest lower group. If no hook has dependencies
+// or a group, hookGraph returns nil, meaning the hooks simply run in order.
+//
+// An error is returned if a dependency names an unknown hook; unknown dependencies
+// are left out of the graph.
+func hookGraph(hooks []namedHook) ([][]int, error) {
+	anyDeps := false
+	for _, h := range hooks {
+		anyDeps = anyDeps || h.hasDeps || h.grouped
+	}
+	if !anyDeps {
+		return nil, nil
+	}
+	index := make(map[string]int, len(hooks))
+	for i, h := range hooks {
+		if _, ok := index[h.name]; !ok {
+			index[h.name] = i
+		}
+	}
+
+	var err error
+	preds := make([][]int, len(hooks))
+	prev := -1
+	for i, h := range hooks {
+		if h.grouped {
+			preds[i] = previousGroup(hooks, h.group)
+			continue
+		}
+		if !h.hasDeps {
+			if prev >= 0 {
+				preds[i] = []int{prev}
+			}
+			prev = i
+			continue
+		}
+		for _, dep := range h.deps {
+			p, ok := index[dep]
+			if !ok {
+				if err == nil {
+					err = fmt.Errorf("hook %q depends on unknown hook %q", h.name, dep)
+				}
+				continue
+			}
+			preds[i] = append(preds[i], p)
+		}
+	}
+
+	return preds, err
+}
+
+// previousGroup returns the indices of the grouped hooks in the highest group below
+// group.
+func previousGroup(hooks []namedHook, group int) []int {
+	var members []int
+	var prev int
+	for i, h := range hooks {
+		if !h.grouped || h.group >= group {
+			continue
+		}
+		if len(members) == 0 || h.group > prev {
+			members, prev = members[:0], h.group
+		}
+		if h.group == prev {
+			members = append(members, i)
+		}
+	}
+	return members
+}
+
+// findCycle returns an error naming a hook that is part of a dependency cycle in
+// preds, or nil if there is none. A cycle would deadlock runHooks.
+func findCycle(hooks []namedHook, preds [][]int) error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(preds))
+	var visit func(i int) bool
+	visit = func(i int) bool {
+		state[i] = visiting
+		for _, p := range preds[i] {
+			if state[p] == visiting || (state[p] == unvisited && visit(p)) {
+				return true
+			}
+		}
+		state[i] = visited
+		return false
+	}
+	for i := range preds {
+		if state[i] == unvisited && visit(i) {
+			return fmt.Errorf("hook %q is part of a dependency cycle", hooks[i].name)
+		}
+	}
+	return nil
+}
+
+// requiredHookErr joins, in the same format as RunHooks, the errors of the hooks in
+// results that are not best-effort. Hooks that did not finish are left out, since the
+// hooks timeout is reported on its own.
+func requiredHookErr(results []HookResult) error {
+	var errs []error
+	for _, result := range results {
+		if result.Err != nil && !result.BestEffort && !errors.Is(result.Err, ErrHooksTimeout) {
+			errs = append(errs, hookFailure(result))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// hookFailure describes the failure of the hook that produced result.
+func hookFailure(result HookResult) error {
+	return fmt.Errorf("shutdown hook err: %s failed after %v: %w", result.Name, result.Duration, result.Err)
+}
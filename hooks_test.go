@@ -0,0 +1,928 @@
+package httpdshutdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRegisterHookDep(t *testing.T) {
+	w, wErr := NewWatcher(1000)
+	if w == nil || wErr != nil {
+		t.Fatalf("TestRegisterHookDep: should not be nil")
+	}
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) ShutdownHook {
+		return func() error {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return nil
+		}
+	}
+	// Register out of order to show dependencies, not registration, decide.
+	if err := w.RegisterHookDep("close-db", []string{"flush"}, record("close-db")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RegisterHookDep("flush", []string{"stop-writes"}, record("flush")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RegisterNamedHook("stop-writes", record("stop-writes")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RunHooks(); err != nil {
+		t.Fatalf("TestRegisterHookDep: unexpected error %v", err)
+	}
+	if strings.Join(order, ",") != "stop-writes,flush,close-db" {
+		t.Errorf("TestRegisterHookDep: unexpected order %v", order)
+	}
+}
+
+func TestRegisterHookDepConcurrent(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	// Each hook waits for the other to start, which only succeeds if independent
+	// branches run concurrently.
+	var started sync.WaitGroup
+	started.Add(2)
+	hook := func() error {
+		started.Done()
+		started.Wait()
+		return nil
+	}
+	if err := w.RegisterHookDep("a", nil, hook); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RegisterHookDep("b", nil, hook); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- w.RunHooks()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("TestRegisterHookDepConcurrent: unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("TestRegisterHookDepConcurrent: independent hooks did not run concurrently")
+	}
+}
+
+func TestRegisterHookDepErrors(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	noop := func() error { return nil }
+	if err := w.RegisterHookDep("x", []string{"y"}, noop); err != nil {
+		t.Fatalf("TestRegisterHookDepErrors: forward dependency should be allowed, got %v", err)
+	}
+	if err := w.RegisterHookDep("y", []string{"x"}, noop); err == nil {
+		t.Errorf("TestRegisterHookDepErrors: cycle should be rejected")
+	}
+	if err := w.RegisterHookDep("x", nil, noop); err == nil {
+		t.Errorf("TestRegisterHookDepErrors: duplicate name should be rejected")
+	}
+
+	// y was never registered, so x's dependency is unknown when hooks run. The
+	// hook still runs but the misconfiguration is reported.
+	ran := false
+	w2, _ := NewWatcher(1000)
+	if err := w2.RegisterHookDep("x", []string{"missing"}, func() error {
+		ran = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	err := w2.RunHooks()
+	if err == nil || !strings.Contains(err.Error(), "unknown hook") {
+		t.Errorf("TestRegisterHookDepErrors: expected unknown hook error, got %v", err)
+	}
+	if !ran {
+		t.Errorf("TestRegisterHookDepErrors: hook with unknown dependency should still run")
+	}
+}
+
+type testCloser struct {
+	closed bool
+	err    error
+}
+
+func (c *testCloser) Close() error {
+	c.closed = true
+	return c.err
+}
+
+func TestRegisterCloserHook(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	db := &testCloser{}
+	file := &testCloser{err: errors.New("close failed")}
+	if err := w.RegisterCloserHook("db", db); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RegisterCloserHook("file", file); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RegisterCloserHook("nil", nil); err == nil {
+		t.Errorf("TestRegisterCloserHook: nil closer should be rejected")
+	}
+	err := w.RunHooks()
+	if err == nil || !strings.Contains(err.Error(), "close failed") {
+		t.Errorf("TestRegisterCloserHook: expected close error, got %v", err)
+	}
+	if !db.closed || !file.closed {
+		t.Errorf("TestRegisterCloserHook: closers were not closed")
+	}
+}
+
+type hookTypedError struct {
+	code int
+}
+
+func (e *hookTypedError) Error() string {
+	return "typed hook error"
+}
+
+func TestRunHooksAggregateError(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	sentinel := errors.New("flush failed")
+	_ = w.RegisterHook(func() error { return sentinel })
+	_ = w.RegisterHook(func() error { return &hookTypedError{code: 7} })
+	err := w.RunHooks()
+	if err == nil {
+		t.Fatalf("TestRunHooksAggregateError: should have error")
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != 2 ||
+		!strings.HasPrefix(lines[0], "shutdown hook err: hook[0] failed after ") ||
+		!strings.HasSuffix(lines[0], ": flush failed") ||
+		!strings.HasPrefix(lines[1], "shutdown hook err: hook[1] failed after ") ||
+		!strings.HasSuffix(lines[1], ": typed hook error") {
+		t.Errorf("TestRunHooksAggregateError: unexpected message %q", err.Error())
+	}
+	if !errors.Is(err, sentinel) {
+		t.Errorf("TestRunHooksAggregateError: errors.Is should find the sentinel")
+	}
+	var typed *hookTypedError
+	if !errors.As(err, &typed) || typed.code != 7 {
+		t.Errorf("TestRunHooksAggregateError: errors.As should recover the typed error")
+	}
+	if _, ok := err.(interface{ Unwrap() []error }); !ok {
+		t.Errorf("TestRunHooksAggregateError: aggregate should implement Unwrap() []error")
+	}
+}
+
+func TestRunHooksElapsed(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	logger := new(testLogger)
+	if err := w.Configure(WithLogger(logger)); err != nil {
+		t.Fatal(err)
+	}
+	_ = w.RegisterNamedHook("slow", func() error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+	_ = w.RegisterNamedHook("broken", func() error { return errors.New("broken") })
+	err := w.RunHooks()
+	if err == nil || !strings.Contains(err.Error(), "broken failed after ") {
+		t.Errorf("TestRunHooksElapsed: error should name the hook and its elapsed time, got %v", err)
+	}
+	if !logger.contains("hook slow finished in ") || !logger.contains("hook broken failed after ") {
+		t.Errorf("TestRunHooksElapsed: every hook's elapsed time should be logged")
+	}
+}
+
+func TestRunHooksResult(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	_ = w.RegisterNamedHook("flush", func() error {
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	})
+	_ = w.RegisterNamedHook("broken", func() error { return errors.New("broken") })
+	_ = w.RegisterNamedHook("close", func() error { return nil })
+	results, err := w.RunHooksResult()
+	if err == nil || !strings.Contains(err.Error(), "broken failed after ") {
+		t.Errorf("TestRunHooksResult: expected the aggregate error, got %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("TestRunHooksResult: expected every hook in the result, got %+v", results)
+	}
+	for i, name := range []string{"flush", "broken", "close"} {
+		if r := results[i]; r.Name != name || (r.Err != nil) != (name == "broken") {
+			t.Errorf("TestRunHooksResult: unexpected result %d: %+v", i, r)
+		}
+	}
+	if results[0].Duration < 5*time.Millisecond {
+		t.Errorf("TestRunHooksResult: expected flush's duration, got %v", results[0].Duration)
+	}
+
+	// A clean run still lists what ran.
+	w, _ = NewWatcher(1000)
+	_ = w.RegisterNamedHook("flush", func() error { return nil })
+	if results, err := w.RunHooksResult(); err != nil || len(results) != 1 || results[0].Name != "flush" {
+		t.Errorf("TestRunHooksResult: expected one successful result, got %+v, %v", results, err)
+	}
+	var nilW *Watcher
+	if _, err := nilW.RunHooksResult(); !errors.Is(err, ErrNilWatcher) {
+		t.Errorf("TestRunHooksResult: expected ErrNilWatcher, got %v", err)
+	}
+}
+
+func TestHooksDone(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	_ = w.RegisterNamedHook("flush", func() error {
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	})
+	w.RecordConnState(http.StateNew)
+	drained, hooksDone := w.ConnsDrained(), w.HooksDone()
+	start := time.Now()
+	stopped := make(chan error, 1)
+	go func() { stopped <- w.OnStop() }()
+	time.Sleep(50 * time.Millisecond)
+	w.RecordConnState(http.StateClosed)
+
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("TestHooksDone: the connections never drained")
+	}
+	drainedAt := time.Since(start)
+	select {
+	case <-hooksDone:
+		t.Errorf("TestHooksDone: the hooks should still be running once the connections drain")
+	default:
+	}
+	select {
+	case <-hooksDone:
+	case <-time.After(time.Second):
+		t.Fatal("TestHooksDone: the hooks never finished")
+	}
+	if hooksAt := time.Since(start); hooksAt-drainedAt < 150*time.Millisecond {
+		t.Errorf("TestHooksDone: expected the hooks to finish well after the drain, got %v and %v",
+			drainedAt, hooksAt)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("TestHooksDone: %v", err)
+	}
+
+	// Reset forgets the finished hooks.
+	w.Reset()
+	select {
+	case <-w.HooksDone():
+		t.Errorf("TestHooksDone: a reset watcher should wait for the next hooks")
+	default:
+	}
+	var nilW *Watcher
+	if nilW.HooksDone() != nil {
+		t.Errorf("TestHooksDone: nil watcher should return a nil channel")
+	}
+}
+
+func TestHooksTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	w, _ := NewWatcher(50)
+	if err := w.Configure(WithHooksTimeout(0)); err == nil {
+		t.Errorf("TestHooksTimeout: zero timeout should be rejected")
+	}
+	if err := w.Configure(WithHooksTimeout(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	_ = w.RegisterNamedHook("quick", func() error { return nil })
+	_ = w.RegisterNamedHook("stuck", func() error {
+		<-release
+		return nil
+	})
+	lateRan := false
+	_ = w.RegisterNamedHook("late", func() error {
+		lateRan = true
+		return nil
+	})
+
+	// The drain times out on its own budget, and the hooks still get theirs.
+	w.RecordConnState(http.StateNew)
+	start := time.Now()
+	err := w.OnStop()
+	elapsed := time.Since(start)
+	if !errors.Is(err, ErrShutdownTimeout) || !errors.Is(err, ErrHooksTimeout) {
+		t.Errorf("TestHooksTimeout: expected drain and hooks timeouts, got %v", err)
+	}
+	if err != nil && (!strings.Contains(err.Error(), "unfinished: stuck, late") ||
+		strings.Contains(err.Error(), "quick")) {
+		t.Errorf("TestHooksTimeout: error should name only the unfinished hooks, got %v", err)
+	}
+	if elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("TestHooksTimeout: expected drain plus hooks budget, took %v", elapsed)
+	}
+	if lateRan {
+		t.Errorf("TestHooksTimeout: no hook should start after the budget expires")
+	}
+	report := w.LastReport()
+	if report == nil || len(report.Hooks) != 3 || report.Hooks[0].Err != nil ||
+		!errors.Is(report.Hooks[1].Err, ErrHooksTimeout) {
+		t.Errorf("TestHooksTimeout: unexpected report %+v", report)
+	}
+
+	// A fast drain does not extend the hooks budget.
+	w.RecordConnState(http.StateClosed)
+	if err := w.RunHooks(); !errors.Is(err, ErrHooksTimeout) {
+		t.Errorf("TestHooksTimeout: RunHooks should honor the budget, got %v", err)
+	}
+}
+
+func TestRunHookSlice(t *testing.T) {
+	if err := RunHookSlice(nil); err != nil {
+		t.Errorf("TestRunHookSlice: no hooks should not be an error, got %v", err)
+	}
+	sentinel := errors.New("flush failed")
+	var order []int
+	err := RunHookSlice([]ShutdownHook{
+		func() error { order = append(order, 0); return nil },
+		func() error { order = append(order, 1); return sentinel },
+	})
+	if len(order) != 2 || order[0] != 0 || order[1] != 1 {
+		t.Errorf("TestRunHookSlice: hooks should run in order, got %v", order)
+	}
+	if !errors.Is(err, sentinel) ||
+		!strings.HasPrefix(err.Error(), "shutdown hook err: hook[1] failed after ") {
+		t.Errorf("TestRunHookSlice: unexpected aggregate error %v", err)
+	}
+}
+
+func TestRegisterBestEffortHook(t *testing.T) {
+	w, _ := NewWatcher(100)
+	logger := new(testLogger)
+	_ = w.Configure(WithLogger(logger))
+	if err := w.RegisterBestEffortHook("", func() error { return nil }); err == nil {
+		t.Errorf("TestRegisterBestEffortHook: empty name should be rejected")
+	}
+	flushErr := errors.New("metrics endpoint unreachable")
+	if err := w.RegisterBestEffortHook("metrics", func() error { return flushErr }); err != nil {
+		t.Fatal(err)
+	}
+	sigs := make(chan os.Signal, 1)
+	exitcode := make(chan int, 1)
+	sigs <- syscall.SIGTERM
+	close(sigs)
+	w.SigHandle(sigs, exitcode)
+	if code := <-exitcode; code != 0 {
+		t.Errorf("TestRegisterBestEffortHook: best-effort failure should exit 0, got %d", code)
+	}
+	if !logger.contains("hook metrics failed after ") {
+		t.Errorf("TestRegisterBestEffortHook: best-effort failure should be logged")
+	}
+	report := w.LastReport()
+	if report == nil || len(report.Hooks) != 1 || !report.Hooks[0].BestEffort || report.Hooks[0].Err != flushErr {
+		t.Errorf("TestRegisterBestEffortHook: unexpected report %+v", report)
+	}
+	if err := w.RunHooks(); !errors.Is(err, flushErr) {
+		t.Errorf("TestRegisterBestEffortHook: RunHooks should report every failure, got %v", err)
+	}
+
+	// A required hook still fails the shutdown.
+	dbErr := errors.New("db close failed")
+	_ = w.RegisterNamedHook("db", func() error { return dbErr })
+	err := w.OnStop()
+	if !errors.Is(err, dbErr) || errors.Is(err, flushErr) {
+		t.Errorf("TestRegisterBestEffortHook: only the required failure should be returned, got %v", err)
+	}
+	if code, _ := w.dispatchSignal(syscall.SIGTERM, nil); code != 1 {
+		t.Errorf("TestRegisterBestEffortHook: required failure should exit 1, got %d", code)
+	}
+}
+
+func TestRegisterContextHook(t *testing.T) {
+	w, _ := NewWatcher(200)
+	if err := w.RegisterContextHook("flush", nil); err == nil {
+		t.Errorf("TestRegisterContextHook: nil hook should be rejected")
+	}
+	var remaining time.Duration
+	err := w.RegisterContextHook("flush", func(ctx context.Context) error {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return errors.New("no deadline")
+		}
+		remaining = time.Until(deadline)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A slow drain leaves the hooks a nearly expired context.
+	w.RecordConnState(http.StateNew)
+	time.AfterFunc(170*time.Millisecond, func() { w.RecordConnState(http.StateClosed) })
+	if err := w.OnStop(); err != nil {
+		t.Fatalf("TestRegisterContextHook: should not have an error, got %v", err)
+	}
+	if remaining > 40*time.Millisecond {
+		t.Errorf("TestRegisterContextHook: hook should get the rest of the grace period, got %v", remaining)
+	}
+
+	// A fast drain leaves nearly the whole grace period.
+	if err := w.OnStop(); err != nil {
+		t.Fatal(err)
+	}
+	if remaining < 150*time.Millisecond || remaining > 200*time.Millisecond {
+		t.Errorf("TestRegisterContextHook: hook should get the full grace period, got %v", remaining)
+	}
+}
+
+func TestRegisterTimeoutHook(t *testing.T) {
+	var order []string
+	w, _ := NewWatcher(20, func() error {
+		order = append(order, "normal")
+		return nil
+	})
+	if err := w.RegisterTimeoutHook(nil); err == nil {
+		t.Errorf("TestRegisterTimeoutHook: nil hook should be rejected")
+	}
+	_ = w.RegisterTimeoutHook(func() error {
+		order = append(order, "timeout")
+		return errors.New("stack dump failed")
+	})
+
+	// A clean drain runs only the normal hooks.
+	if err := w.OnStop(); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 1 || order[0] != "normal" {
+		t.Errorf("TestRegisterTimeoutHook: clean drain should skip timeout hooks, got %v", order)
+	}
+
+	// A timeout runs the timeout hooks first, then the normal hooks.
+	order = nil
+	w.RecordConnState(http.StateNew)
+	err := w.OnStop()
+	if !errors.Is(err, ErrShutdownTimeout) || strings.Contains(err.Error(), "stack dump failed") {
+		t.Errorf("TestRegisterTimeoutHook: expected only the timeout error, got %v", err)
+	}
+	if len(order) != 2 || order[0] != "timeout" || order[1] != "normal" {
+		t.Errorf("TestRegisterTimeoutHook: expected timeout then normal hooks, got %v", order)
+	}
+	report := w.LastReport()
+	if report == nil || len(report.Hooks) != 2 || report.Hooks[0].Name != "timeout-hook[0]" {
+		t.Errorf("TestRegisterTimeoutHook: unexpected report %+v", report)
+	}
+}
+
+func TestRegisterNamedHookDuplicate(t *testing.T) {
+	w, _ := NewWatcher(100)
+	closeDB := func() error { return nil }
+	if err := w.RegisterNamedHook("db", closeDB); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RegisterNamedHook("db", closeDB); err == nil || !strings.Contains(err.Error(), `"db"`) {
+		t.Errorf("TestRegisterNamedHookDuplicate: duplicate name should be rejected, got %v", err)
+	}
+	if err := w.RegisterBestEffortHook("db", closeDB); err == nil {
+		t.Errorf("TestRegisterNamedHookDuplicate: duplicate best-effort name should be rejected")
+	}
+	// Anonymous hooks are exempt.
+	if err := w.RegisterHook(closeDB); err != nil {
+		t.Errorf("TestRegisterNamedHookDuplicate: anonymous hook should be accepted, got %v", err)
+	}
+	if err := w.RegisterHook(closeDB); err != nil {
+		t.Errorf("TestRegisterNamedHookDuplicate: anonymous hook should be accepted, got %v", err)
+	}
+}
+
+func TestRegisterHookGroup(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) {
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+	}
+	// Registered first, but runs last since its group is highest.
+	if err := w.RegisterHookGroup(5, func() error {
+		record("close-db")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The flushes wait for each other to start, which only succeeds if they run
+	// concurrently.
+	var started sync.WaitGroup
+	started.Add(3)
+	for i := 0; i < 3; i++ {
+		if err := w.RegisterHookGroup(1, func() error {
+			started.Done()
+			started.Wait()
+			record("flush")
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.RegisterHookGroup(0, func() error {
+		record("stop-writes")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- w.RunHooks() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("TestRegisterHookGroup: unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("TestRegisterHookGroup: hooks within a group did not run concurrently")
+	}
+	if got := strings.Join(order, ","); got != "stop-writes,flush,flush,flush,close-db" {
+		t.Errorf("TestRegisterHookGroup: unexpected order %v", got)
+	}
+	if err := w.RegisterHookGroup(0, nil); err == nil {
+		t.Errorf("TestRegisterHookGroup: nil hook should be rejected")
+	}
+}
+
+func TestHookNames(t *testing.T) {
+	noop := func() error { return nil }
+	w, _ := NewWatcher(100, noop)
+	_ = w.RegisterNamedHook("db", noop)
+	_ = w.RegisterCloserHook("cache", io.NopCloser(nil))
+	_ = w.RegisterHook(noop)
+	_ = w.RegisterTimeoutHook(noop)
+	want := []string{"hook[0]", "db", "cache", "hook[3]"}
+	if got := w.HookNames(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("TestHookNames: expected %v, got %v", want, got)
+	}
+	// The returned slice is a copy.
+	w.HookNames()[0] = "changed"
+	if w.HookNames()[0] != "hook[0]" {
+		t.Errorf("TestHookNames: should return a copy")
+	}
+	var nw *Watcher
+	if nw.HookNames() != nil {
+		t.Errorf("TestHookNames: nil watcher should return nil")
+	}
+}
+
+func TestHooksTimeoutCancelsContext(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	if err := w.Configure(WithHooksTimeout(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	aborted := make(chan error, 1)
+	_ = w.RegisterContextHook("flush", func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			aborted <- ctx.Err()
+			return ctx.Err()
+		case <-time.After(time.Minute):
+			return nil
+		}
+	})
+	start := time.Now()
+	err := w.RunHooks()
+	if !errors.Is(err, ErrHooksTimeout) || !strings.Contains(err.Error(), "unfinished: flush") {
+		t.Errorf("TestHooksTimeoutCancelsContext: expected a timeout naming the hook, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("TestHooksTimeoutCancelsContext: RunHooks should return promptly, took %v", elapsed)
+	}
+	select {
+	case ctxErr := <-aborted:
+		if ctxErr == nil {
+			t.Errorf("TestHooksTimeoutCancelsContext: context should report why it is done")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("TestHooksTimeoutCancelsContext: the running hook should be cancelled")
+	}
+}
+
+func TestSetHooks(t *testing.T) {
+	set := func(mu *sync.Mutex, ran *[]string, label string) []ShutdownHook {
+		hooks := make([]ShutdownHook, 3)
+		for i := range hooks {
+			hooks[i] = func() error {
+				mu.Lock()
+				*ran = append(*ran, label)
+				mu.Unlock()
+				return nil
+			}
+		}
+		return hooks
+	}
+	for i := 0; i < 50; i++ {
+		var mu sync.Mutex
+		var ran []string
+		w, _ := NewWatcher(100, set(&mu, &ran, "old")...)
+		swapped := make(chan error, 1)
+		go func() { swapped <- w.SetHooks(set(&mu, &ran, "new")...) }()
+		if err := w.OnStop(); err != nil {
+			t.Fatal(err)
+		}
+		swapErr := <-swapped
+		mu.Lock()
+		if len(ran) != 3 || ran[0] != ran[1] || ran[1] != ran[2] {
+			t.Fatalf("TestSetHooks: OnStop ran a mix of hook sets: %v", ran)
+		}
+		if swapErr == nil && ran[0] == "old" {
+			// The swap landed after the shutdown completed.
+			if names := w.HookNames(); len(names) != 3 {
+				t.Errorf("TestSetHooks: expected 3 hooks after the swap, got %v", names)
+			}
+		}
+		mu.Unlock()
+	}
+
+	w, _ := NewWatcher(100)
+	if err := w.SetHooks(nil); err == nil {
+		t.Errorf("TestSetHooks: a nil hook should be rejected")
+	}
+	release := make(chan struct{})
+	_ = w.RegisterHook(func() error {
+		<-release
+		return nil
+	})
+	done := make(chan error, 1)
+	go func() { done <- w.OnStop() }()
+	for w.Phase() != PhaseHooks {
+		time.Sleep(time.Millisecond)
+	}
+	if err := w.SetHooks(); err == nil || !strings.Contains(err.Error(), "shutdown in progress") {
+		t.Errorf("TestSetHooks: SetHooks should be rejected during a shutdown, got %v", err)
+	}
+	close(release)
+	<-done
+	var nw *Watcher
+	if err := nw.SetHooks(); !errors.Is(err, ErrNilWatcher) {
+		t.Errorf("TestSetHooks: nil watcher should return ErrNilWatcher, got %v", err)
+	}
+}
+
+func TestRegisterFinalizer(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) ShutdownHook {
+		return func() error {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return nil
+		}
+	}
+	check := func(scenario string, want ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.Join(order, ",") != strings.Join(want, ",") {
+			t.Errorf("TestRegisterFinalizer: %s: expected %v, got %v", scenario, want, order)
+		}
+		order = nil
+	}
+
+	// Clean shutdown.
+	w, _ := NewWatcher(50)
+	_ = w.RegisterFinalizer(record("audit"))
+	_ = w.RegisterHook(record("hook"))
+	_ = w.RegisterTimeoutHook(record("timeout"))
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestRegisterFinalizer: clean shutdown failed: %v", err)
+	}
+	check("clean", "hook", "audit")
+	if r := w.LastReport(); r == nil || r.Hooks[len(r.Hooks)-1].Name != "finalizer[0]" {
+		t.Errorf("TestRegisterFinalizer: finalizer should be reported last, got %+v", r)
+	}
+
+	// Timed out shutdown.
+	w.Reset()
+	w.RecordConnState(http.StateNew)
+	if err := w.OnStop(); !errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("TestRegisterFinalizer: expected a timeout, got %v", err)
+	}
+	check("timeout", "timeout", "hook", "audit")
+
+	// A panicking hook is recovered and the finalizer still runs.
+	w, _ = NewWatcher(50)
+	_ = w.RegisterFinalizer(record("audit"))
+	_ = w.RegisterHook(func() error { panic("boom") })
+	_ = w.RegisterHook(record("after"))
+	err := w.OnStop()
+	if !errors.Is(err, ErrHookPanic) || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("TestRegisterFinalizer: expected the panic as an error, got %v", err)
+	}
+	check("panic", "after", "audit")
+	if r := w.LastReport(); r == nil || r.Hooks[0].Panic != "boom" ||
+		!strings.Contains(r.Hooks[0].Stack, "panic(") || r.Hooks[1].Panic != nil || r.Hooks[1].Stack != "" {
+		t.Errorf("TestRegisterFinalizer: expected the panic value and stack in the report, got %+v", r)
+	}
+
+	// A failing finalizer fails the shutdown.
+	w, _ = NewWatcher(50)
+	_ = w.RegisterFinalizer(func() error { return errors.New("flush failed") })
+	if err := w.GracefulStop(context.Background()); err == nil || !strings.Contains(err.Error(), "flush failed") {
+		t.Errorf("TestRegisterFinalizer: expected the finalizer error, got %v", err)
+	}
+
+	if err := w.RegisterFinalizer(nil); err == nil {
+		t.Errorf("TestRegisterFinalizer: nil hook should be rejected")
+	}
+	var nw *Watcher
+	if err := nw.RegisterFinalizer(record("x")); !errors.Is(err, ErrNilWatcher) {
+		t.Errorf("TestRegisterFinalizer: nil watcher should return ErrNilWatcher, got %v", err)
+	}
+}
+
+func TestRetryableHook(t *testing.T) {
+	calls := 0
+	flaky := func(failures int) ShutdownHook {
+		calls = 0
+		return func() error {
+			calls++
+			if calls <= failures {
+				return fmt.Errorf("%w: connection refused", ErrRetryable)
+			}
+			return nil
+		}
+	}
+
+	// Fails twice, then succeeds.
+	w, _ := NewWatcher(1000, flaky(2))
+	if err := w.OnStop(); err != nil || calls != 3 {
+		t.Errorf("TestRetryableHook: expected success on the third call, got %v after %d calls", err, calls)
+	}
+
+	// Attempts are limited.
+	w, _ = NewWatcher(1000, flaky(100))
+	if err := w.RunHooks(); !errors.Is(err, ErrRetryable) || calls != maxHookAttempts {
+		t.Errorf("TestRetryableHook: expected %d attempts, got %v after %d calls", maxHookAttempts, err, calls)
+	}
+
+	// Other errors are not retried.
+	w, _ = NewWatcher(1000)
+	_ = w.RegisterHook(func() error {
+		calls++
+		return errors.New("permanent")
+	})
+	calls = 0
+	if err := w.RunHooks(); err == nil || calls != 1 {
+		t.Errorf("TestRetryableHook: a permanent error should not be retried, got %v after %d calls", err, calls)
+	}
+
+	// Retries stop once the grace period would be exceeded.
+	w, _ = NewWatcher(25, flaky(100))
+	start := time.Now()
+	if err := w.OnStop(); !errors.Is(err, ErrRetryable) || calls >= maxHookAttempts {
+		t.Errorf("TestRetryableHook: retries should stop at the deadline, got %v after %d calls", err, calls)
+	}
+	if elapsed := time.Since(start); elapsed > 25*time.Millisecond+50*time.Millisecond {
+		t.Errorf("TestRetryableHook: retries should fit the grace period, took %v", elapsed)
+	}
+}
+
+func TestRegisterHookWithRollback(t *testing.T) {
+	var order []string
+	step := func(name string, err error) ShutdownHook {
+		return func() error {
+			order = append(order, name)
+			return err
+		}
+	}
+	setup := func(opts ...Option) *Watcher {
+		order = nil
+		w, _ := NewWatcher(1000)
+		_ = w.Configure(opts...)
+		_ = w.RegisterHookWithRollback("deregister", step("deregister", nil), step("register", nil))
+		_ = w.RegisterHook(step("flush", nil))
+		_ = w.RegisterHookWithRollback("close", step("close", nil), step("reopen", nil))
+		return w
+	}
+
+	// All hooks succeed: nothing is rolled back.
+	w := setup(WithStrictHooks())
+	if err := w.RunHooks(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(order, ","); got != "deregister,flush,close" {
+		t.Errorf("TestRegisterHookWithRollback: expected no rollback, got %s", got)
+	}
+
+	// A failure rolls back the hooks that succeeded, in reverse order.
+	w = setup(WithStrictHooks())
+	_ = w.RegisterHookWithRollback("drain", step("drain", errors.New("broker down")), step("undrain", nil))
+	err := w.OnStop()
+	if err == nil || !strings.Contains(err.Error(), "broker down") {
+		t.Errorf("TestRegisterHookWithRollback: expected the hook error, got %v", err)
+	}
+	if got := strings.Join(order, ","); got != "deregister,flush,close,drain,reopen,register" {
+		t.Errorf("TestRegisterHookWithRollback: expected a reverse rollback, got %s", got)
+	}
+	r := w.LastReport()
+	if r == nil || len(r.Hooks) != 6 || r.Hooks[4].Name != "close rollback" || r.Hooks[5].Name != "deregister rollback" {
+		t.Errorf("TestRegisterHookWithRollback: rollbacks should be reported, got %+v", r)
+	}
+
+	// Without strict mode a failure is not rolled back.
+	w = setup()
+	_ = w.RegisterHook(step("drain", errors.New("broker down")))
+	if err := w.RunHooks(); err == nil {
+		t.Errorf("TestRegisterHookWithRollback: expected the hook error")
+	}
+	if got := strings.Join(order, ","); got != "deregister,flush,close,drain" {
+		t.Errorf("TestRegisterHookWithRollback: expected no rollback outside strict mode, got %s", got)
+	}
+
+	if err := w.RegisterHookWithRollback("x", step("x", nil), nil); err == nil {
+		t.Errorf("TestRegisterHookWithRollback: nil rollback should be rejected")
+	}
+	if err := w.RegisterHookWithRollback("close", step("x", nil), step("y", nil)); err == nil {
+		t.Errorf("TestRegisterHookWithRollback: duplicate name should be rejected")
+	}
+	var nw *Watcher
+	if err := nw.RegisterHookWithRollback("x", step("x", nil), step("y", nil)); !errors.Is(err, ErrNilWatcher) {
+		t.Errorf("TestRegisterHookWithRollback: nil watcher should return ErrNilWatcher, got %v", err)
+	}
+}
+
+func TestRunHooksConcurrentRegister(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	running, registered := make(chan struct{}), make(chan struct{})
+	var ran atomic.Int32
+	_ = w.RegisterHook(func() error {
+		close(running)
+		<-registered
+		ran.Add(1)
+		return nil
+	})
+	go func() {
+		<-running
+		for i := 0; i < 100; i++ {
+			_ = w.RegisterHook(func() error {
+				ran.Add(1)
+				return nil
+			})
+		}
+		close(registered)
+	}()
+	if err := w.RunHooks(); err != nil {
+		t.Fatal(err)
+	}
+	if n := ran.Load(); n != 1 {
+		t.Errorf("TestRunHooksConcurrentRegister: hooks registered during the run should not run, %d ran", n)
+	}
+
+	// Registering while runs are in progress is race free.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			_ = w.RegisterNamedHook(fmt.Sprintf("hook-%d", i), func() error { return nil })
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			_ = w.RunHooks()
+		}
+	}()
+	wg.Wait()
+	if n := len(w.HookNames()); n != 151 {
+		t.Errorf("TestRunHooksConcurrentRegister: expected 151 hooks, got %d", n)
+	}
+}
+
+func TestRegisterHooks(t *testing.T) {
+	ok := func() error { return nil }
+	w, _ := NewWatcher(100)
+	_ = w.RegisterNamedHook("db", ok)
+	for _, batch := range [][]NamedHook{
+		{{"cache", ok}, {"queue", nil}},
+		{{"cache", ok}, {"", ok}},
+		{{"cache", ok}, {"db", ok}},
+		{{"cache", ok}, {"cache", ok}},
+	} {
+		if err := w.RegisterHooks(batch); err == nil {
+			t.Errorf("TestRegisterHooks: %v should be rejected", batch)
+		}
+		if names := w.HookNames(); len(names) != 1 {
+			t.Errorf("TestRegisterHooks: a rejected batch should add no hooks, got %v", names)
+		}
+	}
+	if err := w.RegisterHooks([]NamedHook{{"cache", ok}, {"queue", ok}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(w.HookNames(), ","); got != "db,cache,queue" {
+		t.Errorf("TestRegisterHooks: expected the batch in order, got %s", got)
+	}
+	var nw *Watcher
+	if err := nw.RegisterHooks(nil); !errors.Is(err, ErrNilWatcher) {
+		t.Errorf("TestRegisterHooks: nil watcher should return ErrNilWatcher, got %v", err)
+	}
+}
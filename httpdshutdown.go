@@ -7,23 +7,185 @@
 package httpdshutdown
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	// ErrShutdownTimeout is returned, wrapped with the number of connections still
+	// open, when a shutdown exceeds its grace period. Test for it with `errors.Is`.
+	ErrShutdownTimeout = errors.New("shutdown timed out")
+
+	// ErrShutdownCancelled is returned by an `OnStop` that was aborted with
+	// `CancelShutdown`.
+	ErrShutdownCancelled = errors.New("shutdown cancelled")
+
+	// ErrShutdownEscalated is returned by an `OnStop` whose drain was cut short by a
+	// second terminating signal; see `SigHandle`.
+	ErrShutdownEscalated = errors.New("shutdown escalated")
+
+	// ErrShutdownInterrupted is returned by an `OnStopInterruptible` whose drain was
+	// cut short by its force channel.
+	ErrShutdownInterrupted = errors.New("shutdown interrupted")
+
+	// ErrNilWatcher is returned, wrapped with the method name, when a method is
+	// called on a nil *Watcher. It marks a programming error rather than a failure at
+	// run time; every method that returns an error reports a nil receiver this way.
+	ErrNilWatcher = errors.New("httpdshutdown: nil Watcher")
+
+	// ErrHooksTimeout is returned, wrapped with the names of the unfinished hooks,
+	// when shutdown hooks exceed the budget set with `WithHooksTimeout`.
+	ErrHooksTimeout = errors.New("shutdown hooks timed out")
+
+	// ErrHookPanic is reported, wrapped with the recovered value, for a shutdown hook
+	// that panicked.
+	ErrHookPanic = errors.New("shutdown hook panicked")
+
+	// ErrRetryable is wrapped by a hook's error to ask for the hook to be retried, for
+	// a failure the hook knows to be transient, such as a network error. A retryable
+	// hook is called up to 5 times in total, with a delay that starts at 10ms and
+	// doubles between attempts, for as long as the deadline or budget of its context
+	// leaves room; its last error is reported.
+	//
+	// Example use:
+	//
+	//     watcher.RegisterNamedHook("deregister", func() error {
+	//             if err := registry.Deregister(); isTransient(err) {
+	//                     return fmt.Errorf("%w: %v", httpdshutdown.ErrRetryable, err)
+	//             }
+	//             return err
+	//     })
+	//
+	ErrRetryable = errors.New("retryable")
+
+	// ErrDraining is returned by a round tripper from `DrainRoundTripper` for
+	// requests issued after a shutdown has begun, and by the `Accept` method of a
+	// listener from `WrapListener` once a shutdown has begun.
+	ErrDraining = errors.New("watcher is draining")
+)
+
+// defaultPollInterval is how often drain conditions that cannot be waited on
+// directly are checked, unless set with `WithDrainPollInterval`.
+const defaultPollInterval = 50 * time.Millisecond
+
 // ShutdownHook is the type callers will implement in their own daemon shutdown handlers.
 type ShutdownHook func() error
 
+// ContextShutdownHook is a shutdown hook that receives a context whose deadline
+// bounds the time it may take. See `RegisterContextHook`.
+type ContextShutdownHook func(ctx context.Context) error
+
 // Watcher manages the execution of shutdownHooks.
 type Watcher struct {
-	connsWG       *sync.WaitGroup // Allows us to wait for conns to complete.
-	shutdownHooks []ShutdownHook  // Run these when daemon is done or timed out.
-	timeoutMS     int             // Grace period for daemon shutdown.
+	timeout  time.Duration // Grace period for daemon shutdown.
+	stall    time.Duration // Adaptive mode: give up once the drain stalls this long.
+	soft     time.Duration // Escalating mode: warn once the drain takes this long.
+	draining atomic.Bool   // Set once a shutdown has started; read without the lock.
+	children []*Watcher    // Stopped alongside this watcher; see NewCompositeWatcher.
+	clock    clock         // Times the drain; replaced by a fake in tests.
+
+	mu            sync.Mutex                 // Guards the fields below.
+	openConns     int                        // Number of connections currently open.
+	longLived     int                        // Number of open connections tagged LongLived.
+	closers       []func()                   // Asked to close long-lived conns at shutdown.
+	hijacked      map[net.Conn]ConnClass     // Hijacked conns kept open until released.
+	drained       chan struct{}              // Closed whenever openConns is zero.
+	conns         map[net.Conn]*connInfo     // Conns whose identity was reported.
+	connsByAddr   map[string]int             // Open conns per attached server address.
+	rejectedConns int                        // Conns closed on arrival by the WithMaxConns limit.
+	totalConns    int                        // Conns opened since creation or Reset.
+	closedConns   int                        // Conns ended by StateClosed since creation or Reset.
+	hijackedConns int                        // Conns ended by StateHijacked since creation or Reset.
+	countPaused   bool                       // State transitions are ignored while set.
+	serving       bool                       // MarkServing was called since creation or Reset.
+	timeouts      int                        // Shutdowns that timed out since creation or Reset.
+	warnedNoConns bool                       // The untracked connections warning was logged.
+	warnedH2      atomic.Bool                // The manually counted HTTP/2 warning was logged.
+	activeConns   int                        // Identified conns with a request in flight.
+	idle          chan struct{}              // Closed whenever activeConns is zero.
+	cancel        chan struct{}              // Closed by CancelShutdown; nil once hooks start.
+	escalation    chan struct{}              // Closed by a second terminating signal during the drain.
+	stopWaiting   chan struct{}              // Closed by a cancel or an escalation to end the drain's waits.
+	run           *shutdownRun               // The shutdown started by BeginShutdown, if any.
+	inflight      *shutdownRun               // The OnStop in progress, if any.
+	stopping      int                        // Number of shutdowns in progress.
+	completed     chan struct{}              // Closed once a shutdown completes; created lazily.
+	completedErr  error                      // Result of the completed shutdown.
+	hooksDone     chan struct{}              // Closed once the shutdown hooks finish; created lazily.
+	phase         Phase                      // Current lifecycle phase.
+	phaseChanges  chan Phase                 // Returned by PhaseChanges; created lazily.
+	shutdownHooks []namedHook                // Run these when daemon is done or timed out.
+	timeoutHooks  []namedHook                // Also run, first, when a shutdown times out.
+	finalizers    []namedHook                // Run last on every shutdown outcome.
+	workerGroups  []WorkerGroup              // Quiesced alongside the connection drain.
+	report        *ShutdownReport            // Describes the most recently completed shutdown.
+	sigActions    map[os.Signal]func() error // Custom actions registered with OnSignal.
+	unhandledSig  func(os.Signal)            // Called for signals with no other behavior.
+	panicHandler  func(interface{})          // Called with panics in SigHandle and Signals.
+	hookEvents    chan HookEvent             // Returned by HookEvents; created lazily.
+	servers       []attachedServer           // Shut down when a shutdown begins.
+	grpcServers   []GRPCServer               // Stopped when a shutdown begins.
+	ctx           context.Context            // Returned by Context; created lazily.
+	ctxCancel     context.CancelFunc         // Cancels ctx when a shutdown begins.
+	drainGates    []DrainGate                // Polled after the drain until satisfied.
+	signalAt      time.Time                  // When the first terminating signal arrived.
+	transfers     map[*Transfer]struct{}     // Streaming responses in progress.
+	streams       map[*Stream]struct{}       // Long-lived responses to notify at shutdown.
+	progressArmed bool                       // firstProgressFn awaits the drain's first close.
+	drainRate     drainRate                  // Closure rate of the drain in progress.
+	stopDeadline  time.Time                  // End of the grace period of the shutdown in progress.
+	exitSubs      []chan int                 // Subscribers awaiting the exit code.
+	exitCode      *int                       // Exit code published for the last terminating signal.
+
+	// Optional behavior, set with Configure.
+	progressInterval time.Duration                       // How often progressFn is called while draining.
+	progressFn       func(int)                           // Reports open connections while draining.
+	trackHijacked    bool                                // Keep hijacked conns counted until ReleaseHijacked.
+	softFn           func(int)                           // Called when the soft deadline passes.
+	logger           Logger                              // Receives lifecycle warnings; nil disables logging.
+	slogger          *slog.Logger                        // Receives structured lifecycle records, if set.
+	drainMode        DrainMode                           // What a shutdown waits for.
+	minDrain         time.Duration                       // Least time a shutdown waits before running hooks.
+	preStopDelay     time.Duration                       // Wait between stopping intake and draining.
+	skipDrain        bool                                // Run hooks without waiting on a drain.
+	hookTracer       HookTracer                          // Traces the shutdown hooks, if set.
+	handoff          func() error                        // Called between intake stopping and the drain.
+	forceClose       bool                                // Close identified conns still open at the timeout.
+	beforeForceClose func(net.Conn)                      // Called with each conn before it is force-closed.
+	forceCloseFns    []func(net.Conn)                    // Called with each conn once it is force-closed.
+	maxRequestAge    time.Duration                       // Requests in flight longer than this are closed while draining.
+	criticalGrace    time.Duration                       // Extra time critical connections get past the deadline.
+	drainPredicate   func() bool                         // Defines drained in place of the connection count, if set.
+	pollInterval     time.Duration                       // How often drain conditions are polled; zero is the default.
+	faults           *FaultConfig                        // Faults injected into every shutdown, if set.
+	interruptExit    bool                                // Exit cleanly with interruptCode on SIGINT rather than panic.
+	interruptCode    int                                 // Exit code sent for SIGINT when interruptExit is set.
+	hooksTimeout     time.Duration                       // Budget for running all hooks; zero means unbounded.
+	maxConns         int                                 // Identified conns allowed at once; zero means unlimited.
+	firstProgressFn  func(int)                           // Called when a draining shutdown first closes a conn.
+	exitCodeMapper   func(os.Signal, ShutdownResult) int // Exit code for a graceful signal.
+	transferPolicy   TransferPolicy                      // Decides which transfers may finish.
+	stallWarn        time.Duration                       // First stall warning; zero disables them.
+	strictHooks      bool                                // Roll back succeeded hooks if any fails.
+	hookTiming       HookTiming                          // When hooks run relative to closing attached servers.
+	autoCommit       bool                                // An abandoned PrepareStop commits rather than rolls back.
+	preTimeoutLead   time.Duration                       // How long before the timeout preTimeoutFn is called.
+	preTimeoutFn     func(int)                           // Last-chance warning before the timeout.
+}
+
+// shutdownRun records a single shutdown started by BeginShutdown or OnStop.
+type shutdownRun struct {
+	done    chan struct{} // Closed when the shutdown has completed.
+	elapsed time.Duration // Duration of the shutdown, valid once done is closed.
+	err     error         // Result of the shutdown, valid once done is closed.
 }
 
 // NewWatcher construct a Watcher with a timeout and an optional set of shutdown hooks
@@ -42,10 +204,66 @@ func NewWatcher(timeoutMS int, hooks ...ShutdownHook) (*Watcher, error) {
 		return nil, errors.New("timeout must be a positive number")
 	}
 	w := new(Watcher)
-	w.timeoutMS = timeoutMS
-	w.connsWG = new(sync.WaitGroup)
-	w.shutdownHooks = make([]ShutdownHook, len(hooks))
-	copy(w.shutdownHooks, hooks)
+	w.timeout = time.Duration(timeoutMS) * time.Millisecond
+	w.clock = realClock{}
+	w.drained = make(chan struct{})
+	close(w.drained)
+	w.idle = make(chan struct{})
+	close(w.idle)
+	w.shutdownHooks = make([]namedHook, len(hooks))
+	for i, hook := range hooks {
+		w.shutdownHooks[i] = namedHook{name: anonymousHookName(i), fn: hook}
+	}
+	return w, nil
+}
+
+// NewWatcherEscalating constructs a Watcher with a two-stage grace period. Once the
+// soft deadline passes with connections still open, a warning is logged and the
+// function set with `WithSoftDeadlineFunc` is called, giving operators visibility
+// before the hard deadline, which behaves like the timeout of `NewWatcher`.
+//
+// Example instantiation:
+//
+//     watcher, err := httpdshutdown.NewWatcherEscalating(10*time.Second, 30*time.Second, closeDB)
+//
+func NewWatcherEscalating(soft, hard time.Duration, hooks ...ShutdownHook) (*Watcher, error) {
+	if soft <= 0 {
+		return nil, errors.New("soft deadline must be a positive duration")
+	}
+	if hard < soft {
+		return nil, errors.New("hard deadline must not be before the soft deadline")
+	}
+	w, err := NewWatcher(0, hooks...)
+	if err != nil {
+		return nil, err
+	}
+	w.timeout, w.soft = hard, soft
+	return w, nil
+}
+
+// NewWatcherAdaptive constructs a Watcher whose grace period adapts to the drain.
+// Rather than giving up after a fixed timeout, the watcher keeps waiting for as long
+// as the number of open connections is decreasing, and only times out once the
+// count has not dropped for the stall duration. The max duration caps the total
+// wait, so a busy but draining daemon is not cut off prematurely while a truly stuck
+// one is still stopped.
+//
+// Example instantiation:
+//
+//     watcher, err := httpdshutdown.NewWatcherAdaptive(5*time.Second, time.Minute, closeDB)
+//
+func NewWatcherAdaptive(stall, max time.Duration, hooks ...ShutdownHook) (*Watcher, error) {
+	if stall <= 0 {
+		return nil, errors.New("stall must be a positive duration")
+	}
+	if max < 0 {
+		return nil, errors.New("max must not be negative")
+	}
+	w, err := NewWatcher(0, hooks...)
+	if err != nil {
+		return nil, err
+	}
+	w.timeout, w.stall = max, stall
 	return w, nil
 }
 
@@ -70,92 +288,1105 @@ func (w *Watcher) RecordConnState(newState http.ConnState) {
 		// do any error checking
 		panic("RecordConnState: receiver is nil")
 	}
-	switch newState {
-	case http.StateNew:
-		w.connsWG.Add(1)
-	case http.StateClosed, http.StateHijacked:
-		w.connsWG.Done()
+	w.RecordConnStateTagged(newState, ShortLived)
+}
+
+// addConns adjusts the open connection count by delta, never letting it drop
+// below zero. The drained channel is closed when the count reaches zero and
+// replaced with a fresh one when it rises again.
+func (w *Watcher) addConns(delta int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.addConnsLocked(delta)
+}
+
+// addConnsLocked is addConns for callers already holding w.mu.
+func (w *Watcher) addConnsLocked(delta int) {
+	n := w.openConns + delta
+	if n < 0 {
+		n = 0
+	}
+	if w.openConns == 0 && n > 0 {
+		w.drained = make(chan struct{})
+	} else if w.openConns > 0 && n == 0 {
+		close(w.drained)
+	}
+	if n < w.openConns && w.stopping > 0 {
+		w.drainRate.observe(w.clock.Now(), w.openConns-n)
 	}
+	if n < w.openConns && w.progressArmed {
+		// Call fn outside the lock, since it may well ask for the open count.
+		w.progressArmed = false
+		go w.firstProgressFn(n)
+	}
+	w.openConns = n
 }
 
-// RunHooks executes registered hooks, each of which blocks. Typically this is called
-// automatically by `OnStop`.
-func (w *Watcher) RunHooks() error {
+// OpenConns returns the number of connections that are currently open.
+func (w *Watcher) OpenConns() int {
 	if w == nil {
-		return errors.New("RunHooks: receiver is nil")
+		return 0
 	}
-	errStrs := make([]string, 0)
-	for _, f := range w.shutdownHooks {
-		err := f()
-		if err != nil {
-			errStrs = append(errStrs, "shutdown hook err: "+err.Error())
-		}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.openConns
+}
+
+// ConnsDrained returns a channel that is closed once there are no open connections,
+// so the drain can be combined with other conditions in a `select`. Unlike a shutdown,
+// it only reflects the connection count and may be awaited at any time.
+//
+// The channel is edge-triggered: each call returns the channel for the current
+// period of activity. If connections are open it closes when the count next reaches
+// zero; if none are open it is already closed. A closed channel stays closed even if
+// new connections arrive afterwards, so call ConnsDrained again to wait for the next
+// drain. A nil Watcher returns a nil channel.
+//
+// Example use:
+//
+//     select {
+//     case <-watcher.ConnsDrained():
+//             log.Print("idle")
+//     case <-ctx.Done():
+//     }
+//
+func (w *Watcher) ConnsDrained() <-chan struct{} {
+	if w == nil {
+		return nil
 	}
-	if len(errStrs) != 0 {
-		return errors.New(strings.Join(errStrs, "\n"))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.drained
+}
+
+// Reset zeroes the connection count and forgets any previous shutdown so a Watcher
+// can be reused, for example across table-driven tests or serial restarts of a
+// daemon. Registered shutdown hooks are left intact.
+//
+// Reset must not be called while a shutdown is in progress.
+func (w *Watcher) Reset() {
+	if w == nil {
+		panic("Reset: receiver is nil")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.openConns > 0 {
+		close(w.drained)
+	}
+	w.openConns = 0
+	w.longLived = 0
+	w.hijacked = nil
+	w.conns = nil
+	w.rejectedConns = 0
+	w.totalConns, w.closedConns, w.hijackedConns = 0, 0, 0
+	w.timeouts = 0
+	w.warnedNoConns, w.serving = false, false
+	for addr := range w.connsByAddr {
+		w.connsByAddr[addr] = 0
+	}
+	if w.activeConns > 0 {
+		close(w.idle)
+	}
+	w.activeConns = 0
+	w.draining.Store(false)
+	w.run = nil
+	w.ctx, w.ctxCancel = nil, nil
+	w.completed, w.completedErr = nil, nil
+	w.hooksDone = nil
+	w.signalAt = time.Time{}
+	w.exitCode = nil
+	w.setPhaseLocked(PhaseRunning)
+}
+
+// ReArm prepares a watcher whose shutdown has completed for another round of serving,
+// for example to drain a "blue" server and then bring up a "green" one in the same
+// process. The watcher leaves the draining state, forgets the previous shutdown and
+// detaches the servers attached with `AttachServer` or `AttachGRPC`, which cannot
+// serve again after being shut down; attach the new servers afterwards. Hooks and
+// options are kept.
+//
+// Unlike `Reset`, ReArm keeps counting connections that are still open, such as
+// tracked hijacked connections, since they remain real. ReArm returns an error if a
+// shutdown is still in progress or none has completed.
+func (w *Watcher) ReArm() error {
+	if w == nil {
+		return fmt.Errorf("ReArm: %w", ErrNilWatcher)
 	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopping > 0 {
+		return errors.New("ReArm: shutdown in progress")
+	}
+	if !w.draining.Load() {
+		return errors.New("ReArm: no completed shutdown")
+	}
+	w.draining.Store(false)
+	w.run = nil
+	w.ctx, w.ctxCancel = nil, nil
+	w.completed, w.completedErr = nil, nil
+	w.hooksDone = nil
+	w.signalAt = time.Time{}
+	w.exitCode = nil
+	w.setPhaseLocked(PhaseRunning)
+	for _, s := range w.servers {
+		delete(w.connsByAddr, s.srv.Addr)
+	}
+	w.servers = nil
+	w.grpcServers = nil
 	return nil
 }
 
 // OnStop will be called by a daemon's signal handler when it is time to shutdown. If there
 // are any shutdown handlers, they will be called. The timeout set on the watcher will
 // be honored. Typically this is called via `SigHandle` as your signal handler.
+//
+// OnStop returns an error if the drain times out or a required hook fails; failures
+// of hooks registered with `RegisterBestEffortHook` are only logged.
+//
+// The drain uses one of two strategies. By default the watcher counts the connections
+// recorded with `RecordConnState` or `ConnStateHook` and waits for them to close. Once
+// servers are attached with `AttachServer` or `AttachGRPC`, the watcher instead relies
+// solely on `http.Server.Shutdown` or `GracefulStop` for each of them, and a server
+// that misses its deadline is reported as `ErrShutdownTimeout`.
+//
+// With attached servers OnStop guarantees the following order, which hooks may rely
+// on for correctness:
+//
+//     1. stop accepting: every server closes its listeners, so new connections are refused;
+//     2. drain: requests in flight are given the grace period to complete;
+//     3. close: every server is closed, dropping any connection that outlived the drain;
+//     4. run hooks: only now are the shutdown hooks called.
+//
+// A hook that releases a resource used by handlers, such as a database pool, therefore
+// cannot be raced by a late request.
+// `WithHookTiming` can move the hooks before the close.
+//
+// The grace period counts from the first terminating signal handled by `SigHandle` or
+// `Signals`, not from the call to OnStop, so that work done between the two, for
+// example by an `OnSignal` action, does not stretch the shutdown beyond the
+// platform's kill deadline, such as Kubernetes' terminationGracePeriodSeconds. An
+// OnStop called 2s after SIGTERM on a watcher with a 10s timeout waits at most 8s.
+//
+// A call made while a shutdown started by OnStop or one of its variants is in
+// progress, for example from a signal racing `BeginShutdown`, does not start a second
+// shutdown: it waits for the one in progress and returns its result. A call made once
+// a shutdown has completed runs a new one.
 func (w *Watcher) OnStop() error {
 	if w == nil {
-		return errors.New("OnStop: receiver is nil")
+		return fmt.Errorf("OnStop: %w", ErrNilWatcher)
 	}
-	waitChan := make(chan bool, 1)
-	go func() {
-		w.connsWG.Wait()
-		waitChan <- true
-	}()
-	select {
-	case <-waitChan:
-		_ = w.RunHooks()
-		return nil
-	case <-time.After(time.Duration(w.timeoutMS) * time.Millisecond):
-		_ = w.RunHooks()
-		return errors.New("OnStop: shutdown timed out")
+	_, err := w.OnStopTimed()
+	return err
+}
+
+// OnStopTimed behaves like `OnStop` but also returns how long the drain and the
+// execution of shutdown hooks took, which is convenient for logging.
+//
+// Example use:
+//
+//     elapsed, err := watcher.OnStopTimed()
+//     log.Printf("graceful shutdown completed in %v (err:%v)", elapsed, err)
+//
+func (w *Watcher) OnStopTimed() (time.Duration, error) {
+	if w == nil {
+		return 0, fmt.Errorf("OnStopTimed: %w", ErrNilWatcher)
+	}
+	timeout := w.graceTimeout()
+	return w.stopOnce(func(st *stopState) (time.Duration, error) {
+		return w.finishStop(*st, timeout)
+	})
+}
+
+// stopOnce begins a shutdown and completes it with finish, which adjusts its state and
+// calls finishStop, unless a shutdown started by stopOnce is already in progress, in
+// which case it waits for that one and returns its result instead.
+func (w *Watcher) stopOnce(finish func(st *stopState) (time.Duration, error)) (time.Duration, error) {
+	w.mu.Lock()
+	run := w.inflight
+	if run != nil {
+		w.mu.Unlock()
+		<-run.done
+		return run.elapsed, run.err
+	}
+	run = &shutdownRun{done: make(chan struct{})}
+	w.inflight = run
+	w.mu.Unlock()
+
+	st := w.beginStop()
+	st.run = run
+	run.elapsed, run.err = finish(&st)
+	// finishStop lets go of the run as the shutdown completes; a cancelled one
+	// returns before that.
+	w.mu.Lock()
+	if w.inflight == run {
+		w.inflight = nil
+	}
+	w.mu.Unlock()
+	close(run.done)
+	return run.elapsed, run.err
+}
+
+// Timeout returns the grace period the watcher was constructed with, for example to
+// log it or to align downstream deadlines with it. It does not account for the time
+// since a signal arrived, nor for a per-call timeout such as `OnStopTimeout`'s.
+func (w *Watcher) Timeout() time.Duration {
+	if w == nil {
+		return 0
 	}
+	return w.timeout
 }
 
-// SigHandle is an example of a typical signal handler that will attempt a graceful shutdown
-// for a set of known signals. The first argument is your signal channel, and the second
-// argument is the channel that can be polled for exit status codes.
+// TimeRemaining returns how much of the grace period is left, so that hooks and
+// handlers can trim their work to fit. During a shutdown it is the time until the
+// shutdown's deadline, clamped at zero, however the grace period was set, for example
+// with `OnStopTimeout` or the context passed to `GracefulStop`. When no shutdown is in
+// progress it is the grace period a shutdown starting now would get: the watcher's
+// timeout, less the time since a terminating signal arrived, if one has.
 //
-// This should be called prior to starting your http daemon. Place it in its own goroutine
-// so signals can be recorded after the daemon has taken over control of the main thread.
+// Example use:
+//
+//     watcher.RegisterNamedHook("flush", func() error {
+//             if watcher.TimeRemaining() < time.Second {
+//                     return queue.FlushCritical()
+//             }
+//             return queue.Flush()
+//     })
+//
+func (w *Watcher) TimeRemaining() time.Duration {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	stopping, deadline := w.stopping > 0, w.stopDeadline
+	w.mu.Unlock()
+	if !stopping || deadline.IsZero() {
+		return w.graceTimeout()
+	}
+	if remaining := deadline.Sub(w.clock.Now()); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// graceTimeout returns the watcher's timeout, less the time elapsed since the first
+// terminating signal arrived, if one has.
+func (w *Watcher) graceTimeout() time.Duration {
+	timeout := w.timeout
+	w.mu.Lock()
+	at := w.signalAt
+	w.mu.Unlock()
+	if at.IsZero() {
+		return timeout
+	}
+	if timeout -= w.clock.Now().Sub(at); timeout < 0 {
+		timeout = 0
+	}
+	return timeout
+}
+
+// OnStopTimeout behaves like `OnStop` but uses timeout as the grace period for this
+// invocation only, for example to allow a longer window for a planned maintenance
+// shutdown. The timeout the watcher was constructed with is left unchanged.
+func (w *Watcher) OnStopTimeout(timeout time.Duration) error {
+	if w == nil {
+		return fmt.Errorf("OnStopTimeout: %w", ErrNilWatcher)
+	}
+	if timeout < 0 {
+		return errors.New("timeout must be a positive number")
+	}
+	_, err := w.stopOnce(func(st *stopState) (time.Duration, error) {
+		return w.finishStop(*st, timeout)
+	})
+	return err
+}
+
+// OnStopDeadline behaves like `OnStopTimeout` with the time remaining until deadline,
+// for callers that already hold an absolute deadline, such as one an orchestrator
+// computed from its termination grace period or one taken from a context. A deadline
+// that has already passed leaves no grace period: connections still open time out at
+// once.
+func (w *Watcher) OnStopDeadline(deadline time.Time) error {
+	if w == nil {
+		return fmt.Errorf("OnStopDeadline: %w", ErrNilWatcher)
+	}
+	_, err := w.stopOnce(func(st *stopState) (time.Duration, error) {
+		timeout := deadline.Sub(st.start)
+		if timeout < 0 {
+			timeout = 0
+		}
+		return w.finishStop(*st, timeout)
+	})
+	return err
+}
+
+// OnStopInterruptible behaves like `OnStop`, but closing force while the shutdown is
+// draining interrupts it, like a second terminating signal does for `SigHandle`: the
+// drain stops waiting, attached servers and identified connections are closed, the
+// timeout hooks and finalizers run at once, the other hooks are skipped, and the
+// error wraps `ErrShutdownInterrupted`. Closing force once the hooks have started has
+// no effect, so whichever of completion, timeout or interruption comes first, each
+// hook runs at most once.
 //
 // Example use:
 //
-//         go func() {
-//                 sigs := make(chan os.Signal, 1)
-//                 exitcode := make(chan int, 1)
-//                 signal.Notify(sigs)
-//                 go watcher.SigHandle(sigs, exitcode)
-//                 code := <-exitcode
-//                 log.Printf("exit with code:%d", code)
-//                 os.Exit(code)
-// 	}()
-func (w *Watcher) SigHandle(sigs <-chan os.Signal, exitcode chan<- int) {
-	if w == nil {
-		// panic since this will typically be launched as a goroutine.
-		panic("SigHandler: Watcher is nil")
-	}
-	for sig := range sigs {
-		if sig == syscall.SIGTERM || sig == syscall.SIGQUIT || sig == syscall.SIGHUP {
-			// The signals that terminate the daemon.
-			stopErr := w.OnStop()
-			if stopErr != nil {
-				exitcode <- 1 // caller should os.Exit(1)
+//     force := make(chan struct{})
+//     go func() {
+//             <-operatorAbort
+//             close(force)
+//     }()
+//     err := watcher.OnStopInterruptible(force)
+//
+func (w *Watcher) OnStopInterruptible(force <-chan struct{}) error {
+	if w == nil {
+		return fmt.Errorf("OnStopInterruptible: %w", ErrNilWatcher)
+	}
+	timeout := w.graceTimeout()
+	_, err := w.stopOnce(func(st *stopState) (time.Duration, error) {
+		st.interrupt = true
+		finished := make(chan struct{})
+		go func() {
+			select {
+			case <-force:
+				w.escalateStop(st.escalate)
+			case <-finished:
+			}
+		}()
+		defer close(finished)
+		return w.finishStop(*st, timeout)
+	})
+	return err
+}
+
+// DrainOnly behaves like `OnStop` but runs none of the watcher's hooks, timeout hooks
+// and finalizers included: it stops intake and drains connections, or shuts down the
+// attached servers, within the grace period, and returns an error wrapping
+// `ErrShutdownTimeout` if the drain does not finish in time. It lets a coordinator
+// that drains several watchers decide itself when their hooks run, for example with
+// `RunHooks` once every child has drained.
+func (w *Watcher) DrainOnly() error {
+	if w == nil {
+		return fmt.Errorf("DrainOnly: %w", ErrNilWatcher)
+	}
+	timeout := w.graceTimeout()
+	_, err := w.stopOnce(func(st *stopState) (time.Duration, error) {
+		st.drainOnly = true
+		return w.finishStop(*st, timeout)
+	})
+	return err
+}
+
+// OnStopWith behaves like `OnStop` but also runs extra after the registered hooks, for
+// cleanup that is specific to the current run, such as a resource opened after the
+// hooks were registered. The extra hooks apply to this invocation only and are not
+// added to the watcher's hooks, so a later `OnStop` does not run them. They are
+// reported as `hook[N]` following the registered hooks. Like `OnStop`, OnStopWith
+// joins a shutdown already in progress, and then does not run extra.
+//
+// Example use:
+//
+//     err := watcher.OnStopWith(func() error { return tmpDir.RemoveAll() })
+//
+func (w *Watcher) OnStopWith(extra ...ShutdownHook) error {
+	if w == nil {
+		return fmt.Errorf("OnStopWith: %w", ErrNilWatcher)
+	}
+	for _, h := range extra {
+		if h == nil {
+			return errors.New("OnStopWith: hook is nil")
+		}
+	}
+	timeout := w.graceTimeout()
+	_, err := w.stopOnce(func(st *stopState) (time.Duration, error) {
+		st.extraHooks = extra
+		return w.finishStop(*st, timeout)
+	})
+	return err
+}
+
+// stopState is what a shutdown snapshots from the watcher as it starts.
+type stopState struct {
+	start       time.Time
+	cancel      chan struct{}
+	escalate    chan struct{}
+	stopWaiting chan struct{} // Closed once the shutdown is cancelled or escalated.
+	interrupt   bool          // The escalation comes from OnStopInterruptible's force channel.
+	closers     []func()
+	servers     []attachedServer
+	grpcServers []GRPCServer
+	requestMode bool
+	minDrain    time.Duration
+	preStopWait time.Duration
+	handoff     func() error
+	faults      *FaultConfig
+	forceClose  bool
+	beforeClose func(net.Conn)
+	extraHooks  []ShutdownHook
+	gates       []DrainGate
+	workers     []WorkerGroup
+	hookTiming  HookTiming
+	drainOnly   bool          // Skip every hook; see DrainOnly.
+	noConns     bool          // Servers are attached but no connection was ever tracked.
+	preServing  bool          // The watcher never started serving; see HasServed.
+	skipDrain   bool          // Close servers outright and wait on nothing; see WithSkipDrain.
+	prepared    *preparedStop // Hold the hooks until committed; see PrepareStop.
+	run         *shutdownRun  // Joined by concurrent callers; see stopOnce.
+}
+
+// beginStop marks the watcher as draining and makes the shutdown cancellable.
+func (w *Watcher) beginStop() stopState {
+	st := stopState{start: w.clock.Now(), cancel: make(chan struct{}), escalate: make(chan struct{}),
+		stopWaiting: make(chan struct{})}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.draining.Store(true)
+	w.stopping++
+	w.setPhaseLocked(PhaseDraining)
+	w.cancel, w.escalation, w.stopWaiting = st.cancel, st.escalate, st.stopWaiting
+	w.progressArmed = w.firstProgressFn != nil && w.openConns > 0
+	w.drainRate.reset(st.start)
+	w.stopDeadline = time.Time{}
+	if w.ctxCancel != nil {
+		w.ctxCancel()
+	}
+	st.closers = append([]func(){}, w.closers...)
+	st.servers = append([]attachedServer{}, w.servers...)
+	st.grpcServers = append([]GRPCServer{}, w.grpcServers...)
+	st.requestMode = w.drainMode == DrainRequests
+	st.minDrain = w.minDrain
+	st.preStopWait = w.preStopDelay
+	st.handoff = w.handoff
+	st.faults = w.faults
+	st.forceClose, st.beforeClose = w.forceClose, w.beforeForceClose
+	st.gates = append([]DrainGate{}, w.drainGates...)
+	st.workers = append([]WorkerGroup{}, w.workerGroups...)
+	st.hookTiming = w.hookTiming
+	if !w.warnedNoConns && w.totalConns == 0 && len(w.servers) > 0 {
+		st.noConns, w.warnedNoConns = true, true
+	}
+	st.preServing = !w.hasServedLocked()
+	if w.skipDrain {
+		st.skipDrain = true
+		st.preStopWait, st.minDrain, st.gates, st.workers = 0, 0, nil, nil
+	}
+	return st
+}
+
+// finishStop completes a shutdown started with beginStop.
+func (w *Watcher) finishStop(st stopState, timeout time.Duration) (time.Duration, error) {
+	start, cancel := st.start, st.cancel
+	closers, requestMode, minDrain := st.closers, st.requestMode, st.minDrain
+	w.mu.Lock()
+	w.stopDeadline = start.Add(timeout)
+	w.mu.Unlock()
+	if err := sdNotify("STOPPING=1"); err != nil {
+		w.logf("httpdshutdown: %v", err)
+	}
+	// Cancelling the shutdown and escalating it both end the waits of the drain, by
+	// closing stopWaiting along with their own channel.
+	stopWaiting := st.stopWaiting
+	if st.noConns {
+		w.logf("httpdshutdown: no connections were ever tracked; if the servers did serve " +
+			"requests, check that their ConnState was not replaced after AttachServer")
+	} else if st.preServing {
+		w.logf("httpdshutdown: shutting down before the daemon started serving")
+	}
+	if st.faults != nil {
+		w.logf("httpdshutdown: fault injection is enabled: %v", st.faults)
+	}
+	// The drain gets what remains of the grace period after the pre-stop delay.
+	budget := timeout
+	if st.preStopWait > 0 {
+		delay, stopDelay := w.clock.After(st.preStopWait)
+		select {
+		case <-delay:
+		case <-st.escalate:
+		case <-cancel:
+			stopDelay()
+			w.commitStop(cancel)
+			return w.clock.Now().Sub(start), fmt.Errorf("OnStop: %w", ErrShutdownCancelled)
+		}
+		stopDelay()
+		budget -= w.clock.Now().Sub(start)
+	}
+	var handoffErr error
+	if st.handoff != nil {
+		if err := st.handoff(); err != nil {
+			handoffErr = fmt.Errorf("OnStop: handoff: %w", err)
+		}
+	}
+	for _, c := range closers {
+		c()
+	}
+	w.notifyStreams()
+	w.cutTransfers(timeout - w.clock.Now().Sub(start))
+	if requestMode {
+		w.closeIdleConns()
+	}
+	waitChildren := w.stopChildren(budget, cancel)
+	waitWorkers := w.quiesceWorkers(st.workers, timeout-w.clock.Now().Sub(start), stopWaiting)
+	var stopErr error
+	var results []HookResult
+	var hooksExpired error
+	hooksRan := false
+	// Closed once the attached servers are closed, if the hooks run before then.
+	var serversClosed chan struct{}
+	runHooks := func() {
+		if st.drainOnly {
+			hooksRan = true
+			return
+		}
+		// Hooks get whatever remains of the grace period.
+		results, hooksExpired, _ = w.runHooks(start.Add(timeout), serversClosed, st.extraHooks...)
+		hooksRan = true
+	}
+	if st.skipDrain {
+		closeServers(st.servers, st.grpcServers)
+	} else if len(st.servers) > 0 || len(st.grpcServers) > 0 {
+		if st.hookTiming == BeforeServerClose {
+			if !w.commitStop(cancel) {
+				return w.clock.Now().Sub(start), fmt.Errorf("OnStop: %w", ErrShutdownCancelled)
 			}
-			exitcode <- 0 // caller should os.Exit(0)
-		} else if sig == syscall.SIGINT {
-			// Unclean shutdown with panic message.
-			panic("panic exit")
+		}
+		// The servers already enforce their own deadlines, so the watcher's own
+		// counting would be redundant.
+		waitGRPC := w.stopGRPCServers(st.grpcServers, budget)
+		waitServers := w.shutdownServers("OnStop", st.servers, budget)
+		if st.hookTiming == BeforeServerClose {
+			for _, s := range st.servers {
+				<-s.closing
+			}
+			serversClosed = make(chan struct{})
+			go func() {
+				stopErr = errors.Join(waitServers(), waitGRPC())
+				close(serversClosed)
+			}()
+			runHooks()
+			<-serversClosed
+		} else {
+			stopErr = errors.Join(waitServers(), waitGRPC())
+		}
+	} else {
+		stopErr = w.waitDrained(budget, stopWaiting)
+	}
+	if st.faults != nil && st.faults.ForceTimeout && !errors.Is(stopErr, ErrShutdownTimeout) {
+		stopErr = errors.Join(stopErr, fmt.Errorf("OnStop: %w: %w", ErrShutdownTimeout, ErrInjectedFault))
+	}
+	if st.forceClose && errors.Is(stopErr, ErrShutdownTimeout) {
+		w.forceCloseConns(st.beforeClose)
+	}
+	if requestMode {
+		w.closeIdleConns()
+	}
+	if !errors.Is(stopErr, ErrShutdownTimeout) {
+		stopErr = errors.Join(stopErr, w.waitGates(st.gates, timeout-w.clock.Now().Sub(start), stopWaiting))
+	}
+	stopErr = errors.Join(handoffErr, stopErr, waitChildren(), waitWorkers())
+	// Give load balancers time to converge even if the drain finished early.
+	if remaining := minDrain - w.clock.Now().Sub(start); remaining > 0 {
+		floor, stopFloor := w.clock.After(remaining)
+		select {
+		case <-floor:
+		case <-stopWaiting:
+		}
+		stopFloor()
+	}
+
+	if p := st.prepared; p != nil {
+		p.drained <- stopErr
+		select {
+		case <-p.commit:
+		case <-st.escalate:
+		case <-cancel:
+		}
+	}
+	// An escalated shutdown skips the hooks but still runs the finalizers, and an
+	// interrupted one the timeout hooks as well.
+	escalated := false
+	select {
+	case <-st.escalate:
+		escalated = true
+		if st.interrupt {
+			stopErr = errors.Join(stopErr, fmt.Errorf("OnStop: %w", ErrShutdownInterrupted))
 		} else {
-			// uncomment this if you want to see uncaught signals
-			// log.Printf("**** caught unchecked signal %v\n", sig)
+			stopErr = errors.Join(stopErr, fmt.Errorf("OnStop: %w", ErrShutdownEscalated))
+		}
+	default:
+	}
+	if !hooksRan && !w.commitStop(cancel) {
+		return w.clock.Now().Sub(start), fmt.Errorf("OnStop: %w", ErrShutdownCancelled)
+	}
+
+	var timeoutResults []HookResult
+	if (errors.Is(stopErr, ErrShutdownTimeout) && !escalated || escalated && st.interrupt) && !st.drainOnly {
+		timeoutResults = w.runTimeoutHooks()
+	}
+	if !hooksRan && !escalated {
+		runHooks()
+	}
+	if hooksExpired != nil {
+		stopErr = errors.Join(stopErr, fmt.Errorf("OnStop: %w", hooksExpired))
+	}
+	// Best-effort hooks have already been logged; only required hooks fail the
+	// shutdown.
+	if hookErr := requiredHookErr(results); hookErr != nil {
+		stopErr = errors.Join(stopErr, fmt.Errorf("OnStop: %w", hookErr))
+	}
+	var finalResults []HookResult
+	if !st.drainOnly {
+		var finalErr error
+		if finalResults, finalErr = w.runFinalizers(); finalErr != nil {
+			stopErr = errors.Join(stopErr, fmt.Errorf("OnStop: %w", finalErr))
+		}
+	}
+	elapsed := w.clock.Now().Sub(start)
+	w.mu.Lock()
+	w.report = &ShutdownReport{
+		Start:    start,
+		Duration: elapsed,
+		TimedOut: errors.Is(stopErr, ErrShutdownTimeout),
+		Hooks:    append(append(timeoutResults, results...), finalResults...),
+	}
+	w.progressArmed = false
+	w.stopping--
+	if w.report.TimedOut {
+		w.timeouts++
+		w.setPhaseLocked(PhaseTimedOut)
+	} else {
+		w.setPhaseLocked(PhaseDone)
+	}
+	// A call made from now on starts a new shutdown rather than joining this one.
+	if st.run != nil && w.inflight == st.run {
+		w.inflight = nil
+	}
+	w.completeLocked(stopErr)
+	w.mu.Unlock()
+	return elapsed, stopErr
+}
+
+// commitStop ends the part of a shutdown that `CancelShutdown` can abort, just before
+// the hooks begin, and enters PhaseHooks. It returns false if the shutdown was
+// cancelled first. Checking under the lock settles a race between CancelShutdown and
+// the drain completing.
+func (w *Watcher) commitStop(cancel chan struct{}) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-cancel:
+		w.stopping--
+		w.progressArmed = false
+		return false
+	default:
+	}
+	if w.cancel == cancel {
+		w.cancel = nil
+	}
+	w.setPhaseLocked(PhaseHooks)
+	return true
+}
+
+// Drain waits up to d for open connections to drain, without starting a shutdown or
+// running hooks, and returns how many connections are still open. If any remain
+// when d expires, the error wraps `ErrShutdownTimeout`. Drain is the primitive behind
+// `OnStop`, and lets callers decide for themselves, for example, whether to
+// force-close what remains.
+//
+// Example use:
+//
+//     if remaining, err := watcher.Drain(10 * time.Second); err != nil {
+//             log.Printf("%d connections did not drain", remaining)
+//     }
+//
+func (w *Watcher) Drain(d time.Duration) (remaining int, err error) {
+	if w == nil {
+		return 0, fmt.Errorf("Drain: %w", ErrNilWatcher)
+	}
+	if d < 0 {
+		return 0, errors.New("Drain: timeout must be a positive number")
+	}
+	err = w.waitDrained(d, nil)
+	return w.OpenConns(), err
+}
+
+// waitDrained blocks until there are no open connections, or in DrainRequests mode no
+// requests in flight, the timeout expires, or cancel is closed. Only the timeout
+// results in an error.
+func (w *Watcher) waitDrained(timeout time.Duration, cancel <-chan struct{}) error {
+	w.mu.Lock()
+	drained := w.drained
+	if w.drainMode == DrainRequests {
+		drained = w.idle
+	}
+	pred := w.drainPredicate
+	pollInterval := w.pollIntervalLocked()
+	if pred != nil {
+		// The predicate replaces the count as the definition of drained.
+		drained = nil
+	}
+	select {
+	case <-drained:
+		// Fast path: already drained, so skip setting up timers and tickers.
+		w.mu.Unlock()
+		return nil
+	default:
+	}
+	progressInterval, progressFn := w.progressInterval, w.progressFn
+	stall := w.stall
+	soft, softFn := w.soft, w.softFn
+	maxAge := w.maxRequestAge
+	stallWarn := w.stallWarn
+	preLead, preFn := w.preTimeoutLead, w.preTimeoutFn
+	w.mu.Unlock()
+	if pred != nil && pred() {
+		return nil
+	}
+
+	// Waiting on the drained channel rather than a goroutine blocked in a
+	// WaitGroup means repeated timeouts cannot accumulate leaked goroutines.
+	timer, stopTimer := w.clock.After(timeout)
+	defer stopTimer()
+	var tick <-chan time.Time
+	if progressFn != nil {
+		var stopTick func()
+		tick, stopTick = w.clock.Tick(progressInterval)
+		defer stopTick()
+	}
+	// In adaptive mode the drain is polled so that the deadline can be extended
+	// for as long as the open count keeps falling.
+	var poll <-chan time.Time
+	var lastOpen int
+	var lastProgress time.Time
+	if stall > 0 {
+		interval := pollInterval
+		if stall < interval {
+			interval = stall
+		}
+		var stopPoll func()
+		poll, stopPoll = w.clock.Tick(interval)
+		defer stopPoll()
+		lastOpen, lastProgress = w.OpenConns(), w.clock.Now()
+	}
+	// With escalation, the soft deadline only warns; the timeout remains the hard
+	// deadline after which the watcher gives up.
+	var softC <-chan time.Time
+	if soft > 0 && soft < timeout {
+		var stopSoft func()
+		softC, stopSoft = w.clock.After(soft)
+		defer stopSoft()
+	}
+	var preC <-chan time.Time
+	if preFn != nil && preLead < timeout {
+		var stopPre func()
+		preC, stopPre = w.clock.After(timeout - preLead)
+		defer stopPre()
+	}
+	// Requests older than the maximum age are reaped by a periodic sweep.
+	var reap <-chan time.Time
+	if maxAge > 0 {
+		interval := pollInterval
+		if maxAge < interval {
+			interval = maxAge
+		}
+		var stopReap func()
+		reap, stopReap = w.clock.Tick(interval)
+		defer stopReap()
+		w.closeStaleConns(maxAge, w.clock.Now())
+	}
+	var predPoll <-chan time.Time
+	if pred != nil {
+		var stopPredPoll func()
+		predPoll, stopPredPoll = w.clock.Tick(pollInterval)
+		defer stopPredPoll()
+	}
+	// Stall warnings double their interval for as long as no connection closes.
+	var stallPoll <-chan time.Time
+	var stallOpen int
+	var stallSince time.Time
+	nextWarn := stallWarn
+	if stallWarn > 0 {
+		interval := pollInterval
+		if stallWarn < interval {
+			interval = stallWarn
+		}
+		var stopStallPoll func()
+		stallPoll, stopStallPoll = w.clock.Tick(interval)
+		defer stopStallPoll()
+		stallOpen, stallSince = w.OpenConns(), w.clock.Now()
+	}
+	for {
+		select {
+		case <-drained:
+			return nil
+		case <-predPoll:
+			if pred() {
+				return nil
+			}
+		case <-timer:
+			// A server does not report a closed connection until its handler returns,
+			// so the extension waits on the critical connections rather than the count.
+			if closed, ok := w.awaitCritical(""); ok && closed == 0 {
+				return nil
+			} else if ok {
+				return fmt.Errorf("OnStop: %w: closed %d connections at the deadline", ErrShutdownTimeout, closed)
+			}
+			if pred != nil {
+				return fmt.Errorf("OnStop: %w with the drain predicate still false", ErrShutdownTimeout)
+			}
+			return fmt.Errorf("OnStop: %w with %d connections still open", ErrShutdownTimeout, w.OpenConns())
+		case <-cancel:
+			return nil
+		case <-softC:
+			open := w.OpenConns()
+			w.logf("httpdshutdown: soft deadline of %v passed with %d connections still open", soft, open)
+			if softFn != nil {
+				softFn(open)
+			}
+		case <-preC:
+			preFn(w.OpenConns())
+		case <-tick:
+			progressFn(w.OpenConns())
+		case now := <-reap:
+			w.closeStaleConns(maxAge, now)
+		case now := <-stallPoll:
+			open := w.OpenConns()
+			if open < stallOpen {
+				stallSince, nextWarn = now, stallWarn
+			}
+			stallOpen = open
+			if stalled := now.Sub(stallSince); stalled >= nextWarn {
+				w.logf("httpdshutdown: drain stalled: still %d connections open after %v without progress",
+					open, stalled.Round(time.Millisecond))
+				nextWarn *= 2
+			}
+		case now := <-poll:
+			open := w.OpenConns()
+			if open < lastOpen {
+				lastProgress = now
+			}
+			lastOpen = open
+			if now.Sub(lastProgress) >= stall {
+				return fmt.Errorf("OnStop: %w with %d connections still open after stalling for %v",
+					ErrShutdownTimeout, open, stall)
+			}
 		}
 	}
 }
+
+// MarkServing records that the daemon has started serving, for a daemon whose
+// connections the watcher does not track. A tracked connection marks the watcher as
+// serving by itself. See `HasServed`.
+func (w *Watcher) MarkServing() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.serving = true
+}
+
+// HasServed reports whether the daemon ever started serving, that is whether
+// `MarkServing` was called or a connection was tracked since the watcher was created or
+// `Reset`. A shutdown that begins before then, for instance because startup failed
+// part way, is logged as such, and hooks can call HasServed to skip cleanup of
+// resources that were never initialized.
+//
+// Example use:
+//
+//     watcher.RegisterNamedHook("deregister", func() error {
+//             if !watcher.HasServed() {
+//                     return nil
+//             }
+//             return registry.Deregister()
+//     })
+//
+func (w *Watcher) HasServed() bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.hasServedLocked()
+}
+
+// hasServedLocked implements HasServed; w.mu must be held.
+func (w *Watcher) hasServedLocked() bool {
+	return w.serving || w.totalConns > 0
+}
+
+// IsDraining reports whether a shutdown has started, so that middleware, background
+// workers and cron jobs can stop taking on new work. It is safe to call from any
+// goroutine. The watcher stays draining after the shutdown completes, until it is
+// `Reset` or the shutdown is cancelled with `CancelShutdown`.
+func (w *Watcher) IsDraining() bool {
+	if w == nil {
+		return false
+	}
+	return w.draining.Load()
+}
+
+// Context returns a context that is cancelled when a shutdown begins, through `OnStop`,
+// `BeginShutdown` or a signal, so background pollers and workers can derive their own
+// contexts from it rather than polling `IsDraining`. The context is created on first
+// use, and is already cancelled if a shutdown is in progress. It is cancelled exactly
+// once; after `CancelShutdown` or `Reset`, Context returns a fresh context for the
+// next shutdown.
+//
+// Example use:
+//
+//     go worker.Run(watcher.Context())
+//
+func (w *Watcher) Context() context.Context {
+	if w == nil {
+		panic("Context: receiver is nil")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ctx == nil {
+		w.ctx, w.ctxCancel = context.WithCancel(context.Background())
+		if w.draining.Load() {
+			w.ctxCancel()
+		}
+	}
+	return w.ctx
+}
+
+// CancelShutdown aborts a shutdown that is still waiting for connections to drain.
+// The watcher leaves the draining state, the interrupted `OnStop` returns an error
+// without running any hooks, and the daemon can keep serving. A later `OnStop` or
+// `BeginShutdown` starts a fresh shutdown. Listeners from `WrapListener` do not come
+// back: they were closed when the shutdown began, so keep serving on new ones.
+//
+// Cancellation is only possible before hooks begin executing; after that, or when no
+// shutdown is in progress, CancelShutdown returns an error.
+func (w *Watcher) CancelShutdown() error {
+	if w == nil {
+		return fmt.Errorf("CancelShutdown: %w", ErrNilWatcher)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cancel == nil {
+		return errors.New("CancelShutdown: no cancellable shutdown in progress")
+	}
+	close(w.cancel)
+	w.cancel = nil
+	w.endWaitsLocked()
+	w.draining.Store(false)
+	w.setPhaseLocked(PhaseRunning)
+	w.run = nil
+	w.ctx, w.ctxCancel = nil, nil
+	w.signalAt = time.Time{}
+	return nil
+}
+
+// BeginShutdown starts the same drain-and-hooks sequence as `OnStop`, but can be
+// triggered programmatically, for example from an admin endpoint or a leadership
+// change callback, independently of `SigHandle`.
+//
+// BeginShutdown is idempotent: only the first call performs the shutdown. Later or
+// concurrent calls wait for that shutdown to complete and return its result. Like
+// `OnStop`, it joins a shutdown already in progress, so a terminating signal handled
+// by `SigHandle`, the admin endpoint and direct calls arriving together start a
+// single shutdown.
+func (w *Watcher) BeginShutdown() error {
+	if w == nil {
+		return fmt.Errorf("BeginShutdown: %w", ErrNilWatcher)
+	}
+	w.mu.Lock()
+	run := w.run
+	if run != nil {
+		w.mu.Unlock()
+		<-run.done
+		return run.err
+	}
+	run = &shutdownRun{done: make(chan struct{})}
+	w.run = run
+	w.mu.Unlock()
+
+	run.err = w.OnStop()
+	close(run.done)
+	return run.err
+}
+
+// WatchStopChan blocks until stop is closed and then performs a shutdown with
+// `BeginShutdown`, returning its result. It lets a program that already closes a
+// stop channel to signal shutdown use the watcher without involving OS signals.
+// Run it in its own goroutine.
+//
+// Example use:
+//
+//     go watcher.WatchStopChan(stop)
+//
+func (w *Watcher) WatchStopChan(stop <-chan struct{}) error {
+	if w == nil {
+		return fmt.Errorf("WatchStopChan: %w", ErrNilWatcher)
+	}
+	<-stop
+	return w.BeginShutdown()
+}
+
+// endWaitsLocked ends the waits of the drain in progress, if any. w.mu must be held.
+func (w *Watcher) endWaitsLocked() {
+	if w.stopWaiting == nil {
+		return
+	}
+	select {
+	case <-w.stopWaiting:
+	default:
+		close(w.stopWaiting)
+	}
+}
+
+// completeLocked records err as the result of a completed shutdown and wakes up
+// Wait. w.mu must be held.
+func (w *Watcher) completeLocked(err error) {
+	w.completedErr = err
+	w.slogCompleteLocked(err)
+	if w.completed == nil {
+		w.completed = make(chan struct{})
+	}
+	select {
+	case <-w.completed:
+	default:
+		close(w.completed)
+	}
+}
+
+// Wait blocks until a shutdown, however it was started, has fully completed, both
+// draining and hooks, and returns its result. It returns at once if a shutdown has
+// already completed, so `main` can simply call Wait before exiting. A cancelled
+// shutdown does not count as completed.
+//
+// Example use:
+//
+//     go watcher.WatchStopChan(stop)
+//     ...
+//     if err := watcher.Wait(); err != nil {
+//             os.Exit(1)
+//     }
+//
+func (w *Watcher) Wait() error {
+	if w == nil {
+		return fmt.Errorf("Wait: %w", ErrNilWatcher)
+	}
+	return w.WaitContext(context.Background())
+}
+
+// WaitContext behaves like `Wait` but gives up once ctx is done, returning its error.
+func (w *Watcher) WaitContext(ctx context.Context) error {
+	if w == nil {
+		return fmt.Errorf("WaitContext: %w", ErrNilWatcher)
+	}
+	w.mu.Lock()
+	if w.completed == nil {
+		w.completed = make(chan struct{})
+	}
+	completed := w.completed
+	w.mu.Unlock()
+	select {
+	case <-completed:
+	case <-ctx.Done():
+		return fmt.Errorf("WaitContext: %w", ctx.Err())
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.completedErr
+}
@@ -0,0 +1,8 @@
+// Package httpdshutdownotel traces the shutdown hooks of an httpdshutdown.Watcher as
+// OpenTelemetry spans. It depends on go.opentelemetry.io/otel, so that the main
+// package does not; it is a module of its own, which pins that dependency, and is only
+// compiled with the `otel` build tag:
+//
+//     cd httpdshutdownotel && go build -tags otel ./...
+//
+package httpdshutdownotel
@@ -0,0 +1,61 @@
+//go:build otel
+
+package httpdshutdownotel
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName names the tracer the spans are created with.
+const instrumentationName = "github.com/bradclawsie/httpdshutdown"
+
+// Tracer is an `httpdshutdown.HookTracer` that creates a "graceful-shutdown" span
+// for the hooks of each shutdown, with a child span named after each hook. A failed
+// hook's span records the error and has an error status, and every hook span carries
+// its duration in milliseconds as the hook.duration_ms attribute.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer returns a tracer creating its spans with tp.
+//
+// Example use:
+//
+//     tracer := httpdshutdownotel.NewTracer(otel.GetTracerProvider())
+//     watcher.Configure(httpdshutdown.WithHookTracer(tracer))
+//
+func NewTracer(tp trace.TracerProvider) *Tracer {
+	return &Tracer{tracer: tp.Tracer(instrumentationName)}
+}
+
+// StartShutdown implements `httpdshutdown.HookTracer`.
+func (t *Tracer) StartShutdown(ctx context.Context) (context.Context, func(error)) {
+	ctx, span := t.tracer.Start(ctx, "graceful-shutdown")
+	return ctx, func(err error) {
+		endSpan(span, err)
+	}
+}
+
+// StartHook implements `httpdshutdown.HookTracer`.
+func (t *Tracer) StartHook(ctx context.Context, name string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := t.tracer.Start(ctx, name, trace.WithAttributes(attribute.String("hook.name", name)))
+	return ctx, func(err error) {
+		span.SetAttributes(attribute.Int64("hook.duration_ms", time.Since(start).Milliseconds()))
+		endSpan(span, err)
+	}
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
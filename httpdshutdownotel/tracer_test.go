@@ -0,0 +1,58 @@
+//go:build otel
+
+package httpdshutdownotel
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bradclawsie/httpdshutdown"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracer(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	w, _ := httpdshutdown.NewWatcher(1000)
+	if err := w.Configure(httpdshutdown.WithHookTracer(NewTracer(tp))); err != nil {
+		t.Fatal(err)
+	}
+	var hookSpan trace.SpanContext
+	_ = w.RegisterContextHook("flush", func(ctx context.Context) error {
+		hookSpan = trace.SpanContextFromContext(ctx)
+		return nil
+	})
+	_ = w.RegisterNamedHook("close-db", func() error { return errors.New("db gone") })
+	if err := w.OnStop(); err == nil {
+		t.Fatalf("TestTracer: expected the hook error")
+	}
+
+	spans := exp.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("TestTracer: expected 3 spans, got %d", len(spans))
+	}
+	byName := make(map[string]tracetest.SpanStub)
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+	root, ok := byName["graceful-shutdown"]
+	if !ok || root.Parent.IsValid() || root.Status.Code != codes.Error {
+		t.Errorf("TestTracer: expected a failed root span, got %+v", root)
+	}
+	for _, name := range []string{"flush", "close-db"} {
+		s, ok := byName[name]
+		if !ok || s.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("TestTracer: expected %s as a child of the root span, got %+v", name, s)
+		}
+	}
+	if byName["flush"].Status.Code == codes.Error || byName["flush"].SpanContext.SpanID() != hookSpan.SpanID() {
+		t.Errorf("TestTracer: flush should succeed and run under its span, got %+v", byName["flush"])
+	}
+	if s := byName["close-db"]; s.Status.Code != codes.Error || len(s.Events) == 0 {
+		t.Errorf("TestTracer: close-db should record its error, got %+v", s)
+	}
+}
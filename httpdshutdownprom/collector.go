@@ -0,0 +1,65 @@
+//go:build prometheus
+
+package httpdshutdownprom
+
+import (
+	"github.com/bradclawsie/httpdshutdown"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a `prometheus.Collector` that reads a watcher's counters on every
+// scrape. It exports:
+//
+//     httpdshutdown_open_connections          gauge
+//     httpdshutdown_connections_total         counter
+//     httpdshutdown_shutdown_timeouts_total   counter
+//     httpdshutdown_last_drain_seconds        gauge, absent until a shutdown completes
+//
+type Collector struct {
+	w *httpdshutdown.Watcher
+
+	open      *prometheus.Desc
+	total     *prometheus.Desc
+	timeouts  *prometheus.Desc
+	lastDrain *prometheus.Desc
+}
+
+// NewCollector returns a collector for w, with constLabels added to every metric so
+// several watchers can be told apart. Register it with a registry.
+//
+// Example use:
+//
+//     prometheus.MustRegister(httpdshutdownprom.NewCollector(watcher, prometheus.Labels{"server": "api"}))
+//
+func NewCollector(w *httpdshutdown.Watcher, constLabels prometheus.Labels) *Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc("httpdshutdown_"+name, help, nil, constLabels)
+	}
+	return &Collector{
+		w:         w,
+		open:      desc("open_connections", "Connections currently open."),
+		total:     desc("connections_total", "Connections opened."),
+		timeouts:  desc("shutdown_timeouts_total", "Shutdowns that exceeded the grace period."),
+		lastDrain: desc("last_drain_seconds", "Duration of the most recently completed shutdown."),
+	}
+}
+
+// Describe implements `prometheus.Collector`.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.open
+	ch <- c.total
+	ch <- c.timeouts
+	ch <- c.lastDrain
+}
+
+// Collect implements `prometheus.Collector`. The counters come from a single
+// `Watcher.Stats` snapshot.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.w.Stats()
+	ch <- prometheus.MustNewConstMetric(c.open, prometheus.GaugeValue, float64(stats.OpenConns))
+	ch <- prometheus.MustNewConstMetric(c.total, prometheus.CounterValue, float64(stats.TotalConns))
+	ch <- prometheus.MustNewConstMetric(c.timeouts, prometheus.CounterValue, float64(stats.Timeouts))
+	if report := c.w.LastReport(); report != nil {
+		ch <- prometheus.MustNewConstMetric(c.lastDrain, prometheus.GaugeValue, report.Duration.Seconds())
+	}
+}
@@ -0,0 +1,48 @@
+//go:build prometheus
+
+package httpdshutdownprom
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bradclawsie/httpdshutdown"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	w, _ := httpdshutdown.NewWatcher(10)
+	c := NewCollector(w, nil)
+	w.RecordConnState(http.StateNew)
+	w.RecordConnState(http.StateNew)
+	w.RecordConnState(http.StateClosed)
+	want := `
+# HELP httpdshutdown_connections_total Connections opened.
+# TYPE httpdshutdown_connections_total counter
+httpdshutdown_connections_total 2
+# HELP httpdshutdown_open_connections Connections currently open.
+# TYPE httpdshutdown_open_connections gauge
+httpdshutdown_open_connections 1
+# HELP httpdshutdown_shutdown_timeouts_total Shutdowns that exceeded the grace period.
+# TYPE httpdshutdown_shutdown_timeouts_total counter
+httpdshutdown_shutdown_timeouts_total 0
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want)); err != nil {
+		t.Errorf("TestCollector: %v", err)
+	}
+
+	// The stuck connection times out the shutdown, which then reports its duration.
+	_ = w.OnStop()
+	want = `
+# HELP httpdshutdown_shutdown_timeouts_total Shutdowns that exceeded the grace period.
+# TYPE httpdshutdown_shutdown_timeouts_total counter
+httpdshutdown_shutdown_timeouts_total 1
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want), "httpdshutdown_shutdown_timeouts_total"); err != nil {
+		t.Errorf("TestCollector: %v", err)
+	}
+	if n := testutil.CollectAndCount(c); n != 4 {
+		t.Errorf("TestCollector: expected 4 metrics after a shutdown, got %d", n)
+	}
+}
@@ -0,0 +1,8 @@
+// Package httpdshutdownprom exports the state of an httpdshutdown.Watcher as
+// Prometheus metrics. It depends on github.com/prometheus/client_golang, so that the
+// main package does not; it is a module of its own, which pins that dependency, and is
+// only compiled with the `prometheus` build tag:
+//
+//     cd httpdshutdownprom && go build -tags prometheus ./...
+//
+package httpdshutdownprom
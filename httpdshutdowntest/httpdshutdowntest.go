@@ -0,0 +1,76 @@
+// Package httpdshutdowntest provides helpers for testing shutdown wiring built on
+// httpdshutdown, such as hooks that record when they run and simulated connections.
+package httpdshutdowntest
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bradclawsie/httpdshutdown"
+)
+
+// RecordingHook is a shutdown hook that records each time it is run. The zero value
+// is ready to use and succeeds; set Err to make it fail.
+//
+// Example use:
+//
+//     rec := new(httpdshutdowntest.RecordingHook)
+//     watcher.RegisterHook(rec.Hook)
+//     watcher.OnStop()
+//     if rec.Calls() != 1 { ... }
+//
+type RecordingHook struct {
+	Err error // Returned by every run of the hook.
+
+	mu    sync.Mutex
+	times []time.Time
+}
+
+// Hook runs the hook; pass it where an `httpdshutdown.ShutdownHook` is expected.
+func (r *RecordingHook) Hook() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.times = append(r.times, time.Now())
+	return r.Err
+}
+
+// Calls returns the number of times the hook has run.
+func (r *RecordingHook) Calls() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.times)
+}
+
+// Times returns when each run of the hook started, in order.
+func (r *RecordingHook) Times() []time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]time.Time(nil), r.times...)
+}
+
+// SimulateConns records n new connections with an active request on w, as an
+// `http.Server` would when clients connect. Call the returned function to record
+// all of them closing.
+//
+// Example use:
+//
+//     closeConns := httpdshutdowntest.SimulateConns(watcher, 3)
+//     time.AfterFunc(100*time.Millisecond, closeConns)
+//     err := watcher.OnStop()
+//
+func SimulateConns(w *httpdshutdown.Watcher, n int) (closeAll func()) {
+	for i := 0; i < n; i++ {
+		w.RecordConnState(http.StateNew)
+		w.RecordConnState(http.StateActive)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for i := 0; i < n; i++ {
+				w.RecordConnState(http.StateIdle)
+				w.RecordConnState(http.StateClosed)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package httpdshutdowntest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bradclawsie/httpdshutdown"
+)
+
+func TestRecordingHook(t *testing.T) {
+	rec := new(RecordingHook)
+	failing := &RecordingHook{Err: errors.New("close failed")}
+	w, _ := httpdshutdown.NewWatcher(100, rec.Hook, failing.Hook)
+	w.OnStop()
+	if rec.Calls() != 1 || failing.Calls() != 1 {
+		t.Errorf("TestRecordingHook: expected one call each, got %d and %d", rec.Calls(), failing.Calls())
+	}
+	if err := w.RunHooks(); !errors.Is(err, failing.Err) {
+		t.Errorf("TestRecordingHook: expected the configured error, got %v", err)
+	}
+	if times := rec.Times(); len(times) != 2 || times[1].Before(times[0]) {
+		t.Errorf("TestRecordingHook: unexpected call times %v", times)
+	}
+}
+
+func TestSimulateConns(t *testing.T) {
+	w, _ := httpdshutdown.NewWatcher(2000)
+	closeConns := SimulateConns(w, 3)
+	if n := w.OpenConns(); n != 3 {
+		t.Fatalf("TestSimulateConns: expected 3 open conns, got %d", n)
+	}
+	time.AfterFunc(50*time.Millisecond, closeConns)
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestSimulateConns: should drain without error, got %v", err)
+	}
+	closeConns()
+	if n := w.OpenConns(); n != 0 {
+		t.Errorf("TestSimulateConns: expected 0 open conns, got %d", n)
+	}
+}
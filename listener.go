@@ -0,0 +1,121 @@
+package httpdshutdown
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// WrapListener returns a listener that stops accepting connections at the socket level
+// once a shutdown begins, rather than leaving new connections to be refused at the
+// HTTP layer. From then on `Accept` returns `ErrDraining`, which makes a
+// `http.Server` serving the listener return from `Serve`; an `Accept` that is blocked
+// when the shutdown begins is woken up by closing l. Connections that were already
+// accepted are unaffected and drain as usual. Because l is closed, the listener
+// stays closed if the shutdown is then aborted with `CancelShutdown`; wrap a new
+// listener to accept connections again.
+//
+// Example use:
+//
+//     ln, err := net.Listen("tcp", ":8080")
+//     ...
+//     go srv.Serve(watcher.WrapListener(ln))
+//
+func (w *Watcher) WrapListener(l net.Listener) net.Listener {
+	if w == nil {
+		panic("WrapListener: receiver is nil")
+	}
+	dl := &drainListener{Listener: l, w: w, closed: make(chan struct{})}
+	ctx := w.Context()
+	go func() {
+		select {
+		case <-ctx.Done():
+			dl.closeListener()
+		case <-dl.closed:
+		}
+	}()
+	return dl
+}
+
+// drainListener refuses connections once its watcher is draining.
+type drainListener struct {
+	net.Listener
+	w         *Watcher
+	closeOnce sync.Once
+	closeErr  error         // Result of closing the underlying listener.
+	closed    chan struct{} // Closed by Close, to stop watching for a shutdown.
+}
+
+// Accept waits for and returns the next connection, unless a shutdown has begun.
+func (dl *drainListener) Accept() (net.Conn, error) {
+	if dl.w.IsDraining() {
+		return nil, ErrDraining
+	}
+	conn, err := dl.Listener.Accept()
+	if dl.w.IsDraining() {
+		// Either the shutdown closed the listener, or the connection arrived too late.
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, ErrDraining
+	}
+	return conn, err
+}
+
+// Close closes the underlying listener. Since the listener may already have been
+// closed by the shutdown, closing it again, as `http.Server.Shutdown` does, is not
+// an error.
+func (dl *drainListener) Close() error {
+	return dl.closeListener()
+}
+
+// closeListener closes the underlying listener once.
+func (dl *drainListener) closeListener() error {
+	dl.closeOnce.Do(func() {
+		close(dl.closed)
+		dl.closeErr = dl.Listener.Close()
+	})
+	return dl.closeErr
+}
+
+// ListenUnix listens on the Unix domain socket at path, for a daemon behind a proxy
+// such as nginx, and returns the listener wrapped with `WrapListener`. A socket file
+// left at path by a process that crashed is removed first, but a socket something is
+// still listening on is reported as an error, as is any other file. The socket file
+// belongs to the listener and is removed when it closes, whether by the shutdown, by
+// `http.Server.Shutdown` or `Close`, or by closing it directly.
+//
+// Connections accepted on a Unix socket are counted, drained and force-closed like
+// TCP ones, and the listener works with `net/http/fcgi` as well as `http.Server`.
+// FastCGI has no `ConnState`, so count its requests with `TrackHandler` instead.
+//
+// Example use:
+//
+//     ln, err := watcher.ListenUnix("/run/app/http.sock")
+//     ...
+//     go srv.Serve(ln)
+//
+func (w *Watcher) ListenUnix(path string) (net.Listener, error) {
+	if w == nil {
+		return nil, fmt.Errorf("ListenUnix: %w", ErrNilWatcher)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("ListenUnix: %s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("ListenUnix: %s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("ListenUnix: removing stale socket: %w", err)
+		}
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("ListenUnix: %w", err)
+	}
+	l.SetUnlinkOnClose(true)
+	return w.WrapListener(l), nil
+}
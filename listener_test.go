@@ -0,0 +1,185 @@
+package httpdshutdown
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWrapListener(t *testing.T) {
+	w, _ := NewWatcher(100)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wl := w.WrapListener(ln)
+	defer wl.Close()
+
+	// Connections are accepted until the shutdown begins.
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	accepted, err := wl.Accept()
+	if err != nil {
+		t.Fatalf("TestWrapListener: accept before the shutdown should succeed, got %v", err)
+	}
+	defer accepted.Close()
+
+	// A blocked Accept is woken up by the shutdown.
+	errc := make(chan error, 1)
+	go func() {
+		_, err := wl.Accept()
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := w.BeginShutdown(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrDraining) {
+			t.Errorf("TestWrapListener: expected ErrDraining, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestWrapListener: Accept was not woken up by the shutdown")
+	}
+	if _, err := wl.Accept(); !errors.Is(err, ErrDraining) {
+		t.Errorf("TestWrapListener: accept after the shutdown should fail, got %v", err)
+	}
+
+	// The connection accepted earlier is still usable.
+	if _, err := client.Write([]byte("x")); err != nil {
+		t.Errorf("TestWrapListener: accepted conn should stay open, got %v", err)
+	}
+	buf := make([]byte, 1)
+	accepted.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := accepted.Read(buf); err != nil || buf[0] != 'x' {
+		t.Errorf("TestWrapListener: accepted conn should stay usable, got %v", err)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "http.sock")
+	// A socket file left behind by a crashed process is replaced.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	w, _ := NewWatcher(2000)
+	ln, err := w.ListenUnix(path)
+	if err != nil {
+		t.Fatalf("TestListenUnix: %v", err)
+	}
+	if _, err := w.ListenUnix(path); err == nil {
+		t.Errorf("TestListenUnix: a socket in use should be rejected")
+	}
+	started := make(chan struct{})
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			io.WriteString(rw, "done")
+		}),
+		ConnState: w.ConnStateHook(),
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", path)
+		},
+	}}
+	body := make(chan string, 1)
+	go func() {
+		resp, err := client.Get("http://unix/")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	<-started
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestListenUnix: %v", err)
+	}
+	if b := <-body; b != "done" {
+		t.Errorf("TestListenUnix: the request in flight should complete, got %q", b)
+	}
+	if _, err := os.Lstat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("TestListenUnix: the socket file should be removed, got %v", err)
+	}
+	if _, err := client.Get("http://unix/"); err == nil {
+		t.Errorf("TestListenUnix: the socket should refuse connections after the shutdown")
+	}
+
+	// Anything but a socket is left alone.
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.ListenUnix(path); err == nil {
+		t.Errorf("TestListenUnix: a regular file should be rejected")
+	}
+}
+
+func TestWrapListenerCancelShutdown(t *testing.T) {
+	w, _ := NewWatcher(2000)
+	w.RecordConnState(http.StateNew)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wl := w.WrapListener(ln)
+	defer wl.Close()
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- w.OnStop() }()
+	waitDraining(t, w)
+	if err := w.CancelShutdown(); err != nil {
+		t.Fatalf("TestWrapListenerCancelShutdown: %v", err)
+	}
+	if err := <-stopped; !errors.Is(err, ErrShutdownCancelled) {
+		t.Errorf("TestWrapListenerCancelShutdown: expected ErrShutdownCancelled, got %v", err)
+	}
+
+	// The shutdown closed the underlying listener, so it does not survive the cancel.
+	if _, err := wl.Accept(); err == nil {
+		t.Errorf("TestWrapListenerCancelShutdown: the listener should stay closed")
+	}
+	if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("TestWrapListenerCancelShutdown: the socket should refuse connections")
+	}
+
+	// A listener wrapped after the cancel accepts connections.
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wl2 := w.WrapListener(ln2)
+	defer wl2.Close()
+	client, err := net.Dial("tcp", ln2.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := wl2.Accept()
+	if err != nil {
+		t.Fatalf("TestWrapListenerCancelShutdown: a new listener should accept, got %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,23 @@
+package httpdshutdown
+
+import "fmt"
+
+// Logger is the minimal logging interface used by a Watcher. The standard library's
+// `*log.Logger` satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// logf writes to the configured logger, if any, and as a warning to the structured
+// logger, if any.
+func (w *Watcher) logf(format string, v ...interface{}) {
+	w.mu.Lock()
+	logger, slogger := w.logger, w.slogger
+	w.mu.Unlock()
+	if logger != nil {
+		logger.Printf(format, v...)
+	}
+	if slogger != nil {
+		slogger.Warn(fmt.Sprintf(format, v...))
+	}
+}
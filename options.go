@@ -0,0 +1,442 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Option configures optional behavior of a Watcher. Options are applied with
+// `Configure`.
+type Option func(*Watcher) error
+
+// Configure applies opts to the watcher in order, stopping at the first option that
+// returns an error. Options should be applied before a shutdown begins.
+//
+// Example use:
+//
+//    err := watcher.Configure(httpdshutdown.WithProgress(time.Second, func(open int) {
+//            log.Printf("draining: %d conns remaining", open)
+//    }))
+//
+func (w *Watcher) Configure(opts ...Option) error {
+	if w == nil {
+		return fmt.Errorf("Configure: %w", ErrNilWatcher)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, opt := range opts {
+		if err := opt(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithProgress calls fn with the number of open connections every interval while a
+// shutdown is waiting for connections to drain. Reporting stops as soon as the drain
+// completes, times out or is cancelled.
+func WithProgress(interval time.Duration, fn func(openConns int)) Option {
+	return func(w *Watcher) error {
+		if interval <= 0 {
+			return errors.New("WithProgress: interval must be a positive duration")
+		}
+		if fn == nil {
+			return errors.New("WithProgress: fn is nil")
+		}
+		w.progressInterval = interval
+		w.progressFn = fn
+		return nil
+	}
+}
+
+// WithHijackTracking keeps hijacked connections counted as open until the application
+// calls `ReleaseHijacked`. By default a `StateHijacked` transition stops the count,
+// which makes a WebSocket gateway, where nearly every connection is hijacked, look
+// drained while its sockets are still in use. Tracking needs to know which
+// connection was hijacked, so it only applies to states recorded through
+// `ConnStateHook` or `WrapConnState`; `RecordConnState` has no connection to track.
+func WithHijackTracking() Option {
+	return func(w *Watcher) error {
+		w.trackHijacked = true
+		return nil
+	}
+}
+
+// WithHijackPolicy selects how hijacked connections are counted. The default,
+// `HijackAsClosed`, stops counting a connection when it is hijacked; `HijackAsOpen`
+// behaves like `WithHijackTracking`.
+func WithHijackPolicy(policy HijackPolicy) Option {
+	return func(w *Watcher) error {
+		switch policy {
+		case HijackAsClosed:
+			w.trackHijacked = false
+		case HijackAsOpen:
+			w.trackHijacked = true
+		default:
+			return fmt.Errorf("WithHijackPolicy: unknown hijack policy %d", policy)
+		}
+		return nil
+	}
+}
+
+// WithHookTiming chooses when the shutdown hooks run relative to closing attached
+// servers. The default, AfterServerClose, is the order `OnStop` documents: hooks only
+// run once the servers have drained and closed, so a hook may safely release
+// resources that handlers use, such as a database pool.
+//
+// BeforeServerClose runs the hooks concurrently with the drain, right after the
+// servers stop accepting, for hooks whose work must reach the requests still being
+// served, such as draining an in-memory queue into pending responses. The tradeoff is
+// that handlers may still run while and after hooks execute, so those hooks must not
+// release anything handlers need. The shutdown can no longer be cancelled once the
+// servers stop accepting, timeout hooks run after the normal hooks rather than
+// before, and hooks of a watcher without attached servers are unaffected.
+func WithHookTiming(timing HookTiming) Option {
+	return func(w *Watcher) error {
+		switch timing {
+		case AfterServerClose, BeforeServerClose:
+			w.hookTiming = timing
+		default:
+			return fmt.Errorf("WithHookTiming: unknown hook timing %d", timing)
+		}
+		return nil
+	}
+}
+
+// WithLogger sets the logger that receives the watcher's warnings, such as a passed
+// soft deadline. A `*log.Logger` satisfies `Logger`. By default nothing is logged.
+func WithLogger(logger Logger) Option {
+	return func(w *Watcher) error {
+		w.logger = logger
+		return nil
+	}
+}
+
+// WithStallWarnings logs a warning through the logger set with `WithLogger` when a
+// drain has made no progress, meaning no connection has closed, for after. Further
+// warnings follow at doubling intervals, after 2*after, 4*after and so on, for as
+// long as the drain stays stalled, and the intervals start over once a connection
+// closes. This helps on-call staff judge whether a shutdown is stuck and should be
+// forced. Warnings apply to drains counted by the watcher, not to attached servers.
+//
+// Example use, warning after 10s, 20s, 40s and so on without progress:
+//
+//     err := watcher.Configure(httpdshutdown.WithLogger(logger),
+//         httpdshutdown.WithStallWarnings(10*time.Second))
+//
+func WithStallWarnings(after time.Duration) Option {
+	return func(w *Watcher) error {
+		if after <= 0 {
+			return errors.New("WithStallWarnings: after must be a positive duration")
+		}
+		w.stallWarn = after
+		return nil
+	}
+}
+
+// WithFirstProgress calls fn once per shutdown, with the number of connections still
+// open, when the first connection closes after the shutdown begins. Compared with the
+// completion of the drain, this tells a slow drain, which makes steady progress, apart
+// from a stuck one, which makes none. fn runs in its own goroutine and is not called
+// if no connection was open when the shutdown began.
+func WithFirstProgress(fn func(openConns int)) Option {
+	return func(w *Watcher) error {
+		if fn == nil {
+			return errors.New("WithFirstProgress: fn is nil")
+		}
+		w.firstProgressFn = fn
+		return nil
+	}
+}
+
+// WithSoftDeadlineFunc sets a function called with the number of open connections
+// when the soft deadline of a watcher built by `NewWatcherEscalating` passes.
+func WithSoftDeadlineFunc(fn func(openConns int)) Option {
+	return func(w *Watcher) error {
+		if fn == nil {
+			return errors.New("WithSoftDeadlineFunc: fn is nil")
+		}
+		w.softFn = fn
+		return nil
+	}
+}
+
+// WithPreTimeoutWarning sets a last-chance callback, called with the number of open
+// connections lead before the grace period of a shutdown expires, so operators can
+// capture state before the shutdown is forced. The callback is only called if the
+// drain is still waiting at that point, and not at all if the grace period is no
+// longer than lead. Like the soft deadline, it applies to drains counted by the
+// watcher, not to attached servers.
+//
+// Example use:
+//
+//     err := watcher.Configure(httpdshutdown.WithPreTimeoutWarning(time.Second, func(open int) {
+//             log.Printf("1s to forced shutdown with %d connections open", open)
+//     }))
+//
+func WithPreTimeoutWarning(lead time.Duration, fn func(openConns int)) Option {
+	return func(w *Watcher) error {
+		if lead <= 0 {
+			return errors.New("WithPreTimeoutWarning: lead must be a positive duration")
+		}
+		if fn == nil {
+			return errors.New("WithPreTimeoutWarning: fn is nil")
+		}
+		w.preTimeoutLead, w.preTimeoutFn = lead, fn
+		return nil
+	}
+}
+
+// WithDrainMode selects what a shutdown waits for. The default, `DrainConnections`,
+// waits for connections to close; `DrainRequests` waits for in-flight requests to
+// complete and closes idle connections.
+func WithDrainMode(mode DrainMode) Option {
+	return func(w *Watcher) error {
+		if mode != DrainConnections && mode != DrainRequests {
+			return fmt.Errorf("WithDrainMode: unknown drain mode %d", mode)
+		}
+		w.drainMode = mode
+		return nil
+	}
+}
+
+// WithDrainPredicate makes ready the definition of drained, for applications that
+// track their requests in flight themselves, such as with an atomic counter in a
+// middleware, rather than through `RecordConnState`. A shutdown, or `Drain`, polls
+// ready every 50ms, or as set with `WithDrainPollInterval`, until it returns true or
+// the grace period ends, and ignores the watcher's connection count, which still feeds
+// progress reports and stall warnings. As with counted connections, the predicate
+// holds up `OnStop` only when no server is attached. ready is called from the
+// shutdown's goroutine, so it must be safe to call concurrently with the handlers.
+//
+// Example use:
+//
+//     watcher.Configure(httpdshutdown.WithDrainPredicate(func() bool {
+//             return inFlight.Load() == 0
+//     }))
+//
+func WithDrainPredicate(ready func() bool) Option {
+	return func(w *Watcher) error {
+		if ready == nil {
+			return errors.New("WithDrainPredicate: ready is nil")
+		}
+		w.drainPredicate = ready
+		return nil
+	}
+}
+
+// WithDrainPollInterval sets how often a shutdown polls the drain conditions that it
+// cannot wait on directly: the predicate of `WithDrainPredicate`, the open count of an
+// adaptive watcher, critical connections, drain gates, request ages and stall
+// warnings. The default is 50ms; a server with a high churn of connections may poll
+// faster to finish its drain sooner, and an idle one slower to save CPU. Conditions
+// with a shorter period of their own, such as a stall duration below d, are still
+// polled at that period.
+func WithDrainPollInterval(d time.Duration) Option {
+	return func(w *Watcher) error {
+		if d <= 0 {
+			return errors.New("WithDrainPollInterval: d must be a positive duration")
+		}
+		w.pollInterval = d
+		return nil
+	}
+}
+
+// pollIntervalLocked returns the interval at which drain conditions are polled. The
+// caller must hold w.mu.
+func (w *Watcher) pollIntervalLocked() time.Duration {
+	if w.pollInterval > 0 {
+		return w.pollInterval
+	}
+	return defaultPollInterval
+}
+
+// WithMinDrainTime makes every shutdown wait at least d before running hooks, even if
+// connections drain sooner. Load balancers take a few seconds to stop routing to a
+// daemon that has started shutting down, and exiting before then would fail the
+// requests still on their way. The wait is max(drain completion, d).
+func WithMinDrainTime(d time.Duration) Option {
+	return func(w *Watcher) error {
+		if d < 0 {
+			return errors.New("WithMinDrainTime: duration must not be negative")
+		}
+		w.minDrain = d
+		return nil
+	}
+}
+
+// WithPreStopDelay makes every shutdown wait d after it starts and before the drain
+// begins, in place of a Kubernetes preStop sleep. The watcher is marked as draining
+// first, so a readiness probe that checks `IsDraining` fails and load balancers stop
+// routing to the daemon, while attached servers keep serving the requests still on
+// their way. A shutdown thus proceeds: readiness off, delay, drain, hooks. Listeners
+// from `WrapListener` already refuse new connections during the delay.
+//
+// The delay is part of the grace period: the drain gets only what remains of it.
+// It also counts towards `WithMinDrainTime`, which is measured from the start of the
+// shutdown, so a minimum drain time no longer than d adds no further wait. A
+// `CancelShutdown` during the delay ends the shutdown before anything is drained.
+func WithPreStopDelay(d time.Duration) Option {
+	return func(w *Watcher) error {
+		if d < 0 {
+			return errors.New("WithPreStopDelay: duration must not be negative")
+		}
+		w.preStopDelay = d
+		return nil
+	}
+}
+
+// WithSkipDrain makes every shutdown skip the drain and go straight to the hooks,
+// for a stateless service whose requests in flight are safe to drop. Nothing is
+// waited on: attached servers are closed and gRPC servers stopped at once, open
+// connections are left to the process exit, and `WithPreStopDelay`,
+// `WithMinDrainTime`, drain gates and worker groups are ignored. Long-lived closers
+// and stream notifications still run, since they do not wait, and child watchers of a
+// composite watcher stop as they are configured. This trades graceful completion of
+// requests for a fast exit, and must be opted into explicitly.
+func WithSkipDrain() Option {
+	return func(w *Watcher) error {
+		w.skipDrain = true
+		return nil
+	}
+}
+
+// WithHandoff calls fn during every shutdown after intake stops but before the drain,
+// so a zero-downtime deploy can hand the listener to a freshly exec'd process that
+// accepts new connections while this one drains. A shutdown proceeds in this order:
+//
+//     1. the watcher starts draining, so `IsDraining` reports true;
+//     2. fn is called;
+//     3. long-lived closers run, attached servers shut down and connections drain;
+//     4. shutdown hooks run.
+//
+// An error from fn is returned by `OnStop`, but does not stop the shutdown.
+func WithHandoff(fn func() error) Option {
+	return func(w *Watcher) error {
+		if fn == nil {
+			return errors.New("WithHandoff: fn is nil")
+		}
+		w.handoff = fn
+		return nil
+	}
+}
+
+// WithForceClose closes the connections still open when a shutdown times out, rather
+// than leaving them to be dropped when the process exits. before, if not nil, is
+// called with each connection just before it is closed, so an application can for
+// example write a final 503 or terminate a chunked stream cleanly. Only connections
+// whose identity was reported through `ConnStateHook` or `WrapConnState`, and which
+// have not been hijacked, can be force-closed.
+func WithForceClose(before func(conn net.Conn)) Option {
+	return func(w *Watcher) error {
+		w.forceClose = true
+		w.beforeForceClose = before
+		return nil
+	}
+}
+
+// WithMaxRequestAge force-closes, during a shutdown, every connection whose current
+// request has been in flight for longer than d, so a stuck request does not hold up
+// the drain until the timeout. Younger requests are left to finish. Only connections
+// whose identity was reported through `ConnStateHook` or `WrapConnState` are tracked.
+func WithMaxRequestAge(d time.Duration) Option {
+	return func(w *Watcher) error {
+		if d <= 0 {
+			return errors.New("WithMaxRequestAge: age must be a positive duration")
+		}
+		w.maxRequestAge = d
+		return nil
+	}
+}
+
+// WithInterruptExitCode makes `SigHandle` respond to SIGINT by sending code on its exit
+// code channel instead of panicking, which avoids a stack trace that confuses process
+// supervisors. The conventional code is 130, that is 128 plus the signal number.
+// Like the default panic, the clean exit does not drain connections or run hooks.
+//
+// Example use:
+//
+//     watcher.Configure(httpdshutdown.WithInterruptExitCode(130))
+//
+func WithInterruptExitCode(code int) Option {
+	return func(w *Watcher) error {
+		if code < 0 || code > 255 {
+			return errors.New("WithInterruptExitCode: code must be between 0 and 255")
+		}
+		w.interruptExit, w.interruptCode = true, code
+		return nil
+	}
+}
+
+// WithExitCodeMapper sets the function that chooses the exit code `SigHandle` and
+// `Signals` report after a signal triggers a graceful shutdown, so exit codes can
+// follow the conventions of systemd or a container runtime, such as 143 for SIGTERM.
+// By default the code is 0 for a clean shutdown and 1 if `OnStop` returned an error.
+// The code for SIGINT is set with `WithInterruptExitCode` instead.
+//
+// Example use:
+//
+//     watcher.Configure(httpdshutdown.WithExitCodeMapper(func(sig os.Signal, r httpdshutdown.ShutdownResult) int {
+//             if r.Err != nil {
+//                     return 1
+//             }
+//             return 128 + int(sig.(syscall.Signal))
+//     }))
+//
+func WithExitCodeMapper(fn func(sig os.Signal, result ShutdownResult) int) Option {
+	return func(w *Watcher) error {
+		if fn == nil {
+			return errors.New("WithExitCodeMapper: fn is nil")
+		}
+		w.exitCodeMapper = fn
+		return nil
+	}
+}
+
+// WithHooksTimeout limits the time all shutdown hooks together may run to d,
+// independently of the grace period used for draining connections. This ensures hooks
+// neither run unbounded after a fast drain nor are starved by a slow one. Once d
+// expires no further hooks are started, and `OnStop` and `RunHooks` return an error
+// wrapping `ErrHooksTimeout` that names the hooks that did not finish. The context
+// shared by hooks registered with `RegisterContextHook` is cancelled at the same
+// time, so they can abort; other hooks already running cannot be interrupted and are
+// left to finish in the background.
+func WithHooksTimeout(d time.Duration) Option {
+	return func(w *Watcher) error {
+		if d <= 0 {
+			return errors.New("WithHooksTimeout: timeout must be a positive duration")
+		}
+		w.hooksTimeout = d
+		return nil
+	}
+}
+
+// WithStrictHooks makes the shutdown hooks transactional: if a required hook fails or
+// the hooks budget expires, the rollbacks registered with `RegisterHookWithRollback`
+// run for the hooks that succeeded, in reverse order. Every hook still runs first,
+// so a failure never causes cleanup to be skipped.
+func WithStrictHooks() Option {
+	return func(w *Watcher) error {
+		w.strictHooks = true
+		return nil
+	}
+}
+
+// WithMaxConns limits the number of concurrent connections to n. A new connection
+// arriving while n are already open is closed at once, and counted by
+// `RejectedConns`. The limit composes with draining: once a shutdown begins the limit
+// effectively drops to zero, so every new connection is rejected while the open ones
+// drain. Enforcement needs connection identities, so states must be recorded through
+// `ConnStateHook`, `WrapConnState` or `AttachServer`.
+func WithMaxConns(n int) Option {
+	return func(w *Watcher) error {
+		if n <= 0 {
+			return errors.New("WithMaxConns: limit must be positive")
+		}
+		w.maxConns = n
+		return nil
+	}
+}
@@ -0,0 +1,515 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWithProgress(t *testing.T) {
+	w, wErr := NewWatcher(5000)
+	if w == nil || wErr != nil {
+		t.Fatalf("TestWithProgress: should not be nil")
+	}
+	if err := w.Configure(WithProgress(0, func(int) {})); err == nil {
+		t.Errorf("TestWithProgress: zero interval should be rejected")
+	}
+	if err := w.Configure(WithProgress(time.Millisecond, nil)); err == nil {
+		t.Errorf("TestWithProgress: nil fn should be rejected")
+	}
+
+	var mu sync.Mutex
+	var reports []int
+	if err := w.Configure(WithProgress(5*time.Millisecond, func(open int) {
+		mu.Lock()
+		reports = append(reports, open)
+		mu.Unlock()
+	})); err != nil {
+		t.Fatal(err)
+	}
+	w.RecordConnState(http.StateNew)
+	w.RecordConnState(http.StateNew)
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		w.RecordConnState(http.StateClosed)
+		time.Sleep(30 * time.Millisecond)
+		w.RecordConnState(http.StateClosed)
+	}()
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestWithProgress: should not have an error, got %v", err)
+	}
+	mu.Lock()
+	seen := len(reports)
+	sawTwo, sawOne := false, false
+	for _, n := range reports {
+		sawTwo = sawTwo || n == 2
+		sawOne = sawOne || n == 1
+	}
+	mu.Unlock()
+	if !sawTwo || !sawOne {
+		t.Errorf("TestWithProgress: expected reports of 2 and 1 open conns, got %v", reports)
+	}
+
+	// The ticker must stop once the drain has completed.
+	time.Sleep(30 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) != seen {
+		t.Errorf("TestWithProgress: progress reported after drain completed")
+	}
+}
+
+func TestWithMinDrainTime(t *testing.T) {
+	w, _ := NewWatcher(5000)
+	if err := w.Configure(WithMinDrainTime(-time.Second)); err == nil {
+		t.Errorf("TestWithMinDrainTime: negative duration should be rejected")
+	}
+	if err := w.Configure(WithMinDrainTime(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	// An instantly empty watcher still honors the floor.
+	elapsed, err := w.OnStopTimed()
+	if err != nil {
+		t.Errorf("TestWithMinDrainTime: should not have an error, got %v", err)
+	}
+	if elapsed < 100*time.Millisecond {
+		t.Errorf("TestWithMinDrainTime: returned after %v, before the minimum drain time", elapsed)
+	}
+
+	// A drain that outlasts the floor is not extended further.
+	w.RecordConnState(http.StateNew)
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		w.RecordConnState(http.StateClosed)
+	}()
+	elapsed, err = w.OnStopTimed()
+	if err != nil {
+		t.Errorf("TestWithMinDrainTime: should not have an error, got %v", err)
+	}
+	if elapsed > 2*time.Second {
+		t.Errorf("TestWithMinDrainTime: drain took %v", elapsed)
+	}
+}
+
+func TestWithPreStopDelay(t *testing.T) {
+	fc := newFakeClock()
+	w := newWatcherWithClock(fc, 5*time.Second)
+	if err := w.Configure(WithPreStopDelay(-time.Second)); err == nil {
+		t.Errorf("TestWithPreStopDelay: negative duration should be rejected")
+	}
+	if err := w.Configure(WithPreStopDelay(2*time.Second), WithMinDrainTime(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var order []string
+	record := func(step string) {
+		mu.Lock()
+		order = append(order, step)
+		mu.Unlock()
+	}
+	_ = w.RegisterLongLivedCloser(func() {
+		record("drain")
+		w.RecordConnState(http.StateClosed)
+	})
+	_ = w.RegisterHook(func() error {
+		record("hooks")
+		return nil
+	})
+	w.RecordConnState(http.StateNew)
+	errc := make(chan error, 1)
+	go func() { errc <- w.OnStop() }()
+	// The hard timeout is not armed until the delay is over.
+	fc.BlockUntil(t, 1)
+	if !w.IsDraining() {
+		t.Errorf("TestWithPreStopDelay: readiness should be off during the delay")
+	}
+	fc.Advance(2*time.Second - time.Millisecond)
+	mu.Lock()
+	if len(order) != 0 {
+		t.Errorf("TestWithPreStopDelay: nothing should run during the delay, got %v", order)
+	}
+	mu.Unlock()
+	// The minimum drain time has already passed, so it adds no wait.
+	fc.Advance(time.Millisecond)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("TestWithPreStopDelay: should not have an error, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestWithPreStopDelay: OnStop did not return after the delay")
+	}
+	if strings.Join(order, ",") != "drain,hooks" {
+		t.Errorf("TestWithPreStopDelay: expected the drain then the hooks, got %v", order)
+	}
+
+	// The delay comes out of the grace period: a stuck connection times out 5s after
+	// the shutdown started, not 5s after the delay.
+	w = newWatcherWithClock(fc, 5*time.Second)
+	_ = w.Configure(WithPreStopDelay(2 * time.Second))
+	w.RecordConnState(http.StateNew)
+	go func() { errc <- w.OnStop() }()
+	fc.BlockUntil(t, 1)
+	fc.Advance(2 * time.Second)
+	fc.BlockUntil(t, 1)
+	fc.Advance(3 * time.Second)
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrShutdownTimeout) {
+			t.Errorf("TestWithPreStopDelay: expected a timeout, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestWithPreStopDelay: the delay should count towards the grace period")
+	}
+	if r := w.LastReport(); r == nil || r.Duration != 5*time.Second {
+		t.Errorf("TestWithPreStopDelay: expected a 5s shutdown, got %+v", r)
+	}
+}
+
+func TestWithSkipDrain(t *testing.T) {
+	w, _ := NewWatcher(60000)
+	if err := w.Configure(WithSkipDrain(), WithMinDrainTime(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	hookRan := false
+	_ = w.RegisterHook(func() error {
+		hookRan = true
+		return nil
+	})
+	w.RecordConnState(http.StateNew)
+	w.RecordConnState(http.StateNew)
+	start := time.Now()
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestWithSkipDrain: should not have an error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("TestWithSkipDrain: OnStop should not wait on the drain, took %v", elapsed)
+	}
+	if !hookRan || w.OpenConns() != 2 {
+		t.Errorf("TestWithSkipDrain: expected the hook to run with 2 connections open, got %v, %d",
+			hookRan, w.OpenConns())
+	}
+
+	// An attached server is closed outright, dropping its stuck request.
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	w, _ = NewWatcher(60000)
+	_ = w.Configure(WithSkipDrain())
+	srv, url := startServer(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}), w.AttachServer)
+	defer srv.Close()
+	inFlight(t, url, started)
+	start = time.Now()
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestWithSkipDrain: should not have an error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("TestWithSkipDrain: OnStop should not wait on the server, took %v", elapsed)
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Errorf("TestWithSkipDrain: the server should be closed")
+	}
+}
+
+func TestWithHandoff(t *testing.T) {
+	w, _ := NewWatcher(2000)
+	hookRan := false
+	w.RegisterHook(func() error {
+		hookRan = true
+		return nil
+	})
+	if err := w.Configure(WithHandoff(nil)); err == nil {
+		t.Errorf("TestWithHandoff: nil fn should be rejected")
+	}
+	w.RecordConnState(http.StateNew)
+	handedOff := false
+	err := w.Configure(WithHandoff(func() error {
+		handedOff = true
+		if !w.IsDraining() {
+			t.Errorf("TestWithHandoff: handoff should run after intake stops")
+		}
+		if w.OpenConns() != 1 || hookRan {
+			t.Errorf("TestWithHandoff: handoff should run before the drain and hooks")
+		}
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			w.RecordConnState(http.StateClosed)
+		}()
+		return errors.New("exec failed")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.OnStop()
+	if !handedOff || !hookRan {
+		t.Errorf("TestWithHandoff: handoff and hooks should both run")
+	}
+	if err == nil || !strings.Contains(err.Error(), "exec failed") {
+		t.Errorf("TestWithHandoff: handoff error should be returned, got %v", err)
+	}
+}
+
+func TestWithFirstProgress(t *testing.T) {
+	w, _ := NewWatcher(50)
+	if err := w.Configure(WithFirstProgress(nil)); err == nil {
+		t.Errorf("TestWithFirstProgress: nil fn should be rejected")
+	}
+	progress := make(chan int, 4)
+	if err := w.Configure(WithFirstProgress(func(open int) { progress <- open })); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stuck drain makes no progress at all. A close before the shutdown does not
+	// count either.
+	w.RecordConnState(http.StateNew)
+	w.RecordConnState(http.StateNew)
+	w.RecordConnState(http.StateClosed)
+	if err := w.OnStop(); !errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("TestWithFirstProgress: expected a timeout, got %v", err)
+	}
+	select {
+	case open := <-progress:
+		t.Errorf("TestWithFirstProgress: stuck drain should report no progress, got %d", open)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// A slow drain reports its first close, and only that one.
+	w.Reset()
+	w.RecordConnState(http.StateNew)
+	w.RecordConnState(http.StateNew)
+	w.RecordConnState(http.StateNew)
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(10 * time.Millisecond)
+			w.RecordConnState(http.StateClosed)
+		}
+	}()
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestWithFirstProgress: slow drain should complete, got %v", err)
+	}
+	select {
+	case open := <-progress:
+		if open != 2 {
+			t.Errorf("TestWithFirstProgress: expected progress with 2 conns open, got %d", open)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("TestWithFirstProgress: slow drain should report progress")
+	}
+	select {
+	case open := <-progress:
+		t.Errorf("TestWithFirstProgress: progress should be reported once, got %d", open)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestWithStallWarnings(t *testing.T) {
+	w, _ := NewWatcher(int(time.Hour / time.Millisecond))
+	if err := w.Configure(WithStallWarnings(0)); err == nil {
+		t.Errorf("TestWithStallWarnings: zero duration should be rejected")
+	}
+	logger := &testLogger{}
+	if err := w.Configure(WithLogger(logger), WithStallWarnings(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	fc := newFakeClock()
+	w.clock = fc
+	warnings := func() int {
+		logger.mu.Lock()
+		defer logger.mu.Unlock()
+		n := 0
+		for _, line := range logger.lines {
+			if strings.Contains(line, "drain stalled") {
+				n++
+			}
+		}
+		return n
+	}
+	waitWarnings := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for warnings() < n && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if got := warnings(); got != n {
+			t.Fatalf("TestWithStallWarnings: expected %d warnings, got %d: %v", n, got, logger.lines)
+		}
+	}
+	advance := func(d time.Duration) {
+		for ; d > 0; d -= defaultPollInterval {
+			fc.Advance(defaultPollInterval)
+			time.Sleep(100 * time.Microsecond)
+		}
+	}
+
+	w.RecordConnState(http.StateNew)
+	w.RecordConnState(http.StateNew)
+	errc := make(chan error, 1)
+	go func() { errc <- w.OnStop() }()
+	// The hard timeout and the stall poll.
+	fc.BlockUntil(t, 2)
+	// Stalled for 7s: warnings after 1s, 2s and 4s.
+	advance(7 * time.Second)
+	waitWarnings(3)
+	if !logger.contains("still 2 connections open after 1s") {
+		t.Errorf("TestWithStallWarnings: first warning should report the open count, got %v", logger.lines)
+	}
+	// Progress starts the intervals over.
+	w.RecordConnState(http.StateClosed)
+	advance(time.Second + defaultPollInterval)
+	waitWarnings(4)
+	w.RecordConnState(http.StateClosed)
+	if err := <-errc; err != nil {
+		t.Errorf("TestWithStallWarnings: drain should complete, got %v", err)
+	}
+}
+
+func TestWithPreTimeoutWarning(t *testing.T) {
+	w, _ := NewWatcher(100)
+	if err := w.Configure(WithPreTimeoutWarning(0, func(int) {})); err == nil {
+		t.Errorf("TestWithPreTimeoutWarning: zero lead should be rejected")
+	}
+	if err := w.Configure(WithPreTimeoutWarning(time.Second, nil)); err == nil {
+		t.Errorf("TestWithPreTimeoutWarning: nil fn should be rejected")
+	}
+	fc := newFakeClock()
+	w = newWatcherWithClock(fc, 10*time.Second)
+	warned := make(chan int, 2)
+	if err := w.Configure(WithPreTimeoutWarning(time.Second, func(open int) { warned <- open })); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stuck drain is warned about a second before it times out.
+	w.RecordConnState(http.StateNew)
+	errc := make(chan error, 1)
+	go func() { errc <- w.OnStop() }()
+	fc.BlockUntil(t, 2)
+	fc.Advance(9*time.Second - time.Millisecond)
+	select {
+	case open := <-warned:
+		t.Fatalf("TestWithPreTimeoutWarning: warned too early with %d open", open)
+	case <-time.After(10 * time.Millisecond):
+	}
+	fc.Advance(time.Millisecond)
+	select {
+	case open := <-warned:
+		if open != 1 {
+			t.Errorf("TestWithPreTimeoutWarning: expected 1 open connection, got %d", open)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestWithPreTimeoutWarning: no warning for a stuck drain")
+	}
+	fc.Advance(time.Second)
+	if err := <-errc; !errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("TestWithPreTimeoutWarning: expected a timeout, got %v", err)
+	}
+
+	// A drain that completes first is not warned about.
+	w.Reset()
+	w.RecordConnState(http.StateNew)
+	go func() { errc <- w.OnStop() }()
+	fc.BlockUntil(t, 2)
+	fc.Advance(5 * time.Second)
+	w.RecordConnState(http.StateClosed)
+	if err := <-errc; err != nil {
+		t.Errorf("TestWithPreTimeoutWarning: clean drain should not have an error, got %v", err)
+	}
+	fc.Advance(10 * time.Second)
+	select {
+	case open := <-warned:
+		t.Errorf("TestWithPreTimeoutWarning: a clean drain should not warn, got %d", open)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestWithDrainPredicate(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	if err := w.Configure(WithDrainPredicate(nil)); err == nil {
+		t.Errorf("TestWithDrainPredicate: a nil predicate should be rejected")
+	}
+	var inFlight atomic.Int32
+	inFlight.Store(1)
+	if err := w.Configure(WithDrainPredicate(func() bool { return inFlight.Load() == 0 })); err != nil {
+		t.Fatal(err)
+	}
+	// The connection count is ignored; only the predicate counts.
+	w.RecordConnState(http.StateNew)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		inFlight.Store(0)
+	}()
+	elapsed, err := w.OnStopTimed()
+	if err != nil {
+		t.Errorf("TestWithDrainPredicate: %v", err)
+	}
+	if elapsed < 100*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("TestWithDrainPredicate: expected to wait for the predicate, took %v", elapsed)
+	}
+
+	// A predicate that never holds times out, even with nothing counted.
+	w, _ = NewWatcher(100)
+	if err := w.Configure(WithDrainPredicate(func() bool { return false })); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.OnStop(); !errors.Is(err, ErrShutdownTimeout) || !strings.Contains(err.Error(), "predicate") {
+		t.Errorf("TestWithDrainPredicate: expected a timeout, got %v", err)
+	}
+}
+
+func TestWithDrainPollInterval(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	if err := w.Configure(WithDrainPollInterval(0)); err == nil {
+		t.Errorf("TestWithDrainPollInterval: a zero interval should be rejected")
+	}
+
+	// drainAfter reports whether a drain, complete as soon as it starts, is detected
+	// within d of fake time with the given poll interval.
+	drainAfter := func(interval, d time.Duration) bool {
+		t.Helper()
+		w, _ := NewWatcher(1000)
+		fc := newFakeClock()
+		w.clock = fc
+		var ready atomic.Bool
+		w.Configure(WithDrainPredicate(ready.Load))
+		if interval > 0 {
+			w.Configure(WithDrainPollInterval(interval))
+		}
+		errc := make(chan error, 1)
+		go func() { errc <- w.OnStop() }()
+		// The timeout and the predicate poll.
+		fc.BlockUntil(t, 2)
+		ready.Store(true)
+		fc.Advance(d)
+		detected := true
+		var err error
+		select {
+		case err = <-errc:
+		case <-time.After(50 * time.Millisecond):
+			// Let the default poll catch up so that the shutdown completes.
+			detected = false
+			fc.Advance(defaultPollInterval)
+			err = <-errc
+		}
+		if err != nil {
+			t.Errorf("TestWithDrainPollInterval: %v", err)
+		}
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		if len(fc.waiters) != 0 {
+			t.Errorf("TestWithDrainPollInterval: %d timers and tickers were left running", len(fc.waiters))
+		}
+		return detected
+	}
+	if !drainAfter(10*time.Millisecond, 10*time.Millisecond) {
+		t.Errorf("TestWithDrainPollInterval: a 10ms poll should detect the drain after 10ms")
+	}
+	if drainAfter(0, 10*time.Millisecond) {
+		t.Errorf("TestWithDrainPollInterval: the default poll should not detect the drain after 10ms")
+	}
+}
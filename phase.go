@@ -0,0 +1,87 @@
+package httpdshutdown
+
+import "fmt"
+
+// phaseChangeBuffer is the capacity of the channel returned by PhaseChanges.
+const phaseChangeBuffer = 16
+
+// Phase is a stage in the lifecycle of a Watcher.
+type Phase int
+
+const (
+	// PhaseRunning means no shutdown is in progress.
+	PhaseRunning Phase = iota
+	// PhaseDraining means a shutdown is waiting for connections to drain.
+	PhaseDraining
+	// PhaseHooks means the shutdown hooks are running.
+	PhaseHooks
+	// PhaseDone means the last shutdown completed within its grace period.
+	PhaseDone
+	// PhaseTimedOut means the last shutdown completed after exceeding its grace
+	// period.
+	PhaseTimedOut
+)
+
+// String returns a lower case name for the phase.
+func (p Phase) String() string {
+	switch p {
+	case PhaseRunning:
+		return "running"
+	case PhaseDraining:
+		return "draining"
+	case PhaseHooks:
+		return "hooks"
+	case PhaseDone:
+		return "done"
+	case PhaseTimedOut:
+		return "timed out"
+	}
+	return fmt.Sprintf("Phase(%d)", int(p))
+}
+
+// Phase returns the current lifecycle phase of the watcher. A clean shutdown moves
+// from PhaseRunning through PhaseDraining and PhaseHooks to PhaseDone; one that
+// exceeds its grace period ends in PhaseTimedOut instead. A cancelled shutdown, as
+// well as `Reset` and `ReArm`, return the watcher to PhaseRunning.
+func (w *Watcher) Phase() Phase {
+	if w == nil {
+		return PhaseRunning
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.phase
+}
+
+// PhaseChanges returns a channel receiving each new phase as the watcher enters it,
+// so a supervisor or dashboard can react to transitions. Every call returns the same
+// channel, and phases are only sent once it has been requested. Like `HookEvents`,
+// the channel is buffered and changes that arrive while it is full are dropped, so a
+// slow reader never holds up a shutdown; `Phase` always reports the current phase.
+func (w *Watcher) PhaseChanges() <-chan Phase {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.phaseChanges == nil {
+		w.phaseChanges = make(chan Phase, phaseChangeBuffer)
+	}
+	return w.phaseChanges
+}
+
+// setPhaseLocked moves the watcher to phase p and reports the change. w.mu must be
+// held.
+func (w *Watcher) setPhaseLocked(p Phase) {
+	if w.phase == p {
+		return
+	}
+	w.phase = p
+	w.slogPhaseLocked(p)
+	if w.phaseChanges == nil {
+		return
+	}
+	select {
+	case w.phaseChanges <- p:
+	default:
+	}
+}
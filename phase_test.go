@@ -0,0 +1,64 @@
+package httpdshutdown
+
+import (
+	"net/http"
+	"testing"
+)
+
+// drainPhases returns the phases buffered on changes.
+func drainPhases(changes <-chan Phase) []Phase {
+	var phases []Phase
+	for {
+		select {
+		case p := <-changes:
+			phases = append(phases, p)
+		default:
+			return phases
+		}
+	}
+}
+
+func TestPhase(t *testing.T) {
+	w, _ := NewWatcher(20)
+	changes := w.PhaseChanges()
+	if p := w.Phase(); p != PhaseRunning {
+		t.Errorf("TestPhase: new watcher should be running, got %v", p)
+	}
+	var duringHooks Phase
+	w.RegisterHook(func() error {
+		duringHooks = w.Phase()
+		return nil
+	})
+
+	w.OnStop()
+	if duringHooks != PhaseHooks {
+		t.Errorf("TestPhase: hooks should run in the hooks phase, got %v", duringHooks)
+	}
+	want := []Phase{PhaseDraining, PhaseHooks, PhaseDone}
+	if got := drainPhases(changes); !equalPhases(got, want) {
+		t.Errorf("TestPhase: clean shutdown: expected %v, got %v", want, got)
+	}
+
+	w.Reset()
+	w.RecordConnState(http.StateNew)
+	w.OnStop()
+	want = []Phase{PhaseRunning, PhaseDraining, PhaseHooks, PhaseTimedOut}
+	if got := drainPhases(changes); !equalPhases(got, want) {
+		t.Errorf("TestPhase: timed out shutdown: expected %v, got %v", want, got)
+	}
+	if p := w.Phase(); p != PhaseTimedOut || p.String() != "timed out" {
+		t.Errorf("TestPhase: expected the timed out phase, got %v", p)
+	}
+}
+
+func equalPhases(a, b []Phase) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
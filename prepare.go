@@ -0,0 +1,98 @@
+package httpdshutdown
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// preparedStop holds a shutdown started by PrepareStop between its drain and its
+// hooks.
+type preparedStop struct {
+	drained chan error    // Receives the result of the drain once it is over.
+	commit  chan struct{} // Closed to let the shutdown go on to its hooks.
+}
+
+// WithPrepareAutoCommit makes a shutdown prepared with `PrepareStop` go on to its
+// hooks when its context ends without a commit, rather than rolling back to serving.
+func WithPrepareAutoCommit() Option {
+	return func(w *Watcher) error {
+		w.autoCommit = true
+		return nil
+	}
+}
+
+// PrepareStop runs the first half of a two-phase shutdown: like `OnStop`, it stops
+// intake and drains the connections, or shuts down the attached servers, within the
+// grace period, but it returns before any hook runs. The returned commit function
+// runs the rest of the shutdown, hooks included, and returns the result `OnStop`
+// would have. This lets a coordinator confirm that other nodes are ready before
+// releasing resources. A drain that missed the deadline is reported as an error
+// wrapping `ErrShutdownTimeout`, together with the commit function, so the caller can
+// still decide.
+//
+// If ctx ends before commit is called, the shutdown is rolled back as if by
+// `CancelShutdown`, and commit returns an error wrapping `ErrShutdownCancelled`; with
+// `WithPrepareAutoCommit`, it is committed instead. A rollback cannot restart the
+// attached servers, which must be replaced as after CancelShutdown. If ctx ends during
+// the drain without auto-commit, PrepareStop returns the cancellation and no commit
+// function. Hooks always run after the drain, whatever `WithHookTiming` says.
+//
+// Example use:
+//
+//     commit, err := watcher.PrepareStop(ctx)
+//     if commit == nil {
+//             return err
+//     }
+//     waitForPeers()
+//     return commit()
+//
+func (w *Watcher) PrepareStop(ctx context.Context) (commit func() error, err error) {
+	if w == nil {
+		return nil, fmt.Errorf("PrepareStop: %w", ErrNilWatcher)
+	}
+	w.mu.Lock()
+	auto := w.autoCommit
+	w.mu.Unlock()
+	st := w.beginStop()
+	p := &preparedStop{drained: make(chan error, 1), commit: make(chan struct{})}
+	st.prepared, st.hookTiming = p, AfterServerClose
+	done := make(chan struct{})
+	var stopErr error
+	go func() {
+		_, stopErr = w.finishStop(st, w.graceTimeout())
+		close(done)
+	}()
+
+	// Committing and abandoning exclude each other, whichever comes first.
+	var decide sync.Once
+	commit = func() error {
+		decide.Do(func() { close(p.commit) })
+		<-done
+		return stopErr
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			decide.Do(func() {
+				if auto {
+					close(p.commit)
+				} else {
+					w.CancelShutdown()
+				}
+			})
+		case <-done:
+		}
+	}()
+
+	select {
+	case err = <-p.drained:
+	case <-done:
+		return nil, stopErr
+	}
+	if ctx.Err() != nil && !auto {
+		<-done
+		return nil, stopErr
+	}
+	return commit, err
+}
@@ -0,0 +1,93 @@
+package httpdshutdown
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPrepareStop(t *testing.T) {
+	var ran atomic.Int32
+	hook := func() error {
+		ran.Add(1)
+		return nil
+	}
+
+	// Prepare, then commit.
+	w, _ := NewWatcher(1000, hook)
+	w.RecordConnState(http.StateNew)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		w.RecordConnState(http.StateClosed)
+	}()
+	commit, err := w.PrepareStop(context.Background())
+	if err != nil || commit == nil {
+		t.Fatalf("TestPrepareStop: %v", err)
+	}
+	if w.OpenConns() != 0 || ran.Load() != 0 || w.Phase() != PhaseDraining {
+		t.Errorf("TestPrepareStop: expected a drained shutdown waiting for its hooks, phase %v, %d hooks run",
+			w.Phase(), ran.Load())
+	}
+	if err := commit(); err != nil {
+		t.Errorf("TestPrepareStop: %v", err)
+	}
+	if ran.Load() != 1 || w.Phase() != PhaseDone {
+		t.Errorf("TestPrepareStop: expected the committed hooks to run, phase %v", w.Phase())
+	}
+	if err := commit(); err != nil || ran.Load() != 1 {
+		t.Errorf("TestPrepareStop: a second commit should return the same result, got %v", err)
+	}
+
+	// Prepare, then abandon: the watcher goes back to serving.
+	ran.Store(0)
+	w, _ = NewWatcher(1000, hook)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	commit, err = w.PrepareStop(ctx)
+	if err != nil || commit == nil {
+		t.Fatalf("TestPrepareStop: %v", err)
+	}
+	for deadline := time.Now().Add(time.Second); w.IsDraining() && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if err := commit(); !errors.Is(err, ErrShutdownCancelled) {
+		t.Errorf("TestPrepareStop: expected an abandoned shutdown to be cancelled, got %v", err)
+	}
+	if ran.Load() != 0 || w.IsDraining() || w.Phase() != PhaseRunning {
+		t.Errorf("TestPrepareStop: expected the watcher to serve again, phase %v, %d hooks run",
+			w.Phase(), ran.Load())
+	}
+
+	// With auto-commit, an abandoned shutdown completes.
+	w, _ = NewWatcher(1000, hook)
+	if err := w.Configure(WithPrepareAutoCommit()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := w.PrepareStop(ctx); err != nil {
+		t.Fatalf("TestPrepareStop: %v", err)
+	}
+	if err := w.Wait(); err != nil || ran.Load() != 1 {
+		t.Errorf("TestPrepareStop: expected the abandoned shutdown to commit, got %v", err)
+	}
+
+	// A drain that misses the deadline is reported, and can still be committed.
+	w, _ = NewWatcher(20)
+	w.RecordConnState(http.StateNew)
+	commit, err = w.PrepareStop(context.Background())
+	if !errors.Is(err, ErrShutdownTimeout) || commit == nil {
+		t.Fatalf("TestPrepareStop: expected a timed out drain, got %v", err)
+	}
+	if err := commit(); !errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("TestPrepareStop: expected the commit to report the timeout, got %v", err)
+	}
+
+	var nilW *Watcher
+	if _, err := nilW.PrepareStop(context.Background()); !errors.Is(err, ErrNilWatcher) {
+		t.Errorf("TestPrepareStop: expected ErrNilWatcher, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package httpdshutdown
+
+import (
+	"fmt"
+	"time"
+)
+
+// HookResult describes the execution of a single shutdown hook.
+type HookResult struct {
+	Name       string        `json:"name"`                  // Name the hook was registered under.
+	Duration   time.Duration `json:"duration"`              // How long the hook ran.
+	Err        error         `json:"-"`                     // Error returned by the hook, if any.
+	Error      string        `json:"error,omitempty"`       // Err as a string, for serialization.
+	BestEffort bool          `json:"best_effort,omitempty"` // Failure does not fail the shutdown.
+	Panic      interface{}   `json:"-"`                     // Value recovered if the hook panicked.
+	Stack      string        `json:"stack,omitempty"`       // Stack trace of the panic, if any.
+}
+
+// ShutdownReport is a machine-readable record of a completed shutdown, suitable for
+// serializing with `encoding/json` and shipping to a log aggregator.
+type ShutdownReport struct {
+	Start    time.Time     `json:"start"`     // When the shutdown began.
+	Duration time.Duration `json:"duration"`  // How long the drain and hooks took.
+	TimedOut bool          `json:"timed_out"` // Whether the drain exceeded the timeout.
+	Hooks    []HookResult  `json:"hooks"`     // One entry per hook, in execution order.
+}
+
+// LastReport returns a copy of the report for the most recently completed shutdown,
+// or nil if no shutdown has completed yet.
+//
+// Example use:
+//
+//    if report := watcher.LastReport(); report != nil {
+//            b, _ := json.Marshal(report)
+//            log.Printf("shutdown report: %s", b)
+//    }
+//
+func (w *Watcher) LastReport() *ShutdownReport {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.report == nil {
+		return nil
+	}
+	report := *w.report
+	report.Hooks = append([]HookResult(nil), w.report.Hooks...)
+	return &report
+}
+
+// TimedOut reports whether the most recently completed shutdown exceeded its grace
+// period, for exit and health logic that only needs the common branch. It is false
+// if no shutdown has completed, and is safe to call while a shutdown runs.
+func (w *Watcher) TimedOut() bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.report != nil && w.report.TimedOut
+}
+
+// anonymousHookName is the name reported for the hook registered without a name at
+// position i.
+func anonymousHookName(i int) string {
+	return fmt.Sprintf("hook[%d]", i)
+}
@@ -0,0 +1,68 @@
+package httpdshutdown
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestLastReport(t *testing.T) {
+	w, wErr := NewWatcher(10, sampleShutdownHook)
+	if w == nil || wErr != nil {
+		t.Fatalf("TestLastReport: should not be nil")
+	}
+	if w.LastReport() != nil {
+		t.Errorf("TestLastReport: should have no report before a shutdown")
+	}
+	if err := w.RegisterNamedHook("db", func() error { return errors.New("db close failed") }); err != nil {
+		t.Fatal(err)
+	}
+	w.RecordConnState(http.StateNew)
+	_ = w.OnStop()
+
+	report := w.LastReport()
+	if report == nil {
+		t.Fatalf("TestLastReport: should have a report")
+	}
+	if !report.TimedOut {
+		t.Errorf("TestLastReport: report should record the timeout")
+	}
+	if len(report.Hooks) != 2 || report.Hooks[0].Name != "hook[0]" || report.Hooks[1].Name != "db" {
+		t.Fatalf("TestLastReport: unexpected hooks %+v", report.Hooks)
+	}
+	if report.Hooks[0].Err != nil || report.Hooks[1].Error != "db close failed" {
+		t.Errorf("TestLastReport: unexpected hook errors %+v", report.Hooks)
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ShutdownReport
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.TimedOut || len(decoded.Hooks) != 2 || decoded.Hooks[1].Error != "db close failed" {
+		t.Errorf("TestLastReport: report did not round trip through JSON: %s", b)
+	}
+	w.RecordConnState(http.StateClosed)
+}
+
+func TestTimedOut(t *testing.T) {
+	w, _ := NewWatcher(20)
+	if w.TimedOut() {
+		t.Errorf("TestTimedOut: should be false before any shutdown")
+	}
+	w.RecordConnState(http.StateNew)
+	go w.BeginShutdown()
+	w.Wait()
+	if !w.TimedOut() {
+		t.Errorf("TestTimedOut: should be true after a timed out shutdown")
+	}
+	w.RecordConnState(http.StateClosed)
+	w.OnStop()
+	if w.TimedOut() {
+		t.Errorf("TestTimedOut: should reflect the most recent shutdown")
+	}
+}
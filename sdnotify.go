@@ -0,0 +1,46 @@
+package httpdshutdown
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// sdNotify sends state to the systemd notification socket named by $NOTIFY_SOCKET.
+// It does nothing if the variable is not set, that is when the daemon is not run by
+// systemd with `Type=notify`.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	if name[0] == '@' {
+		// An abstract socket.
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	return nil
+}
+
+// NotifyReady tells systemd that the daemon has started up, for a service with
+// `Type=notify`. Call it once the servers are listening. Outside of systemd, that is
+// when $NOTIFY_SOCKET is not set, it does nothing. A watcher sends the matching
+// `STOPPING=1` itself when a shutdown begins.
+//
+// Example use:
+//
+//     ln, err := net.Listen("tcp", ":8080")
+//     ...
+//     httpdshutdown.NotifyReady()
+//     srv.Serve(ln)
+//
+func NotifyReady() error {
+	return sdNotify("READY=1")
+}
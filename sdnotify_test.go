@@ -0,0 +1,56 @@
+package httpdshutdown
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// listenNotify listens on a fake systemd notification socket and points
+// $NOTIFY_SOCKET at it.
+func listenNotify(t *testing.T) *net.UnixConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("readNotify: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	conn := listenNotify(t)
+	defer conn.Close()
+	if err := NotifyReady(); err != nil {
+		t.Fatal(err)
+	}
+	if state := readNotify(t, conn); state != "READY=1" {
+		t.Errorf("TestSdNotify: expected READY=1, got %q", state)
+	}
+	w, _ := NewWatcher(100)
+	if err := w.OnStop(); err != nil {
+		t.Fatal(err)
+	}
+	if state := readNotify(t, conn); state != "STOPPING=1" {
+		t.Errorf("TestSdNotify: expected STOPPING=1, got %q", state)
+	}
+
+	// Without systemd the notification is a no-op.
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := NotifyReady(); err != nil {
+		t.Errorf("TestSdNotify: should be a no-op without NOTIFY_SOCKET, got %v", err)
+	}
+}
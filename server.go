@@ -0,0 +1,474 @@
+package httpdshutdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// attachedServer is an http.Server shut down by the watcher.
+type attachedServer struct {
+	srv     *http.Server
+	timeout time.Duration   // Grace period for Shutdown; zero uses the shutdown's timeout.
+	closing <-chan struct{} // Closed once Shutdown has closed the listeners.
+}
+
+// AttachServer registers srv to be shut down with `http.Server.Shutdown` when a
+// shutdown begins. The server stops accepting connections and gets the watcher's
+// grace period to finish the requests it is serving. Attached servers are shut down
+// concurrently.
+//
+// AttachServer also installs a `ConnState` function on srv that records connections
+// with the watcher, counted per server by `OpenConnsByAddr`, and then calls any
+// `ConnState` function the server already had, and likewise a `ConnContext` function
+// that lets handlers call `MarkCritical`. Attach the server before it starts serving.
+//
+// With servers attached, `OnStop` relies solely on `http.Server.Shutdown` to drain
+// them and does not wait on the watcher's connection count. A server still busy at its
+// deadline is reported as `ErrShutdownTimeout`. The deadline is enforced by
+// Shutdown itself, so `CancelShutdown` cannot interrupt this drain early.
+//
+// `CancelShutdown` cannot undo a server shutdown; a cancelled daemon must serve again
+// with a new server.
+func (w *Watcher) AttachServer(srv *http.Server) error {
+	if w == nil {
+		return fmt.Errorf("AttachServer: %w", ErrNilWatcher)
+	}
+	return w.attachServer("AttachServer", srv, 0)
+}
+
+// AttachServerTimeout behaves like `AttachServer` but gives srv its own grace period,
+// so for example a WebSocket server may be allowed a minute while a REST API only
+// needs a few seconds. `OnStop` returns once every server has finished or reached its
+// own deadline.
+//
+// Example use:
+//
+//     watcher.AttachServerTimeout(wsServer, 60*time.Second)
+//     watcher.AttachServerTimeout(apiServer, 5*time.Second)
+//
+func (w *Watcher) AttachServerTimeout(srv *http.Server, timeout time.Duration) error {
+	if w == nil {
+		return fmt.Errorf("AttachServerTimeout: %w", ErrNilWatcher)
+	}
+	if timeout <= 0 {
+		return errors.New("AttachServerTimeout: timeout must be a positive duration")
+	}
+	return w.attachServer("AttachServerTimeout", srv, timeout)
+}
+
+// ShutdownServer gracefully shuts down srv alone, for example to take a public API
+// offline for maintenance while an admin server keeps serving. srv is detached from
+// the watcher, so a later shutdown leaves it alone, and is shut down with
+// `http.Server.Shutdown` within its own grace period from `AttachServerTimeout` or,
+// if it has none, the watcher's timeout. Other servers and the watcher's state are
+// left running. A server still busy at its deadline is reported as
+// `ErrShutdownTimeout`.
+//
+// Example use:
+//
+//     err := watcher.ShutdownServer(publicServer)
+//
+func (w *Watcher) ShutdownServer(srv *http.Server) error {
+	if w == nil {
+		return fmt.Errorf("ShutdownServer: %w", ErrNilWatcher)
+	}
+	if srv == nil {
+		return errors.New("ShutdownServer: server is nil")
+	}
+	w.mu.Lock()
+	var found []attachedServer
+	for i, s := range w.servers {
+		if s.srv == srv {
+			found = []attachedServer{s}
+			w.servers = append(w.servers[:i:i], w.servers[i+1:]...)
+			break
+		}
+	}
+	w.mu.Unlock()
+	if found == nil {
+		return fmt.Errorf("ShutdownServer: server %q is not attached", srv.Addr)
+	}
+	return w.shutdownServers("ShutdownServer", found, w.timeout)()
+}
+
+// Servers returns the servers attached with `AttachServer` and the like, in the order
+// they were attached, for tooling and tests to verify the wiring. A server detached by
+// `ShutdownServer` or `ReArm` is no longer listed; `Reset` keeps them attached. The
+// slice is a copy; changing it does not attach or detach servers.
+func (w *Watcher) Servers() []*http.Server {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	servers := make([]*http.Server, 0, len(w.servers))
+	for _, s := range w.servers {
+		servers = append(servers, s.srv)
+	}
+	return servers
+}
+
+// Run serves srv with `ListenAndServe` until ctx is done and then performs a graceful
+// shutdown with `BeginShutdown`, returning its result. srv is attached to the
+// watcher if it is not already. If the server fails, for example because its address
+// is in use, Run returns that error without shutting down. Run fits directly into
+// an `errgroup.Group`.
+//
+// Example use:
+//
+//     g, ctx := errgroup.WithContext(ctx)
+//     g.Go(func() error { return watcher.Run(ctx, srv) })
+//
+func (w *Watcher) Run(ctx context.Context, srv *http.Server) error {
+	if w == nil {
+		return fmt.Errorf("Run: %w", ErrNilWatcher)
+	}
+	if err := w.ensureAttached("Run", srv); err != nil {
+		return err
+	}
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.ListenAndServe() }()
+	select {
+	case err := <-serveErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			// Shut down by another route, such as a signal.
+			return nil
+		}
+		return fmt.Errorf("Run: %w", err)
+	case <-ctx.Done():
+	}
+	err := w.BeginShutdown()
+	<-serveErr
+	return err
+}
+
+// RunUntilSignal is the all-in-one entry point for a daemon: it serves srv with
+// `ListenAndServe`, handles signals as `SigHandle` does and blocks until a terminating
+// signal arrives. On SIGTERM, SIGQUIT or SIGHUP it performs the full graceful
+// shutdown, stopping intake, draining srv within the grace period and running the
+// hooks, and returns the exit code for `os.Exit`, as chosen by `WithExitCodeMapper`.
+// srv is attached to the watcher if it is not already.
+//
+// Unlike `SigHandle`, SIGINT does not panic: RunUntilSignal returns at once with 1, or
+// the code set with `WithInterruptExitCode`, without draining. If the server fails,
+// for example because its address is in use, the error is logged and 1 is returned.
+//
+// Example use:
+//
+//     os.Exit(watcher.RunUntilSignal(srv))
+//
+func (w *Watcher) RunUntilSignal(srv *http.Server) int {
+	if w == nil {
+		// panic since the caller passes the result straight to os.Exit
+		panic("RunUntilSignal: receiver is nil")
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP, syscall.SIGINT)
+	defer signal.Stop(sigs)
+	return w.runUntilSignal(srv, srv.ListenAndServe, sigs)
+}
+
+// runUntilSignal implements RunUntilSignal with serve starting srv and sigs
+// delivering the signals, so that tests can serve on a listener of their own and
+// simulate signals.
+func (w *Watcher) runUntilSignal(srv *http.Server, serve func() error, sigs <-chan os.Signal) int {
+	if err := w.ensureAttached("RunUntilSignal", srv); err != nil {
+		w.logf("httpdshutdown: %v", err)
+		return 1
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- serve() }()
+	for {
+		select {
+		case err := <-serveErr:
+			if errors.Is(err, http.ErrServerClosed) {
+				// Shut down by another route, such as BeginShutdown.
+				if err := w.Wait(); err != nil {
+					return 1
+				}
+				return 0
+			}
+			w.logf("httpdshutdown: RunUntilSignal: %v", err)
+			return 1
+		case sig := <-sigs:
+			switch ev := w.handleSignal(sig, sigs); ev.Action {
+			case ActionGraceful:
+				<-serveErr
+				return ev.ExitCode
+			case ActionImmediate:
+				return ev.ExitCode
+			}
+		}
+	}
+}
+
+// serve implements Serve with serve starting srv and sigs delivering the signals, so
+// that tests can serve on a listener of their own and simulate signals.
+func (w *Watcher) serve(srv *http.Server, serve func() error, sigs <-chan os.Signal) error {
+	if err := w.ensureAttached("Serve", srv); err != nil {
+		return err
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- serve() }()
+	for {
+		select {
+		case err := <-serveErr:
+			if errors.Is(err, http.ErrServerClosed) {
+				// Shut down by another route, such as BeginShutdown.
+				return w.Wait()
+			}
+			return fmt.Errorf("Serve: %w", err)
+		case sig := <-sigs:
+			switch ev := w.handleSignal(sig, sigs); ev.Action {
+			case ActionGraceful:
+				<-serveErr
+				return ev.Err
+			case ActionImmediate:
+				return fmt.Errorf("Serve: exiting on %v without draining", sig)
+			}
+		}
+	}
+}
+
+// WithServer layers the watcher onto the common shutdown pattern of
+// `go srv.ListenAndServe(); <-stop; srv.Shutdown(ctx)` without restructuring main.
+// It attaches srv, if it is not already, and returns a cleanup function to call in
+// place of `srv.Shutdown` once the program decides to stop. The cleanup performs a
+// shutdown with `BeginShutdown`, draining srv before running the hooks, and returns
+// when both are done. Its result is available from `Wait` and `LastReport`, and an
+// error is also logged. Call WithServer before srv starts serving.
+//
+// Example use:
+//
+//     cleanup := watcher.WithServer(srv)
+//     go srv.ListenAndServe()
+//     <-stop
+//     cleanup()
+//
+func (w *Watcher) WithServer(srv *http.Server) func() {
+	if w == nil {
+		// panic since the returned func is called without error checking
+		panic("WithServer: receiver is nil")
+	}
+	if err := w.ensureAttached("WithServer", srv); err != nil {
+		panic(err.Error())
+	}
+	return func() {
+		if err := w.BeginShutdown(); err != nil {
+			w.logf("httpdshutdown: shutdown failed: %v", err)
+		}
+	}
+}
+
+// ensureAttached attaches srv unless it is already attached.
+func (w *Watcher) ensureAttached(method string, srv *http.Server) error {
+	if srv == nil {
+		return fmt.Errorf("%s: server is nil", method)
+	}
+	w.mu.Lock()
+	attached := false
+	for _, s := range w.servers {
+		attached = attached || s.srv == srv
+	}
+	w.mu.Unlock()
+	if attached {
+		return nil
+	}
+	return w.attachServer(method, srv, 0)
+}
+
+// attachServer registers srv, reporting errors under the name of the calling method.
+func (w *Watcher) attachServer(method string, srv *http.Server, timeout time.Duration) error {
+	if srv == nil {
+		return fmt.Errorf("%s: server is nil", method)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, s := range w.servers {
+		if s.srv == srv {
+			return fmt.Errorf("%s: server %q is already attached", method, srv.Addr)
+		}
+	}
+	// The callback is registered once per attach, since a server cannot unregister it.
+	w.servers = append(w.servers, attachedServer{srv: srv, timeout: timeout, closing: listenersClosed(srv)})
+	w.addAddrConnLocked(srv.Addr, 0)
+	next, addr := srv.ConnState, srv.Addr
+	srv.ConnState = func(conn net.Conn, newState http.ConnState) {
+		w.recordConn(conn, addr, newState, ShortLived)
+		if next != nil {
+			next(conn, newState)
+		}
+	}
+	nextCtx := srv.ConnContext
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if nextCtx != nil {
+			ctx = nextCtx(ctx, c)
+		}
+		return w.ConnContext(ctx, c)
+	}
+	return nil
+}
+
+// shutdownServers starts shutting down servers concurrently, each with its own grace
+// period or, if it has none, timeout. The returned function waits for all of them and
+// returns their errors, reported under method, joined, with a missed deadline
+// reported as ErrShutdownTimeout. A server is closed once its shutdown returns, so that
+// no connection, even one whose request outlived the deadline, is left open when the
+// hooks run.
+func (w *Watcher) shutdownServers(method string, servers []attachedServer, timeout time.Duration) func() error {
+	if len(servers) == 0 {
+		return func() error { return nil }
+	}
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		d := s.timeout
+		if d == 0 {
+			d = timeout
+		}
+		wg.Add(1)
+		go func(i int, srv *http.Server, d time.Duration) {
+			defer wg.Done()
+			ctx, cancel := withClockDeadline(context.Background(), w.clock, w.clock.Now().Add(d))
+			defer cancel()
+			err := srv.Shutdown(ctx)
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = ErrShutdownTimeout
+				if closed, ok := w.awaitCritical(srv.Addr); ok && closed == 0 {
+					err = nil
+				}
+			}
+			if cerr := srv.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: server %q: %w", method, srv.Addr, err)
+			}
+		}(i, s.srv, d)
+	}
+	return func() error {
+		wg.Wait()
+		return errors.Join(errs...)
+	}
+}
+
+// closeServers closes servers and stops grpcServers at once, without waiting for the
+// requests and RPCs in flight.
+func closeServers(servers []attachedServer, grpcServers []GRPCServer) {
+	for _, s := range servers {
+		s.srv.Close()
+	}
+	for _, s := range grpcServers {
+		s.Stop()
+	}
+}
+
+// listenersClosed returns a channel that is closed once a call to srv's Shutdown has
+// closed its listeners.
+func listenersClosed(srv *http.Server) <-chan struct{} {
+	c := make(chan struct{})
+	var once sync.Once
+	srv.RegisterOnShutdown(func() { once.Do(func() { close(c) }) })
+	return c
+}
+
+// BaseContext returns a function that can be assigned directly to a `http.Server`'s
+// `BaseContext` field, so that the context of every request served is derived from
+// `Context` and is cancelled as soon as a shutdown begins. Long-running handlers,
+// such as streams or long polls, can then watch `r.Context().Done()` and return
+// promptly, letting the drain complete within the grace period. Note that this
+// cancels every request in flight, including those that would have finished within
+// the grace period, so handlers that should be allowed to complete must not give up
+// on cancellation.
+//
+// Example use:
+//
+//     srv := &http.Server{Addr: ":8080", BaseContext: watcher.BaseContext()}
+//     watcher.AttachServer(srv)
+//
+func (w *Watcher) BaseContext() func(net.Listener) context.Context {
+	if w == nil {
+		panic("BaseContext: receiver is nil")
+	}
+	return func(net.Listener) context.Context {
+		return w.Context()
+	}
+}
+
+// GRPCServer is the subset of `*grpc.Server` used by `AttachGRPC`, declared here so
+// the package does not depend on the grpc module.
+type GRPCServer interface {
+	GracefulStop()
+	Stop()
+}
+
+// AttachGRPC registers a gRPC server to be stopped when a shutdown begins, mirroring
+// `AttachServer`. The server's `GracefulStop` gets the watcher's grace period to let
+// pending RPCs finish; if it has not returned by then, `Stop` is called to close the
+// remaining connections, and the shutdown reports `ErrShutdownTimeout`.
+//
+// Example use:
+//
+//     watcher.AttachGRPC(grpcServer)
+//
+func (w *Watcher) AttachGRPC(s GRPCServer) error {
+	if w == nil {
+		return fmt.Errorf("AttachGRPC: %w", ErrNilWatcher)
+	}
+	if s == nil {
+		return errors.New("AttachGRPC: server is nil")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, g := range w.grpcServers {
+		if g == s {
+			return errors.New("AttachGRPC: server is already attached")
+		}
+	}
+	w.grpcServers = append(w.grpcServers, s)
+	return nil
+}
+
+// stopGRPCServers starts stopping servers gracefully and concurrently, falling back
+// to a hard stop for any server that has not finished within timeout. The returned
+// function waits for all of them and returns an error wrapping ErrShutdownTimeout if
+// any had to be stopped hard.
+func (w *Watcher) stopGRPCServers(servers []GRPCServer, timeout time.Duration) func() error {
+	if len(servers) == 0 {
+		return func() error { return nil }
+	}
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func(i int, s GRPCServer) {
+			defer wg.Done()
+			stopped := make(chan struct{})
+			go func() {
+				s.GracefulStop()
+				close(stopped)
+			}()
+			timer, stopTimer := w.clock.After(timeout)
+			defer stopTimer()
+			select {
+			case <-stopped:
+			case <-timer:
+				s.Stop()
+				errs[i] = fmt.Errorf("OnStop: grpc server %d: %w", i, ErrShutdownTimeout)
+			}
+		}(i, s)
+	}
+	return func() error {
+		wg.Wait()
+		return errors.Join(errs...)
+	}
+}
@@ -0,0 +1,999 @@
+package httpdshutdown
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startServer serves handler on a loopback port and returns the server and its URL.
+// attach, if not nil, is called with the server before it starts serving.
+func startServer(t *testing.T, handler http.Handler, attach func(*http.Server) error) (*http.Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Addr: ln.Addr().String(), Handler: handler}
+	if attach != nil {
+		if err := attach(srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go srv.Serve(ln)
+	return srv, "http://" + ln.Addr().String()
+}
+
+// inFlight starts a request to url and waits until the handler has received it.
+func inFlight(t *testing.T, url string, started <-chan struct{}) {
+	t.Helper()
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("request never reached the handler")
+	}
+}
+
+func TestAttachServerTimeout(t *testing.T) {
+	stuckStarted, slowStarted := make(chan struct{}), make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	w, _ := NewWatcher(100)
+	stuck, stuckURL := startServer(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(stuckStarted)
+		<-release
+	}), func(srv *http.Server) error {
+		return w.AttachServerTimeout(srv, 100*time.Millisecond)
+	})
+	// The slow server would miss the watcher's 100ms timeout but has its own.
+	slow, slowURL := startServer(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(slowStarted)
+		time.Sleep(300 * time.Millisecond)
+	}), func(srv *http.Server) error {
+		return w.AttachServerTimeout(srv, 2*time.Second)
+	})
+	defer stuck.Close()
+	defer slow.Close()
+
+	inFlight(t, stuckURL, stuckStarted)
+	inFlight(t, slowURL, slowStarted)
+
+	elapsed, err := w.OnStopTimed()
+	if !errors.Is(err, ErrShutdownTimeout) || !strings.Contains(err.Error(), stuck.Addr) {
+		t.Errorf("TestAttachServerTimeout: expected the stuck server to time out, got %v", err)
+	}
+	if err != nil && strings.Contains(err.Error(), slow.Addr) {
+		t.Errorf("TestAttachServerTimeout: slow server should finish within its grace period, got %v", err)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("TestAttachServerTimeout: OnStop should wait for the slow server, took %v", elapsed)
+	}
+}
+
+func TestShutdownServer(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+	public, publicURL := startServer(t, ok, w.AttachServer)
+	admin, adminURL := startServer(t, ok, w.AttachServer)
+	defer public.Close()
+	defer admin.Close()
+
+	if err := w.ShutdownServer(public); err != nil {
+		t.Fatalf("TestShutdownServer: %v", err)
+	}
+	if _, err := http.Get(publicURL); err == nil {
+		t.Errorf("TestShutdownServer: the public server should be shut down")
+	}
+	resp, err := http.Get(adminURL)
+	if err != nil {
+		t.Fatalf("TestShutdownServer: the admin server should keep serving, got %v", err)
+	}
+	resp.Body.Close()
+	if w.IsDraining() || w.Phase() != PhaseRunning {
+		t.Errorf("TestShutdownServer: the watcher should keep running")
+	}
+	if err := w.ShutdownServer(public); err == nil {
+		t.Errorf("TestShutdownServer: a detached server should be rejected")
+	}
+	if err := w.ShutdownServer(nil); err == nil {
+		t.Errorf("TestShutdownServer: nil server should be rejected")
+	}
+
+	// The full shutdown only shuts down the server still attached.
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestShutdownServer: %v", err)
+	}
+	if _, err := http.Get(adminURL); err == nil {
+		t.Errorf("TestShutdownServer: OnStop should shut down the admin server")
+	}
+	var nilW *Watcher
+	if err := nilW.ShutdownServer(admin); !errors.Is(err, ErrNilWatcher) {
+		t.Errorf("TestShutdownServer: expected ErrNilWatcher, got %v", err)
+	}
+}
+
+func TestServers(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	if got := w.Servers(); len(got) != 0 {
+		t.Errorf("TestServers: expected no servers, got %v", got)
+	}
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+	public, _ := startServer(t, ok, w.AttachServer)
+	admin, _ := startServer(t, ok, func(srv *http.Server) error {
+		return w.AttachServerTimeout(srv, time.Second)
+	})
+	defer public.Close()
+	defer admin.Close()
+
+	got := w.Servers()
+	if len(got) != 2 || got[0] != public || got[1] != admin {
+		t.Errorf("TestServers: expected the attached servers in order, got %v", got)
+	}
+	// The result is a copy.
+	got[0] = nil
+	if w.Servers()[0] != public {
+		t.Errorf("TestServers: changing the result should not detach a server")
+	}
+	if err := w.ShutdownServer(public); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Servers(); len(got) != 1 || got[0] != admin {
+		t.Errorf("TestServers: expected only the admin server, got %v", got)
+	}
+	w.Reset()
+	if got := w.Servers(); len(got) != 1 || got[0] != admin {
+		t.Errorf("TestServers: Reset should keep the admin server, got %v", got)
+	}
+	if err := w.OnStop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.ReArm(); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Servers(); len(got) != 0 {
+		t.Errorf("TestServers: ReArm should detach every server, got %v", got)
+	}
+	var nilW *Watcher
+	if got := nilW.Servers(); got != nil {
+		t.Errorf("TestServers: expected nil, got %v", got)
+	}
+}
+
+func TestAttachServerErrors(t *testing.T) {
+	w, _ := NewWatcher(100)
+	srv := &http.Server{Addr: "127.0.0.1:0"}
+	if err := w.AttachServer(nil); err == nil {
+		t.Errorf("TestAttachServerErrors: nil server should be rejected")
+	}
+	if err := w.AttachServerTimeout(srv, 0); err == nil {
+		t.Errorf("TestAttachServerErrors: zero timeout should be rejected")
+	}
+	if err := w.AttachServer(srv); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AttachServer(srv); err == nil {
+		t.Errorf("TestAttachServerErrors: attaching a server twice should be rejected")
+	}
+	var nw *Watcher
+	if err := nw.AttachServer(srv); !errors.Is(err, ErrNilWatcher) {
+		t.Errorf("TestAttachServerErrors: nil watcher should return ErrNilWatcher, got %v", err)
+	}
+}
+
+func TestAttachServerIgnoresConnCount(t *testing.T) {
+	w, _ := NewWatcher(50)
+	srv, _ := startServer(t, http.NotFoundHandler(), w.AttachServer)
+	defer srv.Close()
+	// A count left behind by a missing StateClosed does not hold up a drain that
+	// relies on http.Server.Shutdown.
+	w.RecordConnState(http.StateNew)
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestAttachServerIgnoresConnCount: should not have an error, got %v", err)
+	}
+	if r := w.LastReport(); r == nil || r.TimedOut {
+		t.Errorf("TestAttachServerIgnoresConnCount: report should not record a timeout")
+	}
+}
+
+func TestAttachServerChaining(t *testing.T) {
+	type ctxKey struct{}
+	w, _ := NewWatcher(1000)
+	var mu sync.Mutex
+	var states []http.ConnState
+	marked := make(chan error, 1)
+	srv, url := startServer(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(ctxKey{}) == nil {
+			t.Errorf("TestAttachServerChaining: the server's own ConnContext was not called")
+		}
+		marked <- w.MarkCritical(r)
+	}), func(srv *http.Server) error {
+		// The application's own metrics hooks, set before the watcher attaches.
+		srv.ConnState = func(conn net.Conn, state http.ConnState) {
+			mu.Lock()
+			defer mu.Unlock()
+			states = append(states, state)
+		}
+		srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, ctxKey{}, true)
+		}
+		return w.AttachServer(srv)
+	})
+	defer srv.Close()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := <-marked; err != nil {
+		t.Errorf("TestAttachServerChaining: the watcher's ConnContext was not called: %v", err)
+	}
+	if w.TotalConns() != 1 {
+		t.Errorf("TestAttachServerChaining: expected the watcher to count the connection, got %d", w.TotalConns())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(states) < 2 || states[0] != http.StateNew || states[1] != http.StateActive {
+		t.Errorf("TestAttachServerChaining: expected the server's own ConnState to be called, got %v", states)
+	}
+}
+
+func TestOnStopOrder(t *testing.T) {
+	var mu sync.Mutex
+	var shutdownAt, finishedAt time.Time
+	stamp := func(at *time.Time) {
+		mu.Lock()
+		*at = time.Now()
+		mu.Unlock()
+	}
+	slowStarted, stuckStarted := make(chan struct{}), make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	w, _ := NewWatcher(200)
+	srv, url := startServer(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stuck" {
+			close(stuckStarted)
+			<-release
+			return
+		}
+		close(slowStarted)
+		time.Sleep(50 * time.Millisecond)
+		stamp(&finishedAt)
+	}), w.AttachServer)
+	defer srv.Close()
+	srv.RegisterOnShutdown(func() { stamp(&shutdownAt) })
+
+	inFlight(t, url+"/slow", slowStarted)
+	// The stuck request is sent on a raw connection so that the test can tell when
+	// the server closes it.
+	stuck, err := net.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	if _, err := stuck.Write([]byte("GET /stuck HTTP/1.1\r\nHost: x\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stuckStarted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestOnStopOrder: stuck request never reached the handler")
+	}
+
+	var hookAt time.Time
+	var refused, closed bool
+	_ = w.RegisterHook(func() error {
+		stamp(&hookAt)
+		if c, err := net.Dial("tcp", srv.Addr); err == nil {
+			c.Close()
+		} else {
+			refused = true
+		}
+		stuck.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := stuck.Read(make([]byte, 1))
+		var ne net.Error
+		closed = err != nil && !(errors.As(err, &ne) && ne.Timeout())
+		return nil
+	})
+	if err := w.OnStop(); !errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("TestOnStopOrder: expected the stuck request to time out, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if shutdownAt.IsZero() || finishedAt.IsZero() || hookAt.IsZero() {
+		t.Fatalf("TestOnStopOrder: missing timestamps: shutdown %v, finished %v, hook %v", shutdownAt, finishedAt, hookAt)
+	}
+	if !shutdownAt.Before(finishedAt) || !finishedAt.Before(hookAt) {
+		t.Errorf("TestOnStopOrder: expected shutdown < drained < hook, got %v, %v, %v", shutdownAt, finishedAt, hookAt)
+	}
+	if !refused {
+		t.Errorf("TestOnStopOrder: new connections should be refused before hooks run")
+	}
+	if !closed {
+		t.Errorf("TestOnStopOrder: the server should close the stuck connection before hooks run")
+	}
+}
+
+func TestOpenConnsByAddr(t *testing.T) {
+	apiStarted := make(chan struct{})
+	release := make(chan struct{})
+	w, _ := NewWatcher(1000)
+	api, apiURL := startServer(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(apiStarted)
+		<-release
+	}), w.AttachServer)
+	admin, _ := startServer(t, http.NotFoundHandler(), w.AttachServer)
+	defer api.Close()
+	defer admin.Close()
+
+	inFlight(t, apiURL, apiStarted)
+	counts := w.OpenConnsByAddr()
+	if len(counts) != 2 || counts[api.Addr] != 1 || counts[admin.Addr] != 0 {
+		t.Errorf("TestOpenConnsByAddr: expected one api conn and a drained admin server, got %v", counts)
+	}
+	close(release)
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestOpenConnsByAddr: should drain without error, got %v", err)
+	}
+	// The server reports StateClosed for conns it closed once Shutdown returns.
+	for i := 0; i < 1000 && w.OpenConnsByAddr()[api.Addr] != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := w.OpenConnsByAddr()[api.Addr]; n != 0 {
+		t.Errorf("TestOpenConnsByAddr: api server should be drained, got %d", n)
+	}
+}
+
+func TestRun(t *testing.T) {
+	hookRan := make(chan struct{})
+	w, _ := NewWatcher(1000, func() error {
+		close(hookRan)
+		return nil
+	})
+	srv := &http.Server{Addr: "127.0.0.1:0", Handler: http.NotFoundHandler()}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- w.Run(ctx, srv) }()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("TestRun: graceful shutdown should not have an error, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestRun: Run did not return after the context was cancelled")
+	}
+	select {
+	case <-hookRan:
+	default:
+		t.Errorf("TestRun: shutdown hooks should run")
+	}
+
+	// A server that cannot listen fails without shutting down.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	w2, _ := NewWatcher(1000)
+	busy := &http.Server{Addr: ln.Addr().String()}
+	err = w2.Run(context.Background(), busy)
+	if err == nil || errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("TestRun: expected a listen error, got %v", err)
+	}
+	if w2.IsDraining() {
+		t.Errorf("TestRun: a failed server should not start a shutdown")
+	}
+}
+
+func TestWithServer(t *testing.T) {
+	started := make(chan struct{})
+	var finished atomic.Bool
+	w, _ := NewWatcher(2000)
+	srv, url := startServer(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		finished.Store(true)
+	}), func(srv *http.Server) error {
+		w.WithServer(srv)
+		return nil
+	})
+	defer srv.Close()
+	hookSawDrain := false
+	_ = w.RegisterHook(func() error {
+		hookSawDrain = finished.Load()
+		return nil
+	})
+	inFlight(t, url, started)
+	cleanup := w.WithServer(srv)
+	cleanup()
+	if !hookSawDrain {
+		t.Errorf("TestWithServer: hooks should run after the request drained")
+	}
+	if err := w.Wait(); err != nil {
+		t.Errorf("TestWithServer: shutdown should not have an error, got %v", err)
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Errorf("TestWithServer: server should be shut down")
+	}
+}
+
+func TestReArm(t *testing.T) {
+	hookCalls := 0
+	w, _ := NewWatcher(1000, func() error {
+		hookCalls++
+		return nil
+	})
+	if err := w.ReArm(); err == nil {
+		t.Errorf("TestReArm: re-arming before a shutdown should be an error")
+	}
+	blue, _ := startServer(t, http.NotFoundHandler(), w.AttachServer)
+	defer blue.Close()
+	if err := w.BeginShutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.ReArm(); err != nil {
+		t.Fatal(err)
+	}
+	if w.IsDraining() || w.Context().Err() != nil {
+		t.Errorf("TestReArm: re-armed watcher should not be draining")
+	}
+	if _, ok := w.OpenConnsByAddr()[blue.Addr]; ok {
+		t.Errorf("TestReArm: the shut down server should be detached")
+	}
+
+	// The green server is tracked and drained like the first.
+	started, release := make(chan struct{}), make(chan struct{})
+	green, greenURL := startServer(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}), w.AttachServer)
+	defer green.Close()
+	inFlight(t, greenURL, started)
+	if n := w.OpenConnsByAddr()[green.Addr]; n != 1 {
+		t.Errorf("TestReArm: green server conns should be counted, got %d", n)
+	}
+	time.AfterFunc(20*time.Millisecond, func() { close(release) })
+	if err := w.BeginShutdown(); err != nil {
+		t.Errorf("TestReArm: second shutdown should not have an error, got %v", err)
+	}
+	if hookCalls != 2 {
+		t.Errorf("TestReArm: hooks should run for each shutdown, got %d", hookCalls)
+	}
+}
+
+func TestBaseContext(t *testing.T) {
+	started := make(chan struct{})
+	w, _ := NewWatcher(5000)
+	srv, url := startServer(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		// A long poll that only ends when its context is cancelled.
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Minute):
+		}
+	}), func(srv *http.Server) error {
+		srv.BaseContext = w.BaseContext()
+		return w.AttachServer(srv)
+	})
+	defer srv.Close()
+	inFlight(t, url, started)
+	elapsed, err := w.OnStopTimed()
+	if err != nil {
+		t.Errorf("TestBaseContext: should drain without error, got %v", err)
+	}
+	if elapsed > 2*time.Second {
+		t.Errorf("TestBaseContext: handler should exit promptly on shutdown, took %v", elapsed)
+	}
+}
+
+// fakeGRPC records which of the GRPCServer methods were called. GracefulStop
+// blocks until release is closed or Stop is called, like a grpc.Server with
+// pending RPCs.
+type fakeGRPC struct {
+	mu       sync.Mutex
+	graceful bool
+	stopped  bool
+	release  chan struct{}
+	stop     chan struct{}
+}
+
+func newFakeGRPC() *fakeGRPC {
+	return &fakeGRPC{release: make(chan struct{}), stop: make(chan struct{})}
+}
+
+func (f *fakeGRPC) GracefulStop() {
+	f.mu.Lock()
+	f.graceful = true
+	f.mu.Unlock()
+	select {
+	case <-f.release:
+	case <-f.stop:
+	}
+}
+
+func (f *fakeGRPC) Stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stopped = true
+	close(f.stop)
+}
+
+func (f *fakeGRPC) calls() (graceful, stopped bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.graceful, f.stopped
+}
+
+func TestAttachGRPC(t *testing.T) {
+	w, _ := NewWatcher(100)
+	idle := newFakeGRPC()
+	close(idle.release)
+	if err := w.AttachGRPC(idle); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AttachGRPC(idle); err == nil {
+		t.Errorf("TestAttachGRPC: attaching a server twice should be rejected")
+	}
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestAttachGRPC: graceful stop should not have an error, got %v", err)
+	}
+	if graceful, stopped := idle.calls(); !graceful || stopped {
+		t.Errorf("TestAttachGRPC: expected only GracefulStop, got graceful=%v stop=%v", graceful, stopped)
+	}
+
+	// A server with stuck RPCs is stopped hard once the grace period expires.
+	w2, _ := NewWatcher(50)
+	stuck := newFakeGRPC()
+	_ = w2.AttachGRPC(stuck)
+	if err := w2.OnStop(); !errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("TestAttachGRPC: expected a timeout, got %v", err)
+	}
+	if graceful, stopped := stuck.calls(); !graceful || !stopped {
+		t.Errorf("TestAttachGRPC: expected GracefulStop then Stop, got graceful=%v stop=%v", graceful, stopped)
+	}
+}
+
+func TestUntrackedConnsWarning(t *testing.T) {
+	const warning = "no connections were ever tracked"
+	get := func(url string) {
+		t.Helper()
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// Replacing ConnState after attaching the server defeats the tracking.
+	w, _ := NewWatcher(100)
+	logger := &testLogger{}
+	_ = w.Configure(WithLogger(logger))
+	srv, url := startServer(t, http.NotFoundHandler(), func(srv *http.Server) error {
+		if err := w.AttachServer(srv); err != nil {
+			return err
+		}
+		srv.ConnState = func(net.Conn, http.ConnState) {}
+		return nil
+	})
+	defer srv.Close()
+	get(url)
+	if w.TotalConns() != 0 {
+		t.Fatalf("TestUntrackedConnsWarning: expected no tracked connections, got %d", w.TotalConns())
+	}
+	if err := w.OnStop(); err != nil {
+		t.Fatal(err)
+	}
+	if !logger.contains(warning) {
+		t.Errorf("TestUntrackedConnsWarning: expected a warning, got %v", logger.lines)
+	}
+
+	// The warning is only logged once.
+	logger.lines = nil
+	if err := w.OnStop(); err != nil {
+		t.Fatal(err)
+	}
+	if logger.contains(warning) {
+		t.Errorf("TestUntrackedConnsWarning: the warning should only be logged once")
+	}
+
+	// A properly attached server tracks its connections.
+	w, _ = NewWatcher(100)
+	logger = &testLogger{}
+	_ = w.Configure(WithLogger(logger))
+	srv, url = startServer(t, http.NotFoundHandler(), w.AttachServer)
+	defer srv.Close()
+	get(url)
+	if err := w.OnStop(); err != nil {
+		t.Fatal(err)
+	}
+	if w.TotalConns() == 0 || logger.contains(warning) {
+		t.Errorf("TestUntrackedConnsWarning: tracked connections should not warn, got %d conns and %v",
+			w.TotalConns(), logger.lines)
+	}
+}
+
+func TestRunUntilSignal(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		rw.Write([]byte("done"))
+	}))
+	defer ts.Close()
+	w, _ := NewWatcher(2000)
+	var hookRan atomic.Bool
+	_ = w.RegisterHook(func() error {
+		hookRan.Store(true)
+		return nil
+	})
+	sigs := make(chan os.Signal, 1)
+	code := make(chan int, 1)
+	go func() {
+		code <- w.runUntilSignal(ts.Config, func() error { return ts.Config.Serve(ts.Listener) }, sigs)
+	}()
+
+	// A request in flight when SIGTERM arrives completes before the exit code is
+	// returned.
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ts.Listener.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestRunUntilSignal: request never reached the handler")
+	}
+	sigs <- syscall.SIGTERM
+	select {
+	case c := <-code:
+		t.Fatalf("TestRunUntilSignal: returned %d with a request in flight", c)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case c := <-code:
+		if c != 0 {
+			t.Errorf("TestRunUntilSignal: expected exit code 0, got %d", c)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestRunUntilSignal: did not return after SIGTERM")
+	}
+	if b := <-body; b != "done" {
+		t.Errorf("TestRunUntilSignal: request in flight should complete, got %q", b)
+	}
+	if !hookRan.Load() {
+		t.Errorf("TestRunUntilSignal: hooks should run")
+	}
+
+	// A server that cannot serve exits with 1.
+	w, _ = NewWatcher(100)
+	if c := w.RunUntilSignal(&http.Server{Addr: "127.0.0.1:-1"}); c != 1 {
+		t.Errorf("TestRunUntilSignal: expected exit code 1 for a failing server, got %d", c)
+	}
+}
+
+func TestServe(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		rw.Write([]byte("done"))
+	}))
+	defer ts.Close()
+	w, _ := NewWatcher(2000)
+	var hookRan atomic.Bool
+	_ = w.RegisterHook(func() error {
+		hookRan.Store(true)
+		return nil
+	})
+	sigs := make(chan os.Signal, 1)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- w.serve(ts.Config, func() error { return ts.Config.Serve(ts.Listener) }, sigs)
+	}()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ts.Listener.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestServe: request never reached the handler")
+	}
+	sigs <- syscall.SIGTERM
+	select {
+	case err := <-errc:
+		t.Fatalf("TestServe: returned with a request in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("TestServe: expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestServe: did not return after SIGTERM")
+	}
+	if b := <-body; b != "done" {
+		t.Errorf("TestServe: request in flight should complete, got %q", b)
+	}
+	if !hookRan.Load() || w.OpenConns() != 0 || w.TotalConns() == 0 {
+		t.Errorf("TestServe: expected a tracked, drained server and the hooks run")
+	}
+
+	// SIGINT returns at once without draining.
+	ts = httptest.NewUnstartedServer(http.NotFoundHandler())
+	defer ts.Close()
+	w, _ = NewWatcher(2000)
+	go func() {
+		errc <- w.serve(ts.Config, func() error { return ts.Config.Serve(ts.Listener) }, sigs)
+	}()
+	sigs <- syscall.SIGINT
+	if err := <-errc; err == nil || w.IsDraining() {
+		t.Errorf("TestServe: expected SIGINT to return an error without draining, got %v", err)
+	}
+
+	// A server that cannot serve is an error.
+	if err := Serve(&http.Server{Addr: "127.0.0.1:-1"}); err == nil {
+		t.Errorf("TestServe: expected an error for a failing server")
+	}
+}
+
+func TestWithHookTiming(t *testing.T) {
+	w, _ := NewWatcher(100)
+	if err := w.Configure(WithHookTiming(HookTiming(7))); err == nil {
+		t.Errorf("TestWithHookTiming: unknown timing should be rejected")
+	}
+	for _, c := range []struct {
+		timing        HookTiming
+		servedAtHooks bool
+	}{
+		{AfterServerClose, true},
+		{BeforeServerClose, false},
+	} {
+		w, _ := NewWatcher(2000)
+		if err := w.Configure(WithHookTiming(c.timing)); err != nil {
+			t.Fatal(err)
+		}
+		started := make(chan struct{})
+		var served atomic.Bool
+		srv, url := startServer(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			served.Store(true)
+		}), w.AttachServer)
+		defer srv.Close()
+		inFlight(t, url, started)
+
+		var servedAtHooks, refused bool
+		_ = w.RegisterHook(func() error {
+			servedAtHooks = served.Load()
+			if conn, err := net.Dial("tcp", srv.Addr); err == nil {
+				conn.Close()
+			} else {
+				refused = true
+			}
+			return nil
+		})
+		if err := w.OnStop(); err != nil {
+			t.Errorf("TestWithHookTiming: %d: should not have an error, got %v", c.timing, err)
+		}
+		if servedAtHooks != c.servedAtHooks {
+			t.Errorf("TestWithHookTiming: %d: request served when hooks ran: expected %v, got %v",
+				c.timing, c.servedAtHooks, servedAtHooks)
+		}
+		if !refused {
+			t.Errorf("TestWithHookTiming: %d: the server should stop accepting before hooks run", c.timing)
+		}
+		if !served.Load() {
+			t.Errorf("TestWithHookTiming: %d: the request in flight should complete", c.timing)
+		}
+	}
+}
+
+func TestHookTimingRegistersOnce(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	w.Configure(WithHookTiming(BeforeServerClose))
+	srv, url := startServer(t, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), w.AttachServer)
+	defer srv.Close()
+	// A request served means the server has finished setting itself up.
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// http.Server keeps every RegisterOnShutdown callback for its lifetime; its own
+	// HTTP/2 support registers one too.
+	callbacks := func() int { return reflect.ValueOf(srv).Elem().FieldByName("onShutdown").Len() }
+	before := callbacks()
+	for i := 0; i < 3; i++ {
+		if err := w.OnStop(); err != nil {
+			t.Errorf("TestHookTimingRegistersOnce: %v", err)
+		}
+		w.Reset()
+	}
+	if n := callbacks(); n != before {
+		t.Errorf("TestHookTimingRegistersOnce: shutdown callbacks grew from %d to %d", before, n)
+	}
+}
+
+func TestRegisterPostCloseHook(t *testing.T) {
+	for _, timing := range []HookTiming{AfterServerClose, BeforeServerClose} {
+		w, _ := NewWatcher(2000)
+		if err := w.Configure(WithHookTiming(timing)); err != nil {
+			t.Fatal(err)
+		}
+		var mu sync.Mutex
+		stamps := map[string]time.Time{}
+		stamp := func(event string) {
+			mu.Lock()
+			defer mu.Unlock()
+			stamps[event] = time.Now()
+		}
+		started := make(chan struct{})
+		srv, url := startServer(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			stamp("served")
+		}), w.AttachServer)
+		defer srv.Close()
+		inFlight(t, url, started)
+
+		// Registered first, the post-close hook still runs last.
+		_ = w.RegisterPostCloseHook("stapler", func() error {
+			stamp("stapler")
+			return nil
+		})
+		_ = w.RegisterNamedHook("flush", func() error {
+			stamp("flush")
+			return nil
+		})
+		if err := w.OnStop(); err != nil {
+			t.Errorf("TestRegisterPostCloseHook: %d: %v", timing, err)
+		}
+		if !stamps["stapler"].After(stamps["served"]) || !stamps["stapler"].After(stamps["flush"]) {
+			t.Errorf("TestRegisterPostCloseHook: %d: the post-close hook should run after the server "+
+				"closed and the other hooks, got %v", timing, stamps)
+		}
+		if timing == BeforeServerClose && !stamps["flush"].Before(stamps["served"]) {
+			t.Errorf("TestRegisterPostCloseHook: the other hooks should run during the drain, got %v", stamps)
+		}
+		if names := w.LastReport().Hooks; len(names) != 2 || names[1].Name != "stapler" {
+			t.Errorf("TestRegisterPostCloseHook: %d: expected the post-close hook reported last, got %+v",
+				timing, names)
+		}
+	}
+
+	w, _ := NewWatcher(100)
+	if err := w.RegisterPostCloseHook("", sampleShutdownHook); err == nil {
+		t.Errorf("TestRegisterPostCloseHook: an empty name should be rejected")
+	}
+	if err := w.RegisterPostCloseHook("stapler", nil); err == nil {
+		t.Errorf("TestRegisterPostCloseHook: a nil hook should be rejected")
+	}
+	var nilW *Watcher
+	if err := nilW.RegisterPostCloseHook("stapler", sampleShutdownHook); !errors.Is(err, ErrNilWatcher) {
+		t.Errorf("TestRegisterPostCloseHook: expected ErrNilWatcher, got %v", err)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	const warning = "HTTP/2 connection is counted manually"
+	newH2Server := func(handler http.Handler, setup func(*http.Server) error) *httptest.Server {
+		t.Helper()
+		ts := httptest.NewUnstartedServer(handler)
+		ts.EnableHTTP2 = true
+		if err := setup(ts.Config); err != nil {
+			t.Fatal(err)
+		}
+		ts.StartTLS()
+		return ts
+	}
+
+	// Counting an h2 server's connections manually logs a warning.
+	w, _ := NewWatcher(1000)
+	logger := &testLogger{}
+	_ = w.Configure(WithLogger(logger))
+	ts := newH2Server(http.NotFoundHandler(), func(srv *http.Server) error {
+		srv.ConnState = w.ConnStateHook()
+		return nil
+	})
+	resp, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	ts.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("TestHTTP2: expected HTTP/2, got %s", resp.Proto)
+	}
+	if !logger.contains(warning) {
+		t.Errorf("TestHTTP2: expected a warning for manual counting, got %v", logger.lines)
+	}
+
+	// An attached h2 server drains its streams with GOAWAY. The server closes the
+	// connection up to a second after the final GOAWAY, so allow for that.
+	w, _ = NewWatcher(5000)
+	logger = &testLogger{}
+	_ = w.Configure(WithLogger(logger))
+	started := make(chan struct{}, 3)
+	ts = newH2Server(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		time.Sleep(100 * time.Millisecond)
+		rw.Write([]byte("done"))
+	}), w.AttachServer)
+	defer ts.Close()
+	client := ts.Client()
+	// Warm up a single connection, so that both streams share it.
+	if resp, err := client.Head(ts.URL); err == nil {
+		resp.Body.Close()
+	}
+	<-started
+	bodies := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, err := client.Get(ts.URL)
+			if err != nil {
+				bodies <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			bodies <- resp.Proto + " " + string(b)
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(2 * time.Second):
+			t.Fatal("TestHTTP2: requests never reached the handler")
+		}
+	}
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestHTTP2: attached h2 server should drain, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if b := <-bodies; b != "HTTP/2.0 done" {
+			t.Errorf("TestHTTP2: streams in flight should complete, got %q", b)
+		}
+	}
+	if logger.contains(warning) {
+		t.Errorf("TestHTTP2: attached servers should not warn")
+	}
+}
@@ -0,0 +1,452 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// SigHandle is an example of a typical signal handler that will attempt a graceful shutdown
+// for a set of known signals. The first argument is your signal channel, and the second
+// argument is the channel that can be polled for exit status codes.
+//
+// This should be called prior to starting your http daemon. Place it in its own goroutine
+// so signals can be recorded after the daemon has taken over control of the main thread.
+//
+// SIGINT panics by default. Configure `WithInterruptExitCode` to have the code sent on
+// exitcode instead.
+//
+// A second terminating signal, such as SIGTERM or SIGINT, while the first one's
+// shutdown is still draining escalates the shutdown for an operator who has run out of
+// patience: the drain stops waiting, attached servers are closed, every identified
+// connection is force-closed, the hooks and timeout hooks are skipped, and only the
+// finalizers run before the exit code, that of a failed shutdown, is sent. The
+// shutdown returns an error wrapping `ErrShutdownEscalated`. Once the hooks have
+// started, a further signal no longer interrupts them. The same policy applies to
+// `Signals`, `RunUntilSignal` and `Serve`, although the escalating signal itself emits
+// no `ShutdownEvent`.
+//
+// SigHandle returns once sigs is closed, and then closes exitcode, so a reader blocked
+// on it wakes up. A reader can tell that no terminating signal arrived by receiving
+// with `code, ok := <-exitcode`, where ok is false. Since SigHandle closes it, exitcode
+// must not be shared with another sender.
+//
+// Example use:
+//
+//         go func() {
+//                 sigs := make(chan os.Signal, 1)
+//                 exitcode := make(chan int, 1)
+//                 signal.Notify(sigs)
+//                 go watcher.SigHandle(sigs, exitcode)
+//                 code := <-exitcode
+//                 log.Printf("exit with code:%d", code)
+//                 os.Exit(code)
+// 	}()
+func (w *Watcher) SigHandle(sigs <-chan os.Signal, exitcode chan<- int) {
+	if w == nil {
+		// panic since this will typically be launched as a goroutine.
+		panic("SigHandler: Watcher is nil")
+	}
+	defer w.notifyPanic()
+	for sig := range sigs {
+		if code, terminal := w.dispatchSignal(sig, sigs); terminal {
+			exitcode <- code
+		}
+	}
+	// Wake a reader blocked on exitcode rather than leaving it waiting forever.
+	close(exitcode)
+}
+
+// SigHandleAll is like `SigHandle`, but a terminating signal stops all of watchers
+// concurrently, so a single signal handler can drive both library-provided watchers
+// and the application's own. The exit code is 1 if any of them fails to stop cleanly.
+// The watchers share the longest of their timeouts, as with `NewCompositeWatcher`;
+// signal actions and options must be configured on the composite rather than on the
+// individual watchers, so SIGINT panics.
+//
+// Example use:
+//
+//     go httpdshutdown.SigHandleAll(sigs, exitcode, cacheWatcher, watcher)
+//
+func SigHandleAll(sigs <-chan os.Signal, exitcode chan<- int, watchers ...*Watcher) {
+	NewCompositeWatcher(watchers...).SigHandle(sigs, exitcode)
+}
+
+// OnSignal registers an action to run when `SigHandle` receives sig, turning the
+// signal loop into a general purpose signal router; for example SIGUSR1 could dump
+// goroutine stacks and SIGUSR2 could rotate logs. A registered action replaces the
+// built-in behavior for that signal and never terminates the daemon; the error it
+// returns is ignored. Signals without a registered action keep the default
+// graceful, immediate or ignore behavior. Passing a nil action removes a
+// registration.
+//
+// Example use:
+//
+//    watcher.OnSignal(syscall.SIGUSR2, func() error {
+//            return logger.Rotate()
+//    })
+//
+func (w *Watcher) OnSignal(sig os.Signal, action func() error) error {
+	if w == nil {
+		return fmt.Errorf("OnSignal: %w", ErrNilWatcher)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if action == nil {
+		delete(w.sigActions, sig)
+		return nil
+	}
+	if w.sigActions == nil {
+		w.sigActions = make(map[os.Signal]func() error)
+	}
+	w.sigActions[sig] = action
+	return nil
+}
+
+// SetPanicHandler sets a function that is called with the value of any panic in
+// `SigHandle` or `Signals`, such as the default SIGINT panic or a panic in a hook,
+// before the panic continues. Since these run in their own goroutines, this is the
+// only chance for an application to log the panic to its own system before the
+// process crashes. Passing nil removes the handler.
+func (w *Watcher) SetPanicHandler(handler func(interface{})) error {
+	if w == nil {
+		return fmt.Errorf("SetPanicHandler: %w", ErrNilWatcher)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.panicHandler = handler
+	return nil
+}
+
+// notifyPanic passes a panic in progress to the panic handler, if any, and then
+// continues panicking. It must be deferred.
+func (w *Watcher) notifyPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	w.mu.Lock()
+	handler := w.panicHandler
+	w.mu.Unlock()
+	if handler != nil {
+		handler(r)
+	}
+	panic(r)
+}
+
+// SetUnhandledSignalHandler sets a function that `SigHandle` calls with every signal
+// that has neither a built-in behavior nor an action registered with `OnSignal`, so
+// applications can observe signals such as SIGWINCH or SIGCHLD. By default such
+// signals are ignored. Passing nil restores the default.
+func (w *Watcher) SetUnhandledSignalHandler(handler func(os.Signal)) error {
+	if w == nil {
+		return fmt.Errorf("SetUnhandledSignalHandler: %w", ErrNilWatcher)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.unhandledSig = handler
+	return nil
+}
+
+// SignalAction describes what the watcher did in response to a signal.
+type SignalAction int
+
+const (
+	// ActionIgnored means the signal has no behavior; it was passed to the handler
+	// set with `SetUnhandledSignalHandler`, if any.
+	ActionIgnored SignalAction = iota
+	// ActionCustom means an action registered with `OnSignal` was run.
+	ActionCustom
+	// ActionGraceful means a graceful shutdown was performed with `OnStop`.
+	ActionGraceful
+	// ActionImmediate means the daemon should exit at once without draining.
+	ActionImmediate
+)
+
+// String returns a lower case name for the action.
+func (a SignalAction) String() string {
+	switch a {
+	case ActionIgnored:
+		return "ignored"
+	case ActionCustom:
+		return "custom"
+	case ActionGraceful:
+		return "graceful"
+	case ActionImmediate:
+		return "immediate"
+	}
+	return fmt.Sprintf("SignalAction(%d)", int(a))
+}
+
+// ShutdownEvent describes the handling of a single signal.
+type ShutdownEvent struct {
+	Signal   os.Signal    // The signal received.
+	Action   SignalAction // What the watcher did in response.
+	ExitCode int          // Suggested exit code for ActionGraceful and ActionImmediate.
+	Err      error        // Error from OnStop or a custom action, if any.
+}
+
+// Signals handles each signal received on sigs like `SigHandle`, but rather than
+// deciding when to exit it emits a `ShutdownEvent` for every signal, leaving policy
+// to the caller. SIGINT is reported as ActionImmediate instead of panicking, with the
+// code set by `WithInterruptExitCode` or 1. The returned channel is closed once sigs
+// is closed.
+//
+// Example use:
+//
+//     sigs := make(chan os.Signal, 1)
+//     signal.Notify(sigs)
+//     for ev := range watcher.Signals(sigs) {
+//             if ev.Action == httpdshutdown.ActionGraceful || ev.Action == httpdshutdown.ActionImmediate {
+//                     flushMetrics()
+//                     os.Exit(ev.ExitCode)
+//             }
+//     }
+//
+func (w *Watcher) Signals(sigs <-chan os.Signal) <-chan ShutdownEvent {
+	if w == nil {
+		panic("Signals: receiver is nil")
+	}
+	events := make(chan ShutdownEvent, 1)
+	go func() {
+		defer close(events)
+		defer w.notifyPanic()
+		for sig := range sigs {
+			events <- w.handleSignal(sig, sigs)
+		}
+	}()
+	return events
+}
+
+// ShutdownResult is the outcome of a graceful shutdown triggered by a signal, passed
+// to the function set with `WithExitCodeMapper`.
+type ShutdownResult struct {
+	Err      error           // Error returned by OnStop, if any.
+	TimedOut bool            // Whether the drain exceeded the grace period.
+	Report   *ShutdownReport // Report of the shutdown, if it completed.
+}
+
+// defaultExitCode is the exit code mapper used unless one is configured: 0 for a clean
+// shutdown and 1 otherwise.
+func defaultExitCode(sig os.Signal, result ShutdownResult) int {
+	if result.Err != nil {
+		return 1
+	}
+	return 0
+}
+
+// dispatchSignal performs the action for a single signal, with later signals of
+// sigs, if not nil, handled by handleSignal during a graceful shutdown. For a signal
+// that terminates the daemon it returns the code the caller should exit with and
+// terminal set to true. Keeping this separate from SigHandle lets tests assert the
+// behavior for each signal without delivering real OS signals.
+func (w *Watcher) dispatchSignal(sig os.Signal, sigs <-chan os.Signal) (exitCode int, terminal bool) {
+	ev := w.handleSignal(sig, sigs)
+	switch ev.Action {
+	case ActionImmediate:
+		w.mu.Lock()
+		clean := w.interruptExit
+		w.mu.Unlock()
+		if !clean {
+			// Unclean shutdown with panic message.
+			panic("panic exit")
+		}
+		return ev.ExitCode, true
+	case ActionGraceful:
+		return ev.ExitCode, true
+	}
+	return 0, false
+}
+
+// handleSignal performs the action for a single signal, except that an immediate
+// exit is only reported and left to the caller. While a graceful shutdown runs, the
+// signals arriving on sigs, if not nil, are handled by signalDuringStop.
+func (w *Watcher) handleSignal(sig os.Signal, sigs <-chan os.Signal) ShutdownEvent {
+	ev := ShutdownEvent{Signal: sig}
+	w.mu.Lock()
+	action := w.sigActions[sig]
+	switch sig {
+	case syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP, syscall.SIGINT:
+		// The grace period counts from the first terminating signal, even if an
+		// action delays the shutdown.
+		if w.signalAt.IsZero() {
+			w.signalAt = w.clock.Now()
+		}
+	}
+	w.mu.Unlock()
+	if action != nil {
+		// Errors from custom actions are not fatal to the daemon.
+		ev.Action, ev.Err = ActionCustom, action()
+		return ev
+	}
+	switch sig {
+	case syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP:
+		// The signals that terminate the daemon.
+		ev.Action = ActionGraceful
+		ev.Err = w.stopWatchingSignals(sigs)
+		w.mu.Lock()
+		mapper := w.exitCodeMapper
+		w.mu.Unlock()
+		if mapper == nil {
+			mapper = defaultExitCode
+		}
+		ev.ExitCode = mapper(sig, ShutdownResult{
+			Err:      ev.Err,
+			TimedOut: errors.Is(ev.Err, ErrShutdownTimeout),
+			Report:   w.LastReport(),
+		})
+	case syscall.SIGINT:
+		ev.Action, ev.ExitCode = ActionImmediate, 1
+		w.mu.Lock()
+		if w.interruptExit {
+			ev.ExitCode = w.interruptCode
+		}
+		w.mu.Unlock()
+	default:
+		w.mu.Lock()
+		unhandled := w.unhandledSig
+		w.mu.Unlock()
+		if unhandled != nil {
+			unhandled(sig)
+		}
+	}
+	if ev.Action == ActionGraceful || ev.Action == ActionImmediate {
+		w.publishExitCode(ev.ExitCode)
+	}
+	return ev
+}
+
+// stopWatchingSignals runs OnStop while handling the signals that arrive on sigs
+// meanwhile with signalDuringStop, so that a second terminating signal can escalate
+// the shutdown.
+func (w *Watcher) stopWatchingSignals(sigs <-chan os.Signal) error {
+	if sigs == nil {
+		return w.OnStop()
+	}
+	stopped, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case sig, ok := <-sigs:
+				if !ok {
+					return
+				}
+				w.signalDuringStop(sig)
+			case <-stopped:
+				return
+			}
+		}
+	}()
+	err := w.OnStop()
+	close(stopped)
+	<-done
+	return err
+}
+
+// signalDuringStop handles a signal received while a graceful shutdown runs: an
+// action registered with OnSignal runs as usual, a terminating signal escalates the
+// shutdown, and any other signal goes to the unhandled signal handler.
+func (w *Watcher) signalDuringStop(sig os.Signal) {
+	w.mu.Lock()
+	action, unhandled := w.sigActions[sig], w.unhandledSig
+	w.mu.Unlock()
+	switch {
+	case action != nil:
+		action()
+	case sig == syscall.SIGTERM || sig == syscall.SIGQUIT || sig == syscall.SIGHUP || sig == syscall.SIGINT:
+		w.escalate(sig)
+	case unhandled != nil:
+		unhandled(sig)
+	}
+}
+
+// escalate cuts short the drain of the shutdown in progress on sig with
+// escalateStop. Once the hooks have started it only logs sig.
+func (w *Watcher) escalate(sig os.Signal) {
+	w.mu.Lock()
+	escalation := w.escalation
+	w.mu.Unlock()
+	if !w.escalateStop(escalation) {
+		w.logf("httpdshutdown: ignoring %v while the shutdown hooks run", sig)
+		return
+	}
+	w.logf("httpdshutdown: %v during the drain; closing every connection and skipping the hooks", sig)
+}
+
+// escalateStop cuts short the drain of the shutdown whose escalation channel is
+// escalation: the drain stops waiting, and the attached servers and identified
+// connections are closed, as are those of child watchers. It returns false, doing
+// nothing, if the watcher is no longer draining.
+func (w *Watcher) escalateStop(escalation chan struct{}) bool {
+	w.mu.Lock()
+	if escalation == nil || w.phase != PhaseDraining {
+		w.mu.Unlock()
+		return false
+	}
+	select {
+	case <-escalation:
+	default:
+		close(escalation)
+	}
+	if escalation == w.escalation {
+		w.endWaitsLocked()
+	}
+	servers := append([]attachedServer{}, w.servers...)
+	grpcServers := append([]GRPCServer{}, w.grpcServers...)
+	children := append([]*Watcher{}, w.children...)
+	w.mu.Unlock()
+	closeServers(servers, grpcServers)
+	w.forceCloseConns(nil)
+	for _, c := range children {
+		c.mu.Lock()
+		childEscalation := c.escalation
+		c.mu.Unlock()
+		c.escalateStop(childEscalation)
+	}
+	return true
+}
+
+// Subscribe returns a channel that receives the exit code chosen for the next
+// terminating signal handled by `SigHandle`, `Signals` or `RunUntilSignal`, exactly
+// once, and is then closed. Every call returns a new channel, so independent
+// subsystems of a composed binary can each learn the outcome of the shutdown, in
+// addition to the single consumer of SigHandle's exitcode channel. Subscribing after
+// the code has been published delivers it at once. `Reset` and `ReArm` forget a
+// published code.
+//
+// Example use:
+//
+//     codes := watcher.Subscribe()
+//     go func() {
+//             metrics.Flush(fmt.Sprintf("exit code %d", <-codes))
+//     }()
+//
+func (w *Watcher) Subscribe() <-chan int {
+	if w == nil {
+		return nil
+	}
+	c := make(chan int, 1)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.exitCode != nil {
+		c <- *w.exitCode
+		close(c)
+		return c
+	}
+	w.exitSubs = append(w.exitSubs, c)
+	return c
+}
+
+// publishExitCode delivers code to every subscriber and records it for late ones.
+func (w *Watcher) publishExitCode(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.exitCode = &code
+	for _, c := range w.exitSubs {
+		c <- code
+		close(c)
+	}
+	w.exitSubs = nil
+}
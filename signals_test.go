@@ -0,0 +1,439 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDispatchSignal(t *testing.T) {
+	w, wErr := NewWatcher(10, sampleShutdownHook)
+	if w == nil || wErr != nil {
+		t.Fatalf("TestDispatchSignal: should not be nil")
+	}
+	for _, sig := range []os.Signal{syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP} {
+		code, terminal := w.dispatchSignal(sig, nil)
+		if code != 0 || !terminal {
+			t.Errorf("TestDispatchSignal: %v should exit 0, got %d %v", sig, code, terminal)
+		}
+	}
+	w.RecordConnState(http.StateNew)
+	if code, terminal := w.dispatchSignal(syscall.SIGTERM, nil); code != 1 || !terminal {
+		t.Errorf("TestDispatchSignal: timed out SIGTERM should exit 1, got %d %v", code, terminal)
+	}
+	w.RecordConnState(http.StateClosed)
+	if code, terminal := w.dispatchSignal(syscall.SIGUSR1, nil); code != 0 || terminal {
+		t.Errorf("TestDispatchSignal: SIGUSR1 should be ignored, got %d %v", code, terminal)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("TestDispatchSignal: SIGINT should panic")
+			}
+		}()
+		w.dispatchSignal(syscall.SIGINT, nil)
+	}()
+}
+
+func TestSigHandle(t *testing.T) {
+	w, wErr := NewWatcher(10)
+	if w == nil || wErr != nil {
+		t.Fatalf("TestSigHandle: should not be nil")
+	}
+	sigs := make(chan os.Signal, 2)
+	exitcode := make(chan int, 2)
+	w.RecordConnState(http.StateNew)
+	sigs <- syscall.SIGUSR1
+	sigs <- syscall.SIGTERM
+	close(sigs)
+	w.SigHandle(sigs, exitcode)
+	if code := <-exitcode; code != 1 {
+		t.Errorf("TestSigHandle: expected exit code 1, got %d", code)
+	}
+	if len(exitcode) != 0 {
+		t.Errorf("TestSigHandle: expected a single exit code")
+	}
+}
+
+func TestSigHandleEscalation(t *testing.T) {
+	w, _ := NewWatcher(10000)
+	hookRan, finalized := false, false
+	_ = w.RegisterHook(func() error {
+		hookRan = true
+		return nil
+	})
+	_ = w.RegisterFinalizer(func() error {
+		finalized = true
+		return nil
+	})
+	// The connection never closes, so the drain would take the full 10s.
+	w.RecordConnState(http.StateNew)
+	sigs := make(chan os.Signal, 1)
+	exitcode := make(chan int, 1)
+	go w.SigHandle(sigs, exitcode)
+	start := time.Now()
+	sigs <- syscall.SIGTERM
+	for !w.IsDraining() {
+		time.Sleep(time.Millisecond)
+	}
+	sigs <- syscall.SIGTERM
+
+	select {
+	case code := <-exitcode:
+		if code != 1 {
+			t.Errorf("TestSigHandleEscalation: expected exit code 1, got %d", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestSigHandleEscalation: the second SIGTERM did not cut the drain short")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("TestSigHandleEscalation: expected an immediate exit, took %v", elapsed)
+	}
+	if err := w.Wait(); !errors.Is(err, ErrShutdownEscalated) {
+		t.Errorf("TestSigHandleEscalation: expected ErrShutdownEscalated, got %v", err)
+	}
+	if hookRan || !finalized {
+		t.Errorf("TestSigHandleEscalation: expected only the finalizers to run, hook %v, finalizer %v",
+			hookRan, finalized)
+	}
+	close(sigs)
+}
+
+func TestSignalRacesBeginShutdown(t *testing.T) {
+	triggers := map[string]func(w *Watcher) error{
+		"signal": func(w *Watcher) error {
+			code, _ := w.dispatchSignal(syscall.SIGTERM, nil)
+			if code != 0 {
+				return errors.New("signal: unexpected exit code")
+			}
+			return nil
+		},
+		"BeginShutdown": (*Watcher).BeginShutdown,
+		"OnStop":        (*Watcher).OnStop,
+		"OnStopTimeout": func(w *Watcher) error { return w.OnStopTimeout(time.Second) },
+		"OnStopDeadline": func(w *Watcher) error {
+			return w.OnStopDeadline(time.Now().Add(time.Second))
+		},
+		"OnStopInterruptible": func(w *Watcher) error { return w.OnStopInterruptible(nil) },
+		"OnStopWith":          func(w *Watcher) error { return w.OnStopWith() },
+		// DrainOnly runs no hooks of its own, so it only ever joins here.
+		"DrainOnly": (*Watcher).DrainOnly,
+	}
+	for first := range triggers {
+		if first == "DrainOnly" {
+			continue
+		}
+		var hookCalls atomic.Int32
+		w, _ := NewWatcher(1000, func() error {
+			hookCalls.Add(1)
+			return nil
+		})
+		// An open connection holds the first shutdown open while the others arrive.
+		w.RecordConnState(http.StateNew)
+		errs := make(chan error, len(triggers))
+		var wg sync.WaitGroup
+		start := func(name string) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- triggers[name](w)
+			}()
+		}
+		start(first)
+		waitDraining(t, w)
+		for name := range triggers {
+			if name != first {
+				start(name)
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.RecordConnState(http.StateClosed)
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Errorf("TestSignalRacesBeginShutdown: %s first: %v", first, err)
+			}
+		}
+		if n := hookCalls.Load(); n != 1 {
+			t.Errorf("TestSignalRacesBeginShutdown: %s first: hooks should run once, got %d calls", first, n)
+		}
+	}
+}
+
+func TestSigHandleAll(t *testing.T) {
+	var hooks [2]bool
+	lib, _ := NewWatcher(10, func() error {
+		hooks[0] = true
+		return nil
+	})
+	app, _ := NewWatcher(10, func() error {
+		hooks[1] = true
+		return nil
+	})
+	sigs := make(chan os.Signal, 1)
+	exitcode := make(chan int, 1)
+	sigs <- syscall.SIGTERM
+	close(sigs)
+	SigHandleAll(sigs, exitcode, lib, app)
+	if code := <-exitcode; code != 0 {
+		t.Errorf("TestSigHandleAll: expected exit code 0, got %d", code)
+	}
+	if !hooks[0] || !hooks[1] || !lib.IsDraining() || !app.IsDraining() {
+		t.Errorf("TestSigHandleAll: every watcher should be drained, hooks ran %v", hooks)
+	}
+
+	// A single watcher failing to drain fails the exit code.
+	lib.Reset()
+	app.Reset()
+	app.RecordConnState(http.StateNew)
+	sigs, exitcode = make(chan os.Signal, 1), make(chan int, 1)
+	sigs <- syscall.SIGTERM
+	close(sigs)
+	SigHandleAll(sigs, exitcode, lib, app)
+	if code := <-exitcode; code != 1 {
+		t.Errorf("TestSigHandleAll: expected exit code 1, got %d", code)
+	}
+}
+
+func TestOnSignal(t *testing.T) {
+	hookCalls := 0
+	w, wErr := NewWatcher(10, func() error {
+		hookCalls++
+		return nil
+	})
+	if w == nil || wErr != nil {
+		t.Fatalf("TestOnSignal: should not be nil")
+	}
+	rotations := 0
+	if err := w.OnSignal(syscall.SIGUSR2, func() error {
+		rotations++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if code, terminal := w.dispatchSignal(syscall.SIGUSR2, nil); code != 0 || terminal || rotations != 1 {
+		t.Errorf("TestOnSignal: SIGUSR2 action not run, got %d %v %d", code, terminal, rotations)
+	}
+
+	// A registered action replaces the default for a terminating signal.
+	if err := w.OnSignal(syscall.SIGHUP, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, terminal := w.dispatchSignal(syscall.SIGHUP, nil); terminal || hookCalls != 0 {
+		t.Errorf("TestOnSignal: SIGHUP action should replace graceful shutdown")
+	}
+	if err := w.OnSignal(syscall.SIGHUP, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, terminal := w.dispatchSignal(syscall.SIGHUP, nil); !terminal || hookCalls != 1 {
+		t.Errorf("TestOnSignal: removing the action should restore graceful shutdown")
+	}
+}
+
+func TestSetUnhandledSignalHandler(t *testing.T) {
+	w, _ := NewWatcher(10)
+	// The default remains a no-op.
+	if _, terminal := w.dispatchSignal(syscall.SIGWINCH, nil); terminal {
+		t.Errorf("TestSetUnhandledSignalHandler: SIGWINCH should not be terminal")
+	}
+	var seen []os.Signal
+	if err := w.SetUnhandledSignalHandler(func(sig os.Signal) {
+		seen = append(seen, sig)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	w.dispatchSignal(syscall.SIGWINCH, nil)
+	w.dispatchSignal(syscall.SIGCHLD, nil)
+	w.dispatchSignal(syscall.SIGTERM, nil)
+	if len(seen) != 2 || seen[0] != syscall.SIGWINCH || seen[1] != syscall.SIGCHLD {
+		t.Errorf("TestSetUnhandledSignalHandler: handler saw %v", seen)
+	}
+}
+
+func TestSignals(t *testing.T) {
+	w, _ := NewWatcher(10)
+	custom := errors.New("rotate failed")
+	w.OnSignal(syscall.SIGUSR2, func() error { return custom })
+	sigs := make(chan os.Signal, 5)
+	for _, sig := range []os.Signal{syscall.SIGUSR2, syscall.SIGUSR1, syscall.SIGINT, syscall.SIGTERM} {
+		sigs <- sig
+	}
+	close(sigs)
+	var got []ShutdownEvent
+	for ev := range w.Signals(sigs) {
+		got = append(got, ev)
+	}
+	want := []ShutdownEvent{
+		{Signal: syscall.SIGUSR2, Action: ActionCustom, Err: custom},
+		{Signal: syscall.SIGUSR1, Action: ActionIgnored},
+		{Signal: syscall.SIGINT, Action: ActionImmediate, ExitCode: 1},
+		{Signal: syscall.SIGTERM, Action: ActionGraceful},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("TestSignals: expected %d events, got %v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("TestSignals: event %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+	if ActionGraceful.String() != "graceful" {
+		t.Errorf("TestSignals: unexpected action name %q", ActionGraceful)
+	}
+}
+
+func TestWithExitCodeMapper(t *testing.T) {
+	hookErr := errors.New("flush failed")
+	failHook := false
+	w, _ := NewWatcher(10, func() error {
+		if failHook {
+			return hookErr
+		}
+		return nil
+	})
+	if err := w.Configure(WithExitCodeMapper(nil)); err == nil {
+		t.Errorf("TestWithExitCodeMapper: nil mapper should be rejected")
+	}
+	if err := w.Configure(WithExitCodeMapper(func(sig os.Signal, r ShutdownResult) int {
+		switch {
+		case r.TimedOut:
+			return 124
+		case r.Err != nil:
+			return 2
+		}
+		return 128 + int(sig.(syscall.Signal))
+	})); err != nil {
+		t.Fatal(err)
+	}
+	// Clean.
+	if code, _ := w.dispatchSignal(syscall.SIGTERM, nil); code != 143 {
+		t.Errorf("TestWithExitCodeMapper: clean SIGTERM should exit 143, got %d", code)
+	}
+	// A required hook fails.
+	w.Reset()
+	failHook = true
+	if code, _ := w.dispatchSignal(syscall.SIGTERM, nil); code != 2 {
+		t.Errorf("TestWithExitCodeMapper: SIGTERM with a hook error should exit 2, got %d", code)
+	}
+	// The drain times out.
+	w.Reset()
+	failHook = false
+	w.RecordConnState(http.StateNew)
+	if code, _ := w.dispatchSignal(syscall.SIGTERM, nil); code != 124 {
+		t.Errorf("TestWithExitCodeMapper: timed out SIGTERM should exit 124, got %d", code)
+	}
+}
+
+func TestInterruptExitCode(t *testing.T) {
+	w, _ := NewWatcher(10)
+	if err := w.Configure(WithInterruptExitCode(256)); err == nil {
+		t.Errorf("TestInterruptExitCode: out of range code should be rejected")
+	}
+	if err := w.Configure(WithInterruptExitCode(130)); err != nil {
+		t.Fatal(err)
+	}
+	sigs := make(chan os.Signal, 1)
+	exitcode := make(chan int, 1)
+	sigs <- syscall.SIGINT
+	close(sigs)
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Errorf("TestInterruptExitCode: SIGINT should not panic, got %v", r)
+			}
+		}()
+		w.SigHandle(sigs, exitcode)
+	}()
+	select {
+	case code := <-exitcode:
+		if code != 130 {
+			t.Errorf("TestInterruptExitCode: expected exit code 130, got %d", code)
+		}
+	default:
+		t.Errorf("TestInterruptExitCode: no exit code was sent")
+	}
+}
+
+func TestSetPanicHandler(t *testing.T) {
+	w, _ := NewWatcher(10)
+	var got interface{}
+	if err := w.SetPanicHandler(func(v interface{}) { got = v }); err != nil {
+		t.Fatal(err)
+	}
+	sigs := make(chan os.Signal, 1)
+	sigs <- syscall.SIGINT
+	close(sigs)
+	func() {
+		defer func() {
+			if r := recover(); r != "panic exit" {
+				t.Errorf("TestSetPanicHandler: panic should continue after the handler, got %v", r)
+			}
+		}()
+		w.SigHandle(sigs, make(chan int, 1))
+	}()
+	if got != "panic exit" {
+		t.Errorf("TestSetPanicHandler: handler should receive the SIGINT panic, got %v", got)
+	}
+	var nw *Watcher
+	if err := nw.SetPanicHandler(nil); !errors.Is(err, ErrNilWatcher) {
+		t.Errorf("TestSetPanicHandler: nil watcher should return ErrNilWatcher, got %v", err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	w, _ := NewWatcher(50)
+	first, second := w.Subscribe(), w.Subscribe()
+	w.RecordConnState(http.StateNew)
+	sigs := make(chan os.Signal, 1)
+	exitcode := make(chan int, 1)
+	go w.SigHandle(sigs, exitcode)
+	sigs <- syscall.SIGTERM
+	if code := <-exitcode; code != 1 {
+		t.Errorf("TestSubscribe: expected exit code 1 for a timeout, got %d", code)
+	}
+	close(sigs)
+	for i, c := range []<-chan int{first, second, w.Subscribe()} {
+		code, ok := <-c
+		if !ok || code != 1 {
+			t.Errorf("TestSubscribe: subscriber %d expected code 1, got %d %v", i, code, ok)
+		}
+		if _, ok := <-c; ok {
+			t.Errorf("TestSubscribe: subscriber %d should receive the code only once", i)
+		}
+	}
+
+	// Reset forgets the published code.
+	w.Reset()
+	select {
+	case code := <-w.Subscribe():
+		t.Errorf("TestSubscribe: no code should be published after Reset, got %d", code)
+	default:
+	}
+	var nw *Watcher
+	if nw.Subscribe() != nil {
+		t.Errorf("TestSubscribe: nil watcher should return a nil channel")
+	}
+}
+
+func TestSigHandleClosedSigs(t *testing.T) {
+	w, _ := NewWatcher(10)
+	sigs := make(chan os.Signal)
+	exitcode := make(chan int)
+	go w.SigHandle(sigs, exitcode)
+	close(sigs)
+	select {
+	case code, ok := <-exitcode:
+		if ok {
+			t.Errorf("TestSigHandleClosedSigs: expected exitcode to be closed, got code %d", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestSigHandleClosedSigs: reader of exitcode deadlocked")
+	}
+}
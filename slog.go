@@ -0,0 +1,78 @@
+package httpdshutdown
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SetSlogLogger makes the watcher emit its lifecycle as structured records to
+// logger, in addition to any `Logger` set with `WithLogger`. Records carry these
+// attributes:
+//
+//     phase       the phase entered, on "shutdown phase changed" and "shutdown complete";
+//     open_conns  the open connection count, on the same records;
+//     hook_name   the hook, on "shutdown hook finished";
+//     duration    how long the hook or, on "shutdown complete", the shutdown took;
+//     error       the error, if any, on a hook or the shutdown as a whole.
+//
+// Warnings, such as a passed soft deadline, are logged at `slog.LevelWarn`, as are
+// failed hooks and shutdowns. Phase changes and the completion record are logged
+// while the watcher's lock is held, so the handler must not call back into the
+// watcher. A nil logger, the default, turns structured logging off.
+//
+// Example use:
+//
+//     watcher.SetSlogLogger(slog.Default().With("component", "shutdown"))
+//
+func (w *Watcher) SetSlogLogger(logger *slog.Logger) {
+	if w == nil {
+		panic("SetSlogLogger: receiver is nil")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.slogger = logger
+}
+
+// slogPhaseLocked records entering phase p with the structured logger, if any.
+// w.mu must be held.
+func (w *Watcher) slogPhaseLocked(p Phase) {
+	if w.slogger == nil {
+		return
+	}
+	w.slogger.Info("shutdown phase changed", "phase", p.String(), "open_conns", w.openConns)
+}
+
+// slogCompleteLocked records the completion of a shutdown that returned err with the
+// structured logger, if any. w.mu must be held.
+func (w *Watcher) slogCompleteLocked(err error) {
+	if w.slogger == nil {
+		return
+	}
+	attrs := []slog.Attr{slog.String("phase", w.phase.String()), slog.Int("open_conns", w.openConns)}
+	if w.report != nil {
+		attrs = append(attrs, slog.Duration("duration", w.report.Duration))
+	}
+	level := slog.LevelInfo
+	if err != nil {
+		level = slog.LevelWarn
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	w.slogger.LogAttrs(context.Background(), level, "shutdown complete", attrs...)
+}
+
+// slogHook records a finished hook with the structured logger, if any.
+func (w *Watcher) slogHook(ev HookEvent) {
+	w.mu.Lock()
+	logger := w.slogger
+	w.mu.Unlock()
+	if logger == nil || ev.Kind != HookFinished {
+		return
+	}
+	attrs := []slog.Attr{slog.String("hook_name", ev.Name), slog.Duration("duration", ev.Duration)}
+	level := slog.LevelInfo
+	if ev.Err != nil {
+		level = slog.LevelWarn
+		attrs = append(attrs, slog.String("error", ev.Err.Error()))
+	}
+	logger.LogAttrs(context.Background(), level, "shutdown hook finished", attrs...)
+}
@@ -0,0 +1,101 @@
+package httpdshutdown
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureHandler is a slog.Handler that keeps every record it handles.
+type captureHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *captureHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r)
+	return nil
+}
+
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *captureHandler) WithGroup(string) slog.Handler { return h }
+
+// find returns the attributes and level of the first record with message msg and, if
+// hook is not empty, that hook_name, and whether there was one.
+func (h *captureHandler) find(msg, hook string) (map[string]slog.Value, slog.Level, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.records {
+		attrs := make(map[string]slog.Value)
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value
+			return true
+		})
+		if r.Message == msg && (hook == "" || attrs["hook_name"].String() == hook) {
+			return attrs, r.Level, true
+		}
+	}
+	return nil, 0, false
+}
+
+func TestSetSlogLogger(t *testing.T) {
+	h := &captureHandler{}
+	w, _ := NewWatcher(1000)
+	w.SetSlogLogger(slog.New(h))
+	_ = w.RegisterNamedHook("flush", func() error {
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	})
+	_ = w.RegisterNamedHook("close-db", func() error { return errors.New("db gone") })
+	if err := w.OnStop(); err == nil {
+		t.Fatalf("TestSetSlogLogger: expected the hook error")
+	}
+
+	attrs, _, ok := h.find("shutdown phase changed", "")
+	if !ok || attrs["phase"].String() != "draining" || attrs["open_conns"].Int64() != 0 {
+		t.Errorf("TestSetSlogLogger: expected the draining phase with open_conns, got %v", attrs)
+	}
+	attrs, level, ok := h.find("shutdown hook finished", "flush")
+	if !ok || attrs["hook_name"].String() != "flush" || attrs["duration"].Duration() < 5*time.Millisecond ||
+		level != slog.LevelInfo {
+		t.Errorf("TestSetSlogLogger: expected flush with its duration, got %v", attrs)
+	}
+	if _, ok := attrs["error"]; ok {
+		t.Errorf("TestSetSlogLogger: a successful hook should have no error attribute")
+	}
+	attrs, level, ok = h.find("shutdown complete", "")
+	if !ok || attrs["phase"].String() != "done" || level != slog.LevelWarn {
+		t.Errorf("TestSetSlogLogger: expected a failed completion, got %v at %v", attrs, level)
+	}
+	if _, ok := attrs["duration"]; !ok {
+		t.Errorf("TestSetSlogLogger: the completion should carry the duration")
+	}
+	attrs, level, ok = h.find("shutdown hook finished", "close-db")
+	if !ok || attrs["error"].String() != "db gone" || level != slog.LevelWarn {
+		t.Errorf("TestSetSlogLogger: expected the failed hook's error, got %v at %v", attrs, level)
+	}
+
+	// Warnings are structured too, and a nil logger turns logging off.
+	h2 := &captureHandler{}
+	w, _ = NewWatcher(1000)
+	w.SetSlogLogger(slog.New(h2))
+	w.logf("httpdshutdown: %s", "warning")
+	if _, level, ok := h2.find("httpdshutdown: warning", ""); !ok || level != slog.LevelWarn {
+		t.Errorf("TestSetSlogLogger: expected the warning at LevelWarn")
+	}
+	w.SetSlogLogger(nil)
+	if err := w.OnStop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := h2.find("shutdown complete", ""); ok {
+		t.Errorf("TestSetSlogLogger: nothing should be logged once the logger is unset")
+	}
+}
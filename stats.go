@@ -0,0 +1,105 @@
+package httpdshutdown
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Stats is a snapshot of the watcher's connection counters, taken at a single instant
+// so that the values are consistent with each other.
+type Stats struct {
+	OpenConns      int   `json:"open_conns"`       // Connections currently open.
+	ActiveConns    int   `json:"active_conns"`     // Identified connections with a request in flight.
+	LongLivedConns int   `json:"long_lived_conns"` // Open connections tagged LongLived.
+	TotalConns     int   `json:"total_conns"`      // Connections opened since creation or Reset.
+	ClosedConns    int   `json:"closed_conns"`     // Connections ended with StateClosed.
+	HijackedConns  int   `json:"hijacked_conns"`   // Connections ended with StateHijacked.
+	RejectedConns  int   `json:"rejected_conns"`   // Connections closed on arrival by WithMaxConns.
+	Timeouts       int   `json:"timeouts"`         // Shutdowns that exceeded the grace period.
+	Draining       bool  `json:"draining"`         // Whether a shutdown has started.
+	Phase          Phase `json:"phase"`            // Current lifecycle phase.
+}
+
+// Stats returns a snapshot of the watcher's counters. Unlike calling `OpenConns`,
+// `TotalConns`, `ClosedConns` and the other accessors one after another, which may
+// interleave with connections opening and closing, every field is read under a single
+// acquisition of the watcher's lock, so for example OpenConns never exceeds
+// TotalConns. The snapshot does not change afterwards; call Stats again for fresh
+// values. It costs one lock acquisition and a struct copy, so it is cheap enough for
+// a dashboard to poll.
+func (w *Watcher) Stats() Stats {
+	if w == nil {
+		return Stats{}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return Stats{
+		OpenConns:      w.openConns,
+		ActiveConns:    w.activeConns,
+		LongLivedConns: w.longLived,
+		TotalConns:     w.totalConns,
+		ClosedConns:    w.closedConns,
+		HijackedConns:  w.hijackedConns,
+		RejectedConns:  w.rejectedConns,
+		Timeouts:       w.timeouts,
+		Draining:       w.draining.Load(),
+		Phase:          w.phase,
+	}
+}
+
+// DebugString returns a human-readable summary of the watcher for diagnosing a drain
+// that misbehaves: the phase, the connection counters from `Stats`, the timeout
+// configuration and the names from `HookNames`, one per line. It is handy to log from
+// an `OnSignal` action for SIGUSR1. The format is meant for people and may change.
+//
+// Example output:
+//
+//     phase:       draining
+//     connections: open=2 active=1 long-lived=0 total=5 closed=3 hijacked=0 rejected=0
+//     timeouts:    0
+//     timeout:     10s, hooks budget 2s
+//     hooks:       flush, hook[1]
+//
+func (w *Watcher) DebugString() string {
+	if w == nil {
+		return "httpdshutdown: nil Watcher"
+	}
+	st := w.Stats()
+	hooks := w.HookNames()
+	w.mu.Lock()
+	timeout := []string{w.timeout.String()}
+	for _, d := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"soft deadline", w.soft},
+		{"stall", w.stall},
+		{"min drain", w.minDrain},
+		{"pre-stop delay", w.preStopDelay},
+		{"hooks budget", w.hooksTimeout},
+	} {
+		if d.d > 0 {
+			timeout = append(timeout, d.name+" "+d.d.String())
+		}
+	}
+	faults := w.faults
+	w.mu.Unlock()
+	hookList := "none"
+	if len(hooks) > 0 {
+		hookList = strings.Join(hooks, ", ")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "phase:       %v\n", st.Phase)
+	fmt.Fprintf(&b, "connections: open=%d active=%d long-lived=%d total=%d closed=%d hijacked=%d rejected=%d\n",
+		st.OpenConns, st.ActiveConns, st.LongLivedConns, st.TotalConns, st.ClosedConns, st.HijackedConns,
+		st.RejectedConns)
+	fmt.Fprintf(&b, "timeouts:    %d\n", st.Timeouts)
+	fmt.Fprintf(&b, "timeout:     %s\n", strings.Join(timeout, ", "))
+	fmt.Fprintf(&b, "hooks:       %s\n", hookList)
+	if faults != nil {
+		fmt.Fprintf(&b, "faults:      %v\n", faults)
+	}
+	return b.String()
+}
@@ -0,0 +1,86 @@
+package httpdshutdown
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	w, _ := NewWatcher(100)
+	w.RecordConnState(http.StateNew)
+	w.RecordConnState(http.StateNew)
+	w.RecordConnStateTagged(http.StateNew, LongLived)
+	w.RecordConnState(http.StateHijacked)
+	w.RecordConnState(http.StateClosed)
+	want := Stats{OpenConns: 1, LongLivedConns: 1, TotalConns: 3, ClosedConns: 1, HijackedConns: 1, Phase: PhaseRunning}
+	if got := w.Stats(); got != want {
+		t.Errorf("TestStats: expected %+v, got %+v", want, got)
+	}
+
+	// Under churn every snapshot stays consistent.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				w.RecordConnState(http.StateNew)
+				w.RecordConnState(http.StateClosed)
+			}
+		}()
+	}
+	for i := 0; i < 500; i++ {
+		s := w.Stats()
+		if s.OpenConns+s.ClosedConns+s.HijackedConns != s.TotalConns {
+			t.Fatalf("TestStats: inconsistent snapshot %+v", s)
+		}
+	}
+	wg.Wait()
+	var nw *Watcher
+	if nw.Stats() != (Stats{}) {
+		t.Errorf("TestStats: nil watcher should return zero stats")
+	}
+}
+
+func TestStatsTimeouts(t *testing.T) {
+	w, _ := NewWatcher(10)
+	w.RecordConnState(http.StateNew)
+	for i := 0; i < 2; i++ {
+		_ = w.OnStop()
+	}
+	if n := w.Stats().Timeouts; n != 2 {
+		t.Errorf("TestStatsTimeouts: expected 2 timeouts, got %d", n)
+	}
+	w.Reset()
+	if n := w.Stats().Timeouts; n != 0 {
+		t.Errorf("TestStatsTimeouts: Reset should clear the count, got %d", n)
+	}
+}
+
+func TestDebugString(t *testing.T) {
+	w, _ := NewWatcher(10000)
+	_ = w.Configure(WithHooksTimeout(2 * time.Second))
+	_ = w.RegisterNamedHook("flush", func() error { return nil })
+	_ = w.RegisterHook(func() error { return nil })
+	w.RecordConnState(http.StateNew)
+	w.RecordConnState(http.StateNew)
+	w.RecordConnState(http.StateClosed)
+	s := w.DebugString()
+	for _, want := range []string{
+		"phase:       running\n",
+		"open=1 ", "total=2 ", "closed=1 ", "hijacked=0 ",
+		"timeout:     10s, hooks budget 2s\n",
+		"hooks:       flush, hook[1]\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("TestDebugString: expected %q in:\n%s", want, s)
+		}
+	}
+	var nw *Watcher
+	if s := nw.DebugString(); !strings.Contains(s, "nil Watcher") {
+		t.Errorf("TestDebugString: nil watcher should say so, got %q", s)
+	}
+}
@@ -0,0 +1,118 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Stream is a long-lived response, such as a Server-Sent Events stream or a long
+// poll, registered with `StartStream` so that it can be told about a shutdown.
+type Stream struct {
+	w      *Watcher
+	notify func()
+	once   sync.Once
+}
+
+// StartStream registers a long-lived response whose notify function is called once
+// when a shutdown begins, before the watcher starts waiting on open connections. The
+// notify function should tell the handler to send its goodbye, for instance with
+// `WriteSSEShutdown`, and return, so that the connection drains at once rather than
+// holding up the shutdown until the timeout. It runs on the shutdown's goroutine and
+// must return promptly; in particular it must not write to the response itself while
+// the handler may be writing. If a shutdown has already begun, notify is called
+// before StartStream returns. The handler calls `Done` when the stream ends.
+//
+// Example use:
+//
+//     bye := make(chan struct{})
+//     s := watcher.StartStream(func() { close(bye) })
+//     defer s.Done()
+//     for {
+//             select {
+//             case <-bye:
+//                     httpdshutdown.WriteSSEShutdown(rw, 5*time.Second)
+//                     return
+//             case ev := <-events:
+//                     fmt.Fprintf(rw, "data: %s\n\n", ev)
+//                     rw.(http.Flusher).Flush()
+//             }
+//     }
+//
+func (w *Watcher) StartStream(notify func()) *Stream {
+	if w == nil {
+		panic("StartStream: receiver is nil")
+	}
+	if notify == nil {
+		panic("StartStream: notify is nil")
+	}
+	s := &Stream{w: w, notify: notify}
+	w.mu.Lock()
+	if w.streams == nil {
+		w.streams = make(map[*Stream]struct{})
+	}
+	w.streams[s] = struct{}{}
+	draining := w.draining.Load()
+	w.mu.Unlock()
+	if draining {
+		s.once.Do(s.notify)
+	}
+	return s
+}
+
+// Done stops tracking the stream. It must be called when the stream ends, however it
+// ends.
+func (s *Stream) Done() {
+	s.w.mu.Lock()
+	defer s.w.mu.Unlock()
+	delete(s.w.streams, s)
+}
+
+// Streams returns the number of streams registered with `StartStream` that have not
+// called `Done`.
+func (w *Watcher) Streams() int {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.streams)
+}
+
+// notifyStreams calls the notify function of every stream in progress that has not
+// been notified yet.
+func (w *Watcher) notifyStreams() {
+	w.mu.Lock()
+	streams := make([]*Stream, 0, len(w.streams))
+	for s := range w.streams {
+		streams = append(streams, s)
+	}
+	w.mu.Unlock()
+	for _, s := range streams {
+		s.once.Do(s.notify)
+	}
+}
+
+// WriteSSEShutdown writes a final Server-Sent Events message to rw and flushes it. The
+// message is a comment announcing the shutdown together with a retry field, so that
+// clients reconnect after retry, to another instance behind the load balancer, rather
+// than treating the closed stream as an error. A retry of zero or less leaves the
+// client's reconnection delay unchanged.
+func WriteSSEShutdown(rw http.ResponseWriter, retry time.Duration) error {
+	if rw == nil {
+		return errors.New("WriteSSEShutdown: rw is nil")
+	}
+	msg := ": server shutting down\n"
+	if retry > 0 {
+		msg += fmt.Sprintf("retry: %d\n", retry.Milliseconds())
+	}
+	if _, err := fmt.Fprint(rw, msg+"\n"); err != nil {
+		return fmt.Errorf("WriteSSEShutdown: %w", err)
+	}
+	if f, ok := rw.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package httpdshutdown
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartStream(t *testing.T) {
+	// A 5s grace period that the SSE stream would hold up to the end if it were not
+	// told to close.
+	w, _ := NewWatcher(5000)
+	started := make(chan struct{})
+	srv, url := startServer(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		bye := make(chan struct{})
+		s := w.StartStream(func() { close(bye) })
+		defer s.Done()
+		rw.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(rw, "data: hello\n\n")
+		rw.(http.Flusher).Flush()
+		close(started)
+		<-bye
+		_ = WriteSSEShutdown(rw, 3*time.Second)
+	}), w.AttachServer)
+	defer srv.Close()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		var b strings.Builder
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			b.WriteString(sc.Text() + "\n")
+		}
+		body <- b.String()
+	}()
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestStartStream: stream never started")
+	}
+	if n := w.Streams(); n != 1 {
+		t.Errorf("TestStartStream: expected 1 stream, got %d", n)
+	}
+
+	begin := time.Now()
+	if err := w.OnStop(); err != nil {
+		t.Fatalf("TestStartStream: %v", err)
+	}
+	if d := time.Since(begin); d > time.Second {
+		t.Errorf("TestStartStream: the stream should drain promptly, took %v", d)
+	}
+	got := <-body
+	if !strings.Contains(got, "data: hello\n") || !strings.Contains(got, "retry: 3000\n") {
+		t.Errorf("TestStartStream: expected the goodbye after the event, got %q", got)
+	}
+	if n := w.Streams(); n != 0 {
+		t.Errorf("TestStartStream: expected no streams after the drain, got %d", n)
+	}
+
+	// A stream started once the shutdown has begun is notified at once.
+	notified := false
+	w.StartStream(func() { notified = true }).Done()
+	if !notified {
+		t.Errorf("TestStartStream: a late stream should be notified immediately")
+	}
+}
+
+func TestWriteSSEShutdown(t *testing.T) {
+	rec := httptest.NewRecorder()
+	if err := WriteSSEShutdown(rec, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.Body.String(); got != ": server shutting down\n\n" {
+		t.Errorf("TestWriteSSEShutdown: unexpected message %q", got)
+	}
+	if !rec.Flushed {
+		t.Errorf("TestWriteSSEShutdown: the message should be flushed")
+	}
+	if err := WriteSSEShutdown(nil, time.Second); err == nil {
+		t.Errorf("TestWriteSSEShutdown: a nil writer should be rejected")
+	}
+}
@@ -0,0 +1,52 @@
+package httpdshutdown
+
+import (
+	"context"
+	"errors"
+)
+
+// HookTracer traces the shutdown hooks, for example as OpenTelemetry spans with the
+// `httpdshutdownotel` subpackage, which keeps the tracing dependency out of this
+// package. Each start method returns the context to run under, carrying the new span,
+// and a function that ends the span with the error, if any.
+type HookTracer interface {
+	// StartShutdown is called as the shutdown hooks begin to run. Its context is the
+	// parent of every hook's, and end gets the hooks' joined error once they have all
+	// finished.
+	StartShutdown(ctx context.Context) (context.Context, func(err error))
+	// StartHook is called as the hook registered under name starts, and end once it
+	// has finished, retries included. Context hooks get the returned context.
+	StartHook(ctx context.Context, name string) (context.Context, func(err error))
+}
+
+// WithHookTracer traces the shutdown hooks run by `OnStop`, `RunHooks` and the like
+// with tracer: one span for the hooks of a shutdown, with a child span for each hook.
+// Timeout hooks, rollbacks and finalizers are not traced.
+//
+// Example use:
+//
+//     tracer := httpdshutdownotel.NewTracer(otel.GetTracerProvider())
+//     watcher.Configure(httpdshutdown.WithHookTracer(tracer))
+//
+func WithHookTracer(tracer HookTracer) Option {
+	return func(w *Watcher) error {
+		if tracer == nil {
+			return errors.New("WithHookTracer: tracer is nil")
+		}
+		w.hookTracer = tracer
+		return nil
+	}
+}
+
+// hookTracerKey is the context key under which runHooks passes the tracer to runHook.
+type hookTracerKey struct{}
+
+// startHookSpan starts a span for the hook named name if ctx carries a tracer. It
+// returns the context the hook runs under and a function ending the span.
+func startHookSpan(ctx context.Context, name string) (context.Context, func(error)) {
+	tracer, ok := ctx.Value(hookTracerKey{}).(HookTracer)
+	if !ok {
+		return ctx, func(error) {}
+	}
+	return tracer.StartHook(ctx, name)
+}
@@ -0,0 +1,85 @@
+package httpdshutdown
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// spanKey is the context key under which fakeTracer stores the current span's name.
+type spanKey struct{}
+
+// fakeSpan is a span recorded by fakeTracer.
+type fakeSpan struct {
+	name, parent string
+	err          error
+	ended        bool
+}
+
+// fakeTracer records the spans it starts.
+type fakeTracer struct {
+	mu    sync.Mutex
+	spans []*fakeSpan
+}
+
+func (f *fakeTracer) start(ctx context.Context, name string) (context.Context, func(error)) {
+	parent, _ := ctx.Value(spanKey{}).(string)
+	s := &fakeSpan{name: name, parent: parent}
+	f.mu.Lock()
+	f.spans = append(f.spans, s)
+	f.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, name), func(err error) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		s.err, s.ended = err, true
+	}
+}
+
+func (f *fakeTracer) StartShutdown(ctx context.Context) (context.Context, func(error)) {
+	return f.start(ctx, "graceful-shutdown")
+}
+
+func (f *fakeTracer) StartHook(ctx context.Context, name string) (context.Context, func(error)) {
+	return f.start(ctx, name)
+}
+
+func TestWithHookTracer(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	if err := w.Configure(WithHookTracer(nil)); err == nil {
+		t.Errorf("TestWithHookTracer: nil tracer should be rejected")
+	}
+	tracer := &fakeTracer{}
+	if err := w.Configure(WithHookTracer(tracer)); err != nil {
+		t.Fatal(err)
+	}
+	var hookSpan string
+	_ = w.RegisterContextHook("flush", func(ctx context.Context) error {
+		hookSpan, _ = ctx.Value(spanKey{}).(string)
+		return nil
+	})
+	_ = w.RegisterNamedHook("close-db", func() error { return errors.New("db gone") })
+	if err := w.OnStop(); err == nil {
+		t.Fatalf("TestWithHookTracer: expected the hook error")
+	}
+
+	if hookSpan != "flush" {
+		t.Errorf("TestWithHookTracer: the context hook should run under its span, got %q", hookSpan)
+	}
+	if len(tracer.spans) != 3 {
+		t.Fatalf("TestWithHookTracer: expected 3 spans, got %d", len(tracer.spans))
+	}
+	for i, want := range []fakeSpan{
+		{name: "graceful-shutdown"},
+		{name: "flush", parent: "graceful-shutdown"},
+		{name: "close-db", parent: "graceful-shutdown"},
+	} {
+		s := tracer.spans[i]
+		if s.name != want.name || s.parent != want.parent || !s.ended {
+			t.Errorf("TestWithHookTracer: unexpected span %d: %+v", i, s)
+		}
+		if failed := s.name != "flush"; (s.err != nil) != failed {
+			t.Errorf("TestWithHookTracer: span %s: unexpected error %v", s.name, s.err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TransferProgress describes how far a transfer reported with `StartTransfer` has
+// come.
+type TransferProgress struct {
+	Sent    int64         // Bytes sent so far.
+	Total   int64         // Total size in bytes; zero or less if unknown.
+	Elapsed time.Duration // Time since the transfer started.
+}
+
+// TransferPolicy decides, when a shutdown begins, whether a transfer in progress is
+// left to finish within grace, the time remaining in the grace period, or is cut
+// so that the drain does not wait for it. It returns true to let the transfer finish.
+type TransferPolicy func(p TransferProgress, grace time.Duration) bool
+
+// FinishIfFits is a `TransferPolicy` that lets a transfer finish if, at the rate
+// observed so far, it would complete within the grace period. A nearly complete
+// download is thus not stranded, while one that just started, or whose size is
+// unknown, is cut at once rather than holding up the drain only to be killed at the
+// timeout.
+func FinishIfFits(p TransferProgress, grace time.Duration) bool {
+	if p.Total <= 0 || p.Sent <= 0 || p.Elapsed <= 0 {
+		return false
+	}
+	if p.Sent >= p.Total {
+		return true
+	}
+	remaining := time.Duration(float64(p.Total-p.Sent) / float64(p.Sent) * float64(p.Elapsed))
+	return remaining <= grace
+}
+
+// Transfer reports the progress of a streaming response so that a `TransferPolicy`
+// can decide whether it may finish during a shutdown. Create one with
+// `StartTransfer`.
+type Transfer struct {
+	w       *Watcher
+	total   int64
+	start   time.Time
+	sent    atomic.Int64
+	cut     chan struct{}
+	cutOnce sync.Once
+}
+
+// StartTransfer registers a streaming response of total bytes, or of unknown size if
+// total is zero or less. The handler reports each write with `Add`, stops writing
+// once `Cut` is closed and calls `Done` when the transfer ends. Transfers are only cut
+// if a policy is set with `WithTransferPolicy`.
+//
+// Example use:
+//
+//     t := watcher.StartTransfer(size)
+//     defer t.Done()
+//     for {
+//             select {
+//             case <-t.Cut():
+//                     return
+//             default:
+//             }
+//             n, err := f.Read(buf)
+//             ...
+//             rw.Write(buf[:n])
+//             t.Add(n)
+//     }
+//
+func (w *Watcher) StartTransfer(total int64) *Transfer {
+	if w == nil {
+		panic("StartTransfer: receiver is nil")
+	}
+	t := &Transfer{w: w, total: total, start: w.clock.Now(), cut: make(chan struct{})}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.transfers == nil {
+		w.transfers = make(map[*Transfer]struct{})
+	}
+	w.transfers[t] = struct{}{}
+	return t
+}
+
+// Add records that n more bytes were sent.
+func (t *Transfer) Add(n int) {
+	t.sent.Add(int64(n))
+}
+
+// Cut returns a channel that is closed if the transfer should be abandoned because a
+// shutdown has begun and the policy decided it would not finish in time.
+func (t *Transfer) Cut() <-chan struct{} {
+	return t.cut
+}
+
+// Done stops tracking the transfer. It must be called when the transfer ends, however
+// it ends.
+func (t *Transfer) Done() {
+	t.w.mu.Lock()
+	defer t.w.mu.Unlock()
+	delete(t.w.transfers, t)
+}
+
+// progress reports the transfer's progress at now.
+func (t *Transfer) progress(now time.Time) TransferProgress {
+	return TransferProgress{Sent: t.sent.Load(), Total: t.total, Elapsed: now.Sub(t.start)}
+}
+
+// WithTransferPolicy sets the policy applied to the transfers in progress when a
+// shutdown begins. Transfers the policy does not let finish have their `Cut` channel
+// closed. Use `FinishIfFits` for a policy that favors nearly complete transfers.
+func WithTransferPolicy(policy TransferPolicy) Option {
+	return func(w *Watcher) error {
+		if policy == nil {
+			return errors.New("WithTransferPolicy: policy is nil")
+		}
+		w.transferPolicy = policy
+		return nil
+	}
+}
+
+// cutTransfers applies the transfer policy, if any, to the transfers in progress,
+// given grace remaining in the grace period.
+func (w *Watcher) cutTransfers(grace time.Duration) {
+	w.mu.Lock()
+	policy := w.transferPolicy
+	transfers := make([]*Transfer, 0, len(w.transfers))
+	for t := range w.transfers {
+		transfers = append(transfers, t)
+	}
+	w.mu.Unlock()
+	if policy == nil {
+		return
+	}
+	now := w.clock.Now()
+	for _, t := range transfers {
+		if !policy(t.progress(now), grace) {
+			t.cutOnce.Do(func() { close(t.cut) })
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package httpdshutdown
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFinishIfFits(t *testing.T) {
+	grace := time.Second
+	for _, tc := range []struct {
+		p      TransferProgress
+		finish bool
+	}{
+		// 90% done at 1 byte/ms; the last 100 bytes take 100ms.
+		{TransferProgress{Sent: 900, Total: 1000, Elapsed: 900 * time.Millisecond}, true},
+		// 10% done after a second; the rest would take 9s.
+		{TransferProgress{Sent: 100, Total: 1000, Elapsed: time.Second}, false},
+		// Just started: nothing sent, so no rate to go on.
+		{TransferProgress{Sent: 0, Total: 1000, Elapsed: time.Millisecond}, false},
+		// Unknown size.
+		{TransferProgress{Sent: 900, Total: 0, Elapsed: time.Second}, false},
+		{TransferProgress{Sent: 1000, Total: 1000, Elapsed: time.Second}, true},
+	} {
+		if got := FinishIfFits(tc.p, grace); got != tc.finish {
+			t.Errorf("TestFinishIfFits: %+v: expected %v, got %v", tc.p, tc.finish, got)
+		}
+	}
+}
+
+func TestTransferPolicy(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	fc := newFakeClock()
+	w.clock = fc
+	if err := w.Configure(WithTransferPolicy(nil)); err == nil {
+		t.Errorf("TestTransferPolicy: nil policy should be rejected")
+	}
+	if err := w.Configure(WithTransferPolicy(FinishIfFits)); err != nil {
+		t.Fatal(err)
+	}
+	nearlyDone := w.StartTransfer(1000)
+	fc.Advance(900 * time.Millisecond)
+	nearlyDone.Add(900)
+	justStarted := w.StartTransfer(1000)
+	finished := w.StartTransfer(1000)
+	finished.Done()
+
+	if err := w.OnStop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-nearlyDone.Cut():
+		t.Errorf("TestTransferPolicy: a nearly complete transfer should be left to finish")
+	default:
+	}
+	select {
+	case <-justStarted.Cut():
+	default:
+		t.Errorf("TestTransferPolicy: a transfer that just started should be cut")
+	}
+	select {
+	case <-finished.Cut():
+		t.Errorf("TestTransferPolicy: a finished transfer should not be cut")
+	default:
+	}
+	nearlyDone.Done()
+	justStarted.Done()
+}
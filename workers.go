@@ -0,0 +1,116 @@
+package httpdshutdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WorkerGroup is a pool of background workers drained by a shutdown alongside the
+// connections. See `RegisterWorkerGroup`.
+type WorkerGroup interface {
+	// Quiesce stops the workers from taking new work and returns once all of them
+	// have finished, or with the error of ctx once ctx is done.
+	Quiesce(ctx context.Context) error
+}
+
+// WaitGroupWorkers adapts wg to a `WorkerGroup` whose Quiesce waits for wg's counter
+// to reach zero. Telling the workers to stop is left to the application, for example
+// through the watcher's `Context`. A wait that times out leaves a goroutine blocked
+// on wg until the workers do finish.
+func WaitGroupWorkers(wg *sync.WaitGroup) WorkerGroup {
+	return waitGroupWorkers{wg}
+}
+
+type waitGroupWorkers struct {
+	wg *sync.WaitGroup
+}
+
+func (g waitGroupWorkers) Quiesce(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RegisterWorkerGroup adds a pool of background workers that every shutdown drains
+// concurrently with the connections, within the same grace period. Hooks only run
+// once the connections have drained and every worker group has quiesced. A group
+// still busy when the grace period expires makes `OnStop` return an error wrapping
+// `ErrShutdownTimeout`; any other error from Quiesce is returned as well.
+//
+// Example use:
+//
+//     var workers sync.WaitGroup
+//     for i := 0; i < 8; i++ {
+//             workers.Add(1)
+//             go func() {
+//                     defer workers.Done()
+//                     consume(watcher.Context(), jobs)
+//             }()
+//     }
+//     watcher.RegisterWorkerGroup(httpdshutdown.WaitGroupWorkers(&workers))
+//
+func (w *Watcher) RegisterWorkerGroup(g WorkerGroup) error {
+	if w == nil {
+		return fmt.Errorf("RegisterWorkerGroup: %w", ErrNilWatcher)
+	}
+	if g == nil {
+		return errors.New("RegisterWorkerGroup: group is nil")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.workerGroups = append(w.workerGroups, g)
+	return nil
+}
+
+// quiesceWorkers starts quiescing groups concurrently, each with a context that
+// expires after timeout or once cancel is closed. The returned function waits for
+// all of them and returns their errors joined.
+func (w *Watcher) quiesceWorkers(groups []WorkerGroup, timeout time.Duration, cancel <-chan struct{}) func() error {
+	if len(groups) == 0 {
+		return func() error { return nil }
+	}
+	ctx, ctxCancel := withClockDeadline(context.Background(), w.clock, w.clock.Now().Add(timeout))
+	errs := make([]error, len(groups))
+	var wg sync.WaitGroup
+	for i, g := range groups {
+		wg.Add(1)
+		go func(i int, g WorkerGroup) {
+			defer wg.Done()
+			err := g.Quiesce(ctx)
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = ErrShutdownTimeout
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("OnStop: worker group %d: %w", i, err)
+			}
+		}(i, g)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	go func() {
+		select {
+		case <-cancel:
+			ctxCancel()
+		case <-done:
+		}
+	}()
+	return func() error {
+		<-done
+		ctxCancel()
+		return errors.Join(errs...)
+	}
+}
@@ -0,0 +1,72 @@
+package httpdshutdown
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegisterWorkerGroup(t *testing.T) {
+	w, _ := NewWatcher(1000)
+	var workers sync.WaitGroup
+	workers.Add(1)
+	if err := w.RegisterWorkerGroup(WaitGroupWorkers(&workers)); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var order []string
+	finish := func(what string, after time.Duration, fn func()) {
+		go func() {
+			time.Sleep(after)
+			mu.Lock()
+			order = append(order, what)
+			mu.Unlock()
+			fn()
+		}()
+	}
+	_ = w.RegisterHook(func() error {
+		mu.Lock()
+		order = append(order, "hook")
+		mu.Unlock()
+		return nil
+	})
+
+	// The shutdown waits for the connection and the worker, whichever finishes last.
+	w.RecordConnState(http.StateNew)
+	finish("conn", 20*time.Millisecond, func() { w.RecordConnState(http.StateClosed) })
+	finish("worker", 60*time.Millisecond, workers.Done)
+	start := time.Now()
+	if err := w.OnStop(); err != nil {
+		t.Errorf("TestRegisterWorkerGroup: should not have an error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("TestRegisterWorkerGroup: OnStop should wait for the worker, took %v", elapsed)
+	}
+	mu.Lock()
+	if got := strings.Join(order, ","); got != "conn,worker,hook" {
+		t.Errorf("TestRegisterWorkerGroup: expected hooks after the drain, got %s", got)
+	}
+	mu.Unlock()
+
+	// A worker still busy at the end of the grace period times the shutdown out.
+	w, _ = NewWatcher(50)
+	var stuck sync.WaitGroup
+	stuck.Add(1)
+	defer stuck.Done()
+	_ = w.RegisterWorkerGroup(WaitGroupWorkers(&stuck))
+	err := w.OnStop()
+	if !errors.Is(err, ErrShutdownTimeout) || !strings.Contains(err.Error(), "worker group 0") {
+		t.Errorf("TestRegisterWorkerGroup: expected the worker group to time out, got %v", err)
+	}
+
+	if err := w.RegisterWorkerGroup(nil); err == nil {
+		t.Errorf("TestRegisterWorkerGroup: nil group should be rejected")
+	}
+	var nw *Watcher
+	if err := nw.RegisterWorkerGroup(WaitGroupWorkers(&workers)); !errors.Is(err, ErrNilWatcher) {
+		t.Errorf("TestRegisterWorkerGroup: nil watcher should return ErrNilWatcher, got %v", err)
+	}
+}